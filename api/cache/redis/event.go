@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	eventStream         = "events"
+	eventStreamGroup    = "loop"
+	eventStreamConsumer = "loop"
+)
+
+// EventRedisQueue buffers the events reported by devices in a redis stream
+// until the loop service persists them.
+type EventRedisQueue struct {
+	rdb *redis.Client
+}
+
+func (q *EventRedisQueue) Add(ctx context.Context, events []domain.Event) error {
+	_, err := q.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range events {
+			b, err := json.Marshal(&events[i])
+			if err != nil {
+				return err
+			}
+			err = pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: eventStream,
+				MaxLen: REDIS_EVENTS_MAX_LEN,
+				Approx: true,
+				Values: []interface{}{"e", string(b)},
+			}).Err()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (q *EventRedisQueue) Read(ctx context.Context, count int) ([]domain.QueuedEvent, error) {
+	// pending events first, in case the last run failed before acking them
+	for _, start := range []string{"0", ">"} {
+		streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    eventStreamGroup,
+			Consumer: eventStreamConsumer,
+			Streams:  []string{eventStream, start},
+			Count:    int64(count),
+			Block:    -1,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			continue
+		}
+		ret := make([]domain.QueuedEvent, 0, len(streams[0].Messages))
+		for _, m := range streams[0].Messages {
+			qe := domain.QueuedEvent{ID: m.ID}
+			s, _ := m.Values["e"].(string)
+			if err := json.Unmarshal([]byte(s), &qe.Event); err != nil {
+				// acked along with the rest so it does not block the queue
+				log.Println("bad event", m.ID, err)
+				qe.Event = domain.Event{}
+			}
+			ret = append(ret, qe)
+		}
+		return ret, nil
+	}
+	return []domain.QueuedEvent{}, nil
+}
+
+func (q *EventRedisQueue) Ack(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := pipe.XAck(ctx, eventStream, eventStreamGroup, ids...).Err(); err != nil {
+			return err
+		}
+		return pipe.XDel(ctx, eventStream, ids...).Err()
+	})
+	return err
+}
+
+// LoadScripts creates the consumer group of the stream.
+func (q *EventRedisQueue) LoadScripts(ctx context.Context) error {
+	err := q.rdb.XGroupCreateMkStream(ctx, eventStream, eventStreamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func NewEventRedisQueue() *EventRedisQueue {
+	return &EventRedisQueue{
+		rdb: redis.NewClient(&redis.Options{
+			Addr:            REDIS_ADDR,
+			Password:        "",
+			DB:              REDIS_DATABASE_EVENTS,
+			MaxRetries:      3,
+			MinRetryBackoff: REDIS_MIN_RETRY_BACKOFF,
+			MaxRetryBackoff: REDIS_MAX_RETRY_BACKOFF,
+			OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+				log.Println("redis:", "OnConnect()", "Event")
+				return nil
+			},
+		}),
+	}
+}
@@ -0,0 +1,92 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// InAppMessageRedisCache keeps the active in-app messages of each project and
+// counts their views and clicks with the keys and scripts of notifications, in
+// a database of its own. The impressions of each device are kept in
+// {pid}.f.{id}.{device_id} for the frequency caps.
+type InAppMessageRedisCache struct {
+	*NotificationRedisCache
+
+	scriptIncrImpressions string
+}
+
+// IncrDeviceImpressionsIds counts an impression by the device of each of the
+// messages in periods that is active. The count of a message starts over after
+// its period, or is kept for REDIS_IN_APP_MESSAGE_IMPRESSIONS_EXPIRY if the
+// period is 0.
+func (m *InAppMessageRedisCache) IncrDeviceImpressionsIds(ctx context.Context, pid string, deviceID string, periods map[string]time.Duration) error {
+	if len(periods) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(periods)+1)
+	keys = append(keys, fmt.Sprintf("%s.i", pid))
+	args := make([]interface{}, 0, 2*len(periods))
+	for id, period := range periods {
+		if period <= 0 {
+			period = REDIS_IN_APP_MESSAGE_IMPRESSIONS_EXPIRY
+		}
+		keys = append(keys, fmt.Sprintf("%s.f.%s.%s", pid, id, deviceID))
+		args = append(args, id, int(period.Seconds()))
+	}
+	err := m.rdb.EvalSha(
+		ctx,
+		m.scriptIncrImpressions,
+		keys,
+		args...,
+	).Err()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
+
+func (m *InAppMessageRedisCache) GetDeviceImpressions(ctx context.Context, pid string, deviceID string, ids []string) (map[string]int, error) {
+	ret := make(map[string]int, len(ids))
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("%s.f.%s.%s", pid, id, deviceID)
+	}
+	res, err := m.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		s, ok := res[i].(string)
+		if !ok {
+			continue
+		}
+		count, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, ErrRedisBadValue
+		}
+		ret[id] = count
+	}
+	return ret, nil
+}
+
+func (m *InAppMessageRedisCache) LoadScripts(ctx context.Context) error {
+	err := m.NotificationRedisCache.LoadScripts(ctx)
+	if err != nil {
+		return err
+	}
+	m.scriptIncrImpressions, err = m.rdb.ScriptLoad(ctx, "for i = 2, #KEYS do if redis.call('HEXISTS', KEYS[1], ARGV[2 * i - 3]) == 1 then local c = redis.call('INCR', KEYS[i]); if c == 1 then redis.call('EXPIRE', KEYS[i], ARGV[2 * i - 2]) end end end; return nil").Result()
+	return err
+}
+
+func NewInAppMessageRedisCache() *InAppMessageRedisCache {
+	return &InAppMessageRedisCache{
+		NotificationRedisCache: newNotificationRedisCache(REDIS_DATABASE_IN_APP, "InAppMessage"),
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,7 +16,12 @@ import (
 type NotificationRedisCache struct {
 	rdb *redis.Client
 
-	scriptIncrClicks string
+	scriptIncrClicks    string
+	scriptIncrClicksIds string
+	scriptIncrViews     string
+	scriptGetAndReset   string
+	scriptGetAndDelete  string
+	scriptSetIds        string
 }
 
 func (n *NotificationRedisCache) GetTimeByProjectID(ctx context.Context, pid string) (*time.Time, error) {
@@ -33,7 +40,7 @@ func (n *NotificationRedisCache) GetDataExistsByProjectID(ctx context.Context, p
 	ret, err := n.rdb.Exists(
 		ctx,
 		fmt.Sprintf("%s.t", pid),
-		fmt.Sprintf("%s.v", pid),
+		fmt.Sprintf("%s.i", pid),
 		fmt.Sprintf("%s.c", pid),
 		fmt.Sprintf("%s.d", pid),
 	).Result()
@@ -44,43 +51,47 @@ func (n *NotificationRedisCache) GetDataExistsByProjectID(ctx context.Context, p
 }
 
 func (n *NotificationRedisCache) GetDataByProjectID(ctx context.Context, pid string) (*string, error) {
-	pipe := n.rdb.TxPipeline()
-	cmd := pipe.Get(ctx, fmt.Sprintf("%s.d", pid))
-	_ = pipe.Incr(ctx, fmt.Sprintf("%s.v", pid))
-	_, err := pipe.Exec(ctx)
+	data, err := n.rdb.Get(ctx, fmt.Sprintf("%s.d", pid)).Result()
 	if err != nil {
 		return nil, err
 	}
-	data := cmd.Val()
 	return &data, nil
 }
 
+func (n *NotificationRedisCache) GetETagByProjectID(ctx context.Context, pid string) (string, error) {
+	return n.rdb.Get(ctx, fmt.Sprintf("%s.e", pid)).Result()
+}
+
 func (n *NotificationRedisCache) UpdateProjectData(ctx context.Context, pid string, ids string, data string, t time.Time, expire time.Duration) error {
 	_, err := n.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 		err := pipe.SetEX(ctx, fmt.Sprintf("%s.t", pid), t, expire).Err()
 		if err != nil {
 			return err
 		}
-		err = pipe.SetEX(ctx, fmt.Sprintf("%s.v", pid), 0, expire).Err()
-		if err != nil {
-			return err
-		}
 		// log.Println("ids =", ids)
 		idArr := strings.Split(ids, " ")
 		if len(idArr) == 0 {
 			return errors.New("len(ids) = 0")
 		}
-		args := make([]string, 2*len(idArr))
+		args := make([]interface{}, len(idArr))
 		for i, id := range idArr {
-			args[i*2] = id
-			args[i*2+1] = "0"
+			args[i] = id
 		}
-		// log.Println("args:", args)
-		err = pipe.HSet(ctx, fmt.Sprintf("%s.c", pid), args).Err()
-		if err != nil {
-			return err
+		// the counters of notifications that are still active are kept since
+		// they may not have been flushed yet
+		for _, key := range []string{fmt.Sprintf("%s.i", pid), fmt.Sprintf("%s.c", pid)} {
+			err = pipe.EvalSha(ctx, n.scriptSetIds, []string{key}, args...).Err()
+			if err != nil {
+				return err
+			}
+			err = pipe.Expire(ctx, key, expire).Err()
+			if err != nil {
+				return err
+			}
 		}
-		err = pipe.Expire(ctx, fmt.Sprintf("%s.c", pid), expire).Err()
+		h := fnv.New64a()
+		h.Write([]byte(data))
+		err = pipe.SetEX(ctx, fmt.Sprintf("%s.e", pid), strconv.FormatUint(h.Sum64(), 16), expire).Err()
 		if err != nil {
 			return err
 		}
@@ -93,8 +104,11 @@ func (n *NotificationRedisCache) DeleteProjectData(ctx context.Context, pid stri
 	return n.rdb.Del(
 		ctx,
 		fmt.Sprintf("%s.t", pid),
-		fmt.Sprintf("%s.v", pid),
+		fmt.Sprintf("%s.i", pid),
 		fmt.Sprintf("%s.c", pid),
+		fmt.Sprintf("%s.iv", pid),
+		fmt.Sprintf("%s.cv", pid),
+		fmt.Sprintf("%s.e", pid),
 		fmt.Sprintf("%s.d", pid),
 	).Err()
 }
@@ -105,7 +119,7 @@ func (n *NotificationRedisCache) SetProjectDataExpire(ctx context.Context, pid s
 		if err != nil {
 			return err
 		}
-		err = pipe.Expire(ctx, fmt.Sprintf("%s.v", pid), expiration).Err()
+		err = pipe.Expire(ctx, fmt.Sprintf("%s.i", pid), expiration).Err()
 		if err != nil {
 			return err
 		}
@@ -113,17 +127,69 @@ func (n *NotificationRedisCache) SetProjectDataExpire(ctx context.Context, pid s
 		if err != nil {
 			return err
 		}
+		err = pipe.Expire(ctx, fmt.Sprintf("%s.e", pid), expiration).Err()
+		if err != nil {
+			return err
+		}
 		return pipe.Expire(ctx, fmt.Sprintf("%s.d", pid), expiration).Err()
 	})
 	return err
 }
 
-func (n *NotificationRedisCache) GetViewsByProjectID(ctx context.Context, pid string) (string, error) {
-	return n.rdb.Get(ctx, fmt.Sprintf("%s.v", pid)).Result()
+// GetAndResetViewsByProjectID returns the impressions reported for each active
+// notification since the last call.
+func (n *NotificationRedisCache) GetAndResetViewsByProjectID(ctx context.Context, pid string) (map[string]string, error) {
+	return n.getAndReset(ctx, n.scriptGetAndReset, fmt.Sprintf("%s.i", pid))
+}
+
+// GetAndResetClicksByProjectID returns the clicks reported for each active
+// notification since the last call.
+func (n *NotificationRedisCache) GetAndResetClicksByProjectID(ctx context.Context, pid string) (map[string]string, error) {
+	return n.getAndReset(ctx, n.scriptGetAndReset, fmt.Sprintf("%s.c", pid))
 }
 
-func (n *NotificationRedisCache) GetClicksByProjectID(ctx context.Context, pid string) (map[string]string, error) {
-	return n.rdb.HGetAll(ctx, fmt.Sprintf("%s.c", pid)).Result()
+// GetAndResetAppVersionViewsByProjectID returns the impressions reported since
+// the last call by notification and app version, keyed {id}:{app_version}.
+func (n *NotificationRedisCache) GetAndResetAppVersionViewsByProjectID(ctx context.Context, pid string) (map[string]string, error) {
+	return n.getAndReset(ctx, n.scriptGetAndDelete, fmt.Sprintf("%s.iv", pid))
+}
+
+// GetAndResetAppVersionClicksByProjectID returns the clicks reported since the
+// last call by notification and app version, keyed {id}:{app_version}.
+func (n *NotificationRedisCache) GetAndResetAppVersionClicksByProjectID(ctx context.Context, pid string) (map[string]string, error) {
+	return n.getAndReset(ctx, n.scriptGetAndDelete, fmt.Sprintf("%s.cv", pid))
+}
+
+func (n *NotificationRedisCache) getAndReset(ctx context.Context, script string, key string) (map[string]string, error) {
+	res, err := n.rdb.EvalSha(ctx, script, []string{key}).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(res)/2)
+	for i := 0; i+1 < len(res); i += 2 {
+		ret[res[i]] = res[i+1]
+	}
+	return ret, nil
+}
+
+// GetReachByProjectID returns the estimated number of devices that have seen
+// each of the notifications.
+func (n *NotificationRedisCache) GetReachByProjectID(ctx context.Context, pid string, ids []string) (map[string]int64, error) {
+	cmds := make([]*redis.IntCmd, len(ids))
+	_, err := n.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.PFCount(ctx, fmt.Sprintf("%s.u.%s", pid, id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]int64, len(ids))
+	for i, id := range ids {
+		ret[id] = cmds[i].Val()
+	}
+	return ret, nil
 }
 
 func (n *NotificationRedisCache) IncrClicks(ctx context.Context, pid string, id string) error {
@@ -134,14 +200,40 @@ func (n *NotificationRedisCache) IncrClicks(ctx context.Context, pid string, id
 	).Err()
 }
 
-func (n *NotificationRedisCache) IncrClicksIds(ctx context.Context, pid string, ids []string) error {
+// IncrClicksIds counts a click on each of the notifications, both in total and
+// for the app version of the device.
+func (n *NotificationRedisCache) IncrClicksIds(ctx context.Context, pid string, appVersion int, ids []string) error {
 	for _, id := range ids {
 		err := n.rdb.EvalSha(
 			ctx,
-			n.scriptIncrClicks,
-			[]string{fmt.Sprintf("%s.c", pid), id},
+			n.scriptIncrClicksIds,
+			[]string{fmt.Sprintf("%s.c", pid), fmt.Sprintf("%s.cv", pid)},
+			id,
+			fmt.Sprintf("%s:%d", id, appVersion),
 		).Err()
-		if err != redis.Nil {
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IncrViewsIds counts an impression of each of the notifications, both in
+// total and for the app version of the device. If the device id is known it is
+// also added to the reach of the notifications, so a device that reports the
+// same notification again is counted once.
+func (n *NotificationRedisCache) IncrViewsIds(ctx context.Context, pid string, deviceID string, appVersion int, ids []string) error {
+	for _, id := range ids {
+		err := n.rdb.EvalSha(
+			ctx,
+			n.scriptIncrViews,
+			[]string{fmt.Sprintf("%s.i", pid), fmt.Sprintf("%s.u.%s", pid, id), fmt.Sprintf("%s.iv", pid)},
+			id,
+			deviceID,
+			int(REDIS_NOTIFICATION_REACH_EXPIRY.Seconds()),
+			fmt.Sprintf("%s:%d", id, appVersion),
+		).Err()
+		if err != nil && err != redis.Nil {
 			return err
 		}
 	}
@@ -154,22 +246,48 @@ func (n *NotificationRedisCache) LoadScripts(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	n.scriptIncrClicksIds, err = n.rdb.ScriptLoad(ctx, "if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then return nil end; redis.call('HINCRBY', KEYS[1], ARGV[1], 1); redis.call('HINCRBY', KEYS[2], ARGV[2], 1); local ttl = redis.call('TTL', KEYS[1]); if ttl > 0 then redis.call('EXPIRE', KEYS[2], ttl) end; return 1").Result()
+	if err != nil {
+		return err
+	}
+	n.scriptIncrViews, err = n.rdb.ScriptLoad(ctx, "if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then return nil end; redis.call('HINCRBY', KEYS[1], ARGV[1], 1); redis.call('HINCRBY', KEYS[3], ARGV[4], 1); local ttl = redis.call('TTL', KEYS[1]); if ttl > 0 then redis.call('EXPIRE', KEYS[3], ttl) end; if ARGV[2] ~= '' then redis.call('PFADD', KEYS[2], ARGV[2]); redis.call('EXPIRE', KEYS[2], ARGV[3]) end; return 1").Result()
+	if err != nil {
+		return err
+	}
+	n.scriptGetAndReset, err = n.rdb.ScriptLoad(ctx, "local r = redis.call('HGETALL', KEYS[1]); for i = 1, #r, 2 do redis.call('HSET', KEYS[1], r[i], 0) end; return r").Result()
+	if err != nil {
+		return err
+	}
+	n.scriptGetAndDelete, err = n.rdb.ScriptLoad(ctx, "local r = redis.call('HGETALL', KEYS[1]); redis.call('DEL', KEYS[1]); return r").Result()
+	if err != nil {
+		return err
+	}
+	n.scriptSetIds, err = n.rdb.ScriptLoad(ctx, "local ids = {}; for _, id in ipairs(ARGV) do ids[id] = true; redis.call('HSETNX', KEYS[1], id, 0) end; for _, f in ipairs(redis.call('HKEYS', KEYS[1])) do if not ids[f] then redis.call('HDEL', KEYS[1], f) end end; return 1").Result()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func NewNotificationRedisCache() *NotificationRedisCache {
+// newNotificationRedisCache makes a cache of notifications, or of anything
+// that is served and counted like them, in the database db.
+func newNotificationRedisCache(db int, name string) *NotificationRedisCache {
 	return &NotificationRedisCache{
 		rdb: redis.NewClient(&redis.Options{
 			Addr:            REDIS_ADDR,
 			Password:        "",
-			DB:              REDIS_DATABASE_NOTIFICATOINS,
+			DB:              db,
 			MaxRetries:      3,
 			MinRetryBackoff: REDIS_MIN_RETRY_BACKOFF,
 			MaxRetryBackoff: REDIS_MAX_RETRY_BACKOFF,
 			OnConnect: func(ctx context.Context, cn *redis.Conn) error {
-				log.Println("redis:", "OnConnect()", "Notification")
+				log.Println("redis:", "OnConnect()", name)
 				return nil
 			},
 		}),
 	}
 }
+
+func NewNotificationRedisCache() *NotificationRedisCache {
+	return newNotificationRedisCache(REDIS_DATABASE_NOTIFICATOINS, "Notification")
+}
@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/go-redis/redis/v8"
+)
+
+const streamChannelPrefix = "stream."
+
+// StreamRedisPubSub fans stream events out through redis pub/sub. All the
+// subscribers of a process share a single redis subscription, which listens
+// to the channels of the projects that have at least one subscriber.
+type StreamRedisPubSub struct {
+	rdb *redis.Client
+
+	mu          sync.Mutex
+	pubsub      *redis.PubSub
+	subscribers map[string]map[chan *domain.StreamEvent]struct{}
+}
+
+func (s *StreamRedisPubSub) Publish(ctx context.Context, pid string, e *domain.StreamEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Publish(ctx, streamChannelPrefix+pid, b).Err()
+}
+
+func (s *StreamRedisPubSub) Subscribe(ctx context.Context, pid string) (<-chan *domain.StreamEvent, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pubsub == nil {
+		s.pubsub = s.rdb.Subscribe(context.Background())
+		go s.receive(s.pubsub)
+	}
+	if len(s.subscribers[pid]) == 0 {
+		if err := s.pubsub.Subscribe(ctx, streamChannelPrefix+pid); err != nil {
+			return nil, nil, err
+		}
+		s.subscribers[pid] = make(map[chan *domain.StreamEvent]struct{})
+	}
+	ch := make(chan *domain.StreamEvent, 8)
+	s.subscribers[pid][ch] = struct{}{}
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.unsubscribe(pid, ch)
+		})
+	}, nil
+}
+
+func (s *StreamRedisPubSub) unsubscribe(pid string, ch chan *domain.StreamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers[pid], ch)
+	if len(s.subscribers[pid]) > 0 {
+		return
+	}
+	delete(s.subscribers, pid)
+	if err := s.pubsub.Unsubscribe(context.Background(), streamChannelPrefix+pid); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *StreamRedisPubSub) receive(pubsub *redis.PubSub) {
+	for msg := range pubsub.Channel() {
+		pid := strings.TrimPrefix(msg.Channel, streamChannelPrefix)
+		e := &domain.StreamEvent{}
+		if err := json.Unmarshal([]byte(msg.Payload), e); err != nil {
+			log.Println("bad stream event on", msg.Channel, err)
+			continue
+		}
+		s.mu.Lock()
+		for ch := range s.subscribers[pid] {
+			select {
+			case ch <- e:
+			default:
+				// the client is too slow. it will get the next event
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func NewStreamRedisPubSub() *StreamRedisPubSub {
+	return &StreamRedisPubSub{
+		rdb: redis.NewClient(&redis.Options{
+			Addr:            REDIS_ADDR,
+			Password:        "",
+			MaxRetries:      3,
+			MinRetryBackoff: REDIS_MIN_RETRY_BACKOFF,
+			MaxRetryBackoff: REDIS_MAX_RETRY_BACKOFF,
+			OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+				log.Println("redis:", "OnConnect()", "Stream")
+				return nil
+			},
+		}),
+		subscribers: make(map[string]map[chan *domain.StreamEvent]struct{}),
+	}
+}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
@@ -11,6 +12,23 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
+// remoteConfigSnapshot is a published version of a remote config as kept in
+// the {pid}.h hash.
+type remoteConfigSnapshot struct {
+	Data        string  `json:"d"`
+	Rules       *string `json:"r,omitempty"`
+	Experiments *string `json:"x,omitempty"`
+}
+
+// remoteConfigKey is the key prefix of a remote config namespace. The default
+// namespace keeps the {pid} prefix it had before namespaces existed.
+func remoteConfigKey(pid string, namespace string) string {
+	if namespace == "" || namespace == domain.RC_DEFAULT_NAMESPACE {
+		return pid
+	}
+	return fmt.Sprintf("%s:%s", pid, namespace)
+}
+
 type RemoteConfigRedisCache struct {
 	rdb        *redis.Client
 	dataExpiry time.Duration
@@ -18,11 +36,11 @@ type RemoteConfigRedisCache struct {
 	scriptUpdateRC string
 }
 
-func (c *RemoteConfigRedisCache) GetDataExistsByProjectID(ctx context.Context, pid string) (bool, error) {
+func (c *RemoteConfigRedisCache) GetDataExistsByProjectID(ctx context.Context, pid string, namespace string) (bool, error) {
 	ret, err := c.rdb.Exists(
 		ctx,
-		fmt.Sprintf("%s.v", pid),
-		fmt.Sprintf("%s.d", pid),
+		fmt.Sprintf("%s.v", remoteConfigKey(pid, namespace)),
+		fmt.Sprintf("%s.d", remoteConfigKey(pid, namespace)),
 	).Result()
 	if err != nil {
 		return false, err
@@ -30,8 +48,8 @@ func (c *RemoteConfigRedisCache) GetDataExistsByProjectID(ctx context.Context, p
 	return ret == 2, nil
 }
 
-func (c *RemoteConfigRedisCache) GetVersionByProjectID(ctx context.Context, pid string) (*int, error) {
-	v, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.v", pid), c.dataExpiry).Result()
+func (c *RemoteConfigRedisCache) GetVersionByProjectID(ctx context.Context, pid string, namespace string) (*int, error) {
+	v, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.v", remoteConfigKey(pid, namespace)), c.dataExpiry).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -42,30 +60,160 @@ func (c *RemoteConfigRedisCache) GetVersionByProjectID(ctx context.Context, pid
 	return &version, nil
 }
 
-func (c *RemoteConfigRedisCache) GetDataByProjectID(ctx context.Context, pid string) (*string, error) {
-	data, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.d", pid), c.dataExpiry).Result()
+func (c *RemoteConfigRedisCache) GetUpdateTimeByProjectID(ctx context.Context, pid string, namespace string) (*time.Time, error) {
+	t, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.t", remoteConfigKey(pid, namespace)), c.dataExpiry).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (c *RemoteConfigRedisCache) GetDataByProjectID(ctx context.Context, pid string, namespace string) (*string, error) {
+	data, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.d", remoteConfigKey(pid, namespace)), c.dataExpiry).Result()
 	if err != nil {
 		return nil, err
 	}
 	return &data, nil
 }
 
+func (c *RemoteConfigRedisCache) GetRulesByProjectID(ctx context.Context, pid string, namespace string) (*string, error) {
+	rules, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.r", remoteConfigKey(pid, namespace)), c.dataExpiry).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+func (c *RemoteConfigRedisCache) GetExperimentsByProjectID(ctx context.Context, pid string, namespace string) (*string, error) {
+	experiments, err := c.rdb.GetEx(ctx, fmt.Sprintf("%s.x", remoteConfigKey(pid, namespace)), c.dataExpiry).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &experiments, nil
+}
+
+// GetByVersion returns one of the last REDIS_RC_HISTORY_SIZE versions of the
+// remote config.
+func (c *RemoteConfigRedisCache) GetByVersion(ctx context.Context, pid string, namespace string, version int) (*domain.RemoteConfig, error) {
+	s, err := c.rdb.HGet(ctx, fmt.Sprintf("%s.h", remoteConfigKey(pid, namespace)), strconv.Itoa(version)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var snapshot remoteConfigSnapshot
+	if err := json.Unmarshal([]byte(s), &snapshot); err != nil {
+		return nil, err
+	}
+	return &domain.RemoteConfig{
+		ProjectID:   pid,
+		Namespace:   namespace,
+		Data:        snapshot.Data,
+		Rules:       snapshot.Rules,
+		Experiments: snapshot.Experiments,
+		Version:     version,
+	}, nil
+}
+
+// AddExposures adds the device to the exposed devices of each variant. The
+// variants are kept in {pid}.ev and their devices in {pid}.eu.{key}, so a
+// device that fetches the remote config again is counted once.
+func (c *RemoteConfigRedisCache) AddExposures(ctx context.Context, pid string, deviceID string, keys []string) error {
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			if err := pipe.SAdd(ctx, fmt.Sprintf("%s.ev", pid), k).Err(); err != nil {
+				return err
+			}
+			if err := pipe.PFAdd(ctx, fmt.Sprintf("%s.eu.%s", pid, k), deviceID).Err(); err != nil {
+				return err
+			}
+			if err := pipe.Expire(ctx, fmt.Sprintf("%s.eu.%s", pid, k), REDIS_EXPERIMENT_EXPOSURES_EXPIRY).Err(); err != nil {
+				return err
+			}
+		}
+		return pipe.Expire(ctx, fmt.Sprintf("%s.ev", pid), REDIS_EXPERIMENT_EXPOSURES_EXPIRY).Err()
+	})
+	return err
+}
+
+// GetExposures returns the estimated number of devices exposed to each
+// variant so far.
+func (c *RemoteConfigRedisCache) GetExposures(ctx context.Context, pid string) (map[string]int64, error) {
+	keys, err := c.rdb.SMembers(ctx, fmt.Sprintf("%s.ev", pid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err = c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.PFCount(ctx, fmt.Sprintf("%s.eu.%s", pid, k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]int64, len(keys))
+	for i, k := range keys {
+		ret[k] = cmds[i].Val()
+	}
+	return ret, nil
+}
+
 func (c *RemoteConfigRedisCache) Update(ctx context.Context, rc *domain.RemoteConfig) error {
+	var rules string
+	if rc.Rules != nil {
+		rules = *rc.Rules
+	}
+	var experiments string
+	if rc.Experiments != nil {
+		experiments = *rc.Experiments
+	}
+	var updateTime string
+	if rc.UpdateTime != nil {
+		updateTime = rc.UpdateTime.UTC().Format(time.RFC3339)
+	}
+	snapshot, err := json.Marshal(&remoteConfigSnapshot{
+		Data:        rc.Data,
+		Rules:       rc.Rules,
+		Experiments: rc.Experiments,
+	})
+	if err != nil {
+		return err
+	}
+	key := remoteConfigKey(rc.ProjectID, rc.Namespace)
 	return c.rdb.EvalSha(
 		ctx,
 		c.scriptUpdateRC,
 		[]string{
-			fmt.Sprintf("%s.v", rc.ProjectID),
-			fmt.Sprintf("%s.d", rc.ProjectID),
+			fmt.Sprintf("%s.v", key),
+			fmt.Sprintf("%s.d", key),
+			fmt.Sprintf("%s.r", key),
+			fmt.Sprintf("%s.x", key),
+			fmt.Sprintf("%s.t", key),
+			fmt.Sprintf("%s.h", key),
 		},
 		rc.Version,
 		rc.Data,
+		rules,
+		experiments,
+		updateTime,
+		snapshot,
+		REDIS_RC_HISTORY_SIZE,
 	).Err()
 }
 
 func (c *RemoteConfigRedisCache) LoadScripts(ctx context.Context) error {
 	var err error
-	c.scriptUpdateRC, err = c.rdb.ScriptLoad(ctx, "local v = tonumber(redis.call('GET', KEYS[1])); if v and tonumber(ARGV[1]) <= v then return nil else redis.call('SET', KEYS[1], ARGV[1]); return redis.call('SET', KEYS[2], ARGV[2]) end").Result()
+	c.scriptUpdateRC, err = c.rdb.ScriptLoad(ctx, "local v = tonumber(redis.call('GET', KEYS[1])); if v and tonumber(ARGV[1]) <= v then return nil end; redis.call('SET', KEYS[1], ARGV[1]); for i = 3, 5 do if ARGV[i] == '' then redis.call('DEL', KEYS[i]) else redis.call('SET', KEYS[i], ARGV[i]) end end; redis.call('HSET', KEYS[6], ARGV[1], ARGV[6]); for _, f in ipairs(redis.call('HKEYS', KEYS[6])) do if tonumber(f) <= tonumber(ARGV[1]) - tonumber(ARGV[7]) then redis.call('HDEL', KEYS[6], f) end end; return redis.call('SET', KEYS[2], ARGV[2])").Result()
 	if err != nil {
 		return err
 	}
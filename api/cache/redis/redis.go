@@ -16,4 +16,19 @@ const (
 	REDIS_DATABASE_AUTH          = 0
 	REDIS_DATABASE_RC            = 1
 	REDIS_DATABASE_NOTIFICATOINS = 2
+	REDIS_DATABASE_EVENTS        = 3
+	REDIS_DATABASE_IN_APP        = 4
+	REDIS_RC_HISTORY_SIZE        = 10
+	// how long the devices that have seen a notification are remembered
+	// after its last impression
+	REDIS_NOTIFICATION_REACH_EXPIRY = 7 * 24 * time.Hour
+	// how long the devices exposed to an experiment variant are remembered
+	// after its last exposure
+	REDIS_EXPERIMENT_EXPOSURES_EXPIRY = 30 * 24 * time.Hour
+	// how long the impressions of an in-app message by a device are
+	// remembered if its frequency cap has no period
+	REDIS_IN_APP_MESSAGE_IMPRESSIONS_EXPIRY = 30 * 24 * time.Hour
+	// the events stream is trimmed to about this many events if the loop
+	// service falls behind
+	REDIS_EVENTS_MAX_LEN = 1000000
 )
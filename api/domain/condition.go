@@ -0,0 +1,199 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// RemoteConfigCondition is a named rule that matches devices. Every field that
+// is set must match for the condition to be true.
+type RemoteConfigCondition struct {
+	Name          string              `json:"name"`
+	MinAppVersion *int                `json:"min_app_version,omitempty"`
+	MaxAppVersion *int                `json:"max_app_version,omitempty"`
+	Platforms     []string            `json:"platforms,omitempty"`
+	Locales       []string            `json:"locales,omitempty"`
+	Countries     []string            `json:"countries,omitempty"`
+	Models        []string            `json:"models,omitempty"`
+	Properties    map[string][]string `json:"properties,omitempty"`
+	PercentFrom   *float64            `json:"percent_from,omitempty"`
+	PercentTo     *float64            `json:"percent_to,omitempty"`
+	Seed          string              `json:"seed,omitempty"`
+}
+
+// RemoteConfigRules holds the conditions of a remote config and the values its
+// parameters take when a condition matches. Parameters maps a top-level key of
+// the remote config data to condition names and their values.
+type RemoteConfigRules struct {
+	Conditions []RemoteConfigCondition               `json:"conditions"`
+	Parameters map[string]map[string]json.RawMessage `json:"parameters"`
+}
+
+func (c *RemoteConfigCondition) Matches(device *DeviceInfo) bool {
+	if c.MinAppVersion != nil && device.AppVersion < *c.MinAppVersion {
+		return false
+	}
+	if c.MaxAppVersion != nil && (device.AppVersion == 0 || device.AppVersion > *c.MaxAppVersion) {
+		return false
+	}
+	if len(c.Platforms) > 0 && !containsString(c.Platforms, strings.ToLower(device.Platform)) {
+		return false
+	}
+	if len(c.Locales) > 0 && !containsString(c.Locales, strings.ToLower(strings.ReplaceAll(device.Locale, "_", "-"))) && !containsString(c.Locales, device.Language()) {
+		return false
+	}
+	if len(c.Countries) > 0 && !containsString(c.Countries, device.Region()) {
+		return false
+	}
+	if len(c.Models) > 0 && !containsString(c.Models, strings.ToLower(device.Model)) {
+		return false
+	}
+	for key, values := range c.Properties {
+		value, ok := device.Properties[key]
+		if !ok || !containsString(values, value) {
+			return false
+		}
+	}
+	if c.PercentFrom != nil || c.PercentTo != nil {
+		if device.ID == "" {
+			return false
+		}
+		seed := c.Seed
+		if seed == "" {
+			seed = c.Name
+		}
+		bucket := PercentBucket(seed, device.ID)
+		if c.PercentFrom != nil && bucket < *c.PercentFrom {
+			return false
+		}
+		if c.PercentTo != nil && bucket >= *c.PercentTo {
+			return false
+		}
+	}
+	return true
+}
+
+// PercentBucket deterministically maps a device to a value in [0, 100).
+func PercentBucket(seed string, deviceID string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(seed))
+	h.Write([]byte{'.'})
+	h.Write([]byte(deviceID))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// Compile validates the condition and normalizes it for evaluation. The name
+// is checked by the caller, e.g. RemoteConfigRules.Compile.
+func (c *RemoteConfigCondition) Compile() error {
+	if c.MinAppVersion != nil && c.MaxAppVersion != nil && *c.MinAppVersion > *c.MaxAppVersion {
+		return fmt.Errorf("condition %s: min_app_version > max_app_version", c.Name)
+	}
+	for _, p := range []*float64{c.PercentFrom, c.PercentTo} {
+		if p != nil && (*p < 0 || *p > 100) {
+			return fmt.Errorf("condition %s: percent must be between 0 and 100", c.Name)
+		}
+	}
+	if c.PercentFrom != nil && c.PercentTo != nil && *c.PercentFrom > *c.PercentTo {
+		return fmt.Errorf("condition %s: percent_from > percent_to", c.Name)
+	}
+	for key, values := range c.Properties {
+		if key == "" || len(values) == 0 {
+			return fmt.Errorf("condition %s: bad property %s", c.Name, key)
+		}
+	}
+	lowerStrings(c.Platforms)
+	lowerStrings(c.Locales)
+	lowerStrings(c.Countries)
+	lowerStrings(c.Models)
+	for j, l := range c.Locales {
+		c.Locales[j] = strings.ReplaceAll(l, "_", "-")
+	}
+	return nil
+}
+
+// Compile validates the rules and normalizes them for evaluation.
+func (r *RemoteConfigRules) Compile() error {
+	names := make(map[string]bool)
+	for i := range r.Conditions {
+		c := &r.Conditions[i]
+		if c.Name == "" {
+			return fmt.Errorf("condition %d has no name", i)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate condition name %s", c.Name)
+		}
+		names[c.Name] = true
+		if err := c.Compile(); err != nil {
+			return err
+		}
+	}
+	for key, values := range r.Parameters {
+		if key == "" {
+			return errors.New("empty parameter key")
+		}
+		for name := range values {
+			if !names[name] {
+				return fmt.Errorf("parameter %s: unknown condition %s", key, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *RemoteConfigRules) IsEmpty() bool {
+	return len(r.Conditions) == 0 && len(r.Parameters) == 0
+}
+
+// Resolve returns the remote config data as seen by the given device. For each
+// parameter the value of the first matching condition, in the order conditions
+// are defined, replaces the default value in data.
+func (r *RemoteConfigRules) Resolve(data string, device *DeviceInfo) (string, error) {
+	if len(r.Parameters) == 0 {
+		return data, nil
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		// only objects have parameters
+		return data, nil
+	}
+	resolved := make(map[string]bool)
+	for _, c := range r.Conditions {
+		if !c.Matches(device) {
+			continue
+		}
+		for key, conditionalValues := range r.Parameters {
+			value, ok := conditionalValues[c.Name]
+			if !ok || resolved[key] {
+				continue
+			}
+			values[key] = value
+			resolved[key] = true
+		}
+	}
+	if len(resolved) == 0 {
+		return data, nil
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func containsString(arr []string, s string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerStrings(arr []string) {
+	for i, s := range arr {
+		arr[i] = strings.ToLower(s)
+	}
+}
@@ -0,0 +1,34 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	PUSH_PROVIDER_FCM     = "fcm"
+	PUSH_PROVIDER_APNS    = "apns"
+	PUSH_PROVIDER_WEBPUSH = "webpush"
+)
+
+// PushCredential is the secret a project uses to send through a push provider,
+// e.g. the service account JSON of a firebase project or the .p8 key of an
+// APNs team.
+type PushCredential struct {
+	PID        string     `json:"pid"`
+	Provider   string     `json:"provider"`
+	Data       []byte     `json:"-"`
+	CreateTime *time.Time `json:"create_time"`
+	UpdateTime *time.Time `json:"update_time"`
+}
+
+type PushCredentialRepository interface {
+	// GetByPID returns the credentials of the project without their data.
+	GetByPID(ctx context.Context, pid string) ([]PushCredential, error)
+	Get(ctx context.Context, pid string, provider string) (*PushCredential, error)
+	GetUpdateTime(ctx context.Context, pid string, provider string) (*time.Time, error)
+	// Upsert stores the credential, replacing the current one of the
+	// provider.
+	Upsert(ctx context.Context, c *PushCredential) error
+	Delete(ctx context.Context, pid string, provider string) error
+}
@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// DeviceInfo describes the device a public request was made from, as reported
+// by the client in query parameters.
+type DeviceInfo struct {
+	ID         string
+	AppVersion int
+	Platform   string
+	Locale     string
+	Country    string
+	Model      string
+	// TZOffset is the offset of the device timezone from UTC in minutes, e.g.
+	// 210 for +03:30.
+	TZOffset   int
+	Properties map[string]string
+}
+
+// Language returns the language part of the device locale, e.g. "fa" for "fa-IR".
+func (d *DeviceInfo) Language() string {
+	parts := strings.FieldsFunc(d.Locale, isLocaleSeparator)
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.ToLower(parts[0])
+}
+
+// Region returns the device country, falling back to the region part of the
+// locale when the client did not send one.
+func (d *DeviceInfo) Region() string {
+	if d.Country != "" {
+		return strings.ToLower(d.Country)
+	}
+	parts := strings.FieldsFunc(d.Locale, isLocaleSeparator)
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.ToLower(parts[len(parts)-1])
+}
+
+func isLocaleSeparator(r rune) bool {
+	return r == '-' || r == '_'
+}
+
+// Device is an install of a project app as registered by the client.
+type Device struct {
+	PID        string  `json:"pid"`
+	InstallID  string  `json:"install_id"`
+	AppVersion int     `json:"app_version"`
+	OSVersion  string  `json:"os_version"`
+	Locale     string  `json:"locale"`
+	FCMToken   *string `json:"fcm_token,omitempty"`
+	APNsToken  *string `json:"apns_token,omitempty"`
+	// WebPushSubscription is the JSON of the PushSubscription of a browser.
+	WebPushSubscription *string    `json:"web_push_subscription,omitempty"`
+	CreateTime          *time.Time `json:"create_time"`
+	LastSeen            *time.Time `json:"last_seen"`
+}
+
+// DeviceStats are the install counts of a project.
+type DeviceStats struct {
+	Installs      int `json:"installs"`
+	Active1d      int `json:"active_1d"`
+	Active7d      int `json:"active_7d"`
+	Active30d     int `json:"active_30d"`
+	WithFCMToken  int `json:"with_fcm_token"`
+	WithAPNsToken int `json:"with_apns_token"`
+	WithWebPush   int `json:"with_web_push"`
+}
+
+type DeviceRepository interface {
+	GetByInstallID(ctx context.Context, pid string, installID string) (*Device, error)
+	// Register inserts the device or updates it if the install is already
+	// known. Either way the last seen time of the device is set to now. Known
+	// push tokens are kept if the device does not report them.
+	Register(ctx context.Context, d *Device) error
+	GetStats(ctx context.Context, pid string) (*DeviceStats, error)
+	// GetPushTokens returns the tokens of the devices for the push provider.
+	// For web push the tokens are the subscriptions of the browsers.
+	GetPushTokens(ctx context.Context, pid string, provider string) ([]string, error)
+	// DeletePushTokens forgets tokens that the provider does not accept
+	// anymore.
+	DeletePushTokens(ctx context.Context, pid string, provider string, tokens []string) (int64, error)
+}
@@ -0,0 +1,109 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const (
+	EVENT_NOTIFICATION_DISMISSED = "notification_dismissed"
+	EVENT_NOTIFICATION_CONVERTED = "notification_converted"
+	EVENT_RC_APPLIED             = "rc_applied"
+)
+
+const (
+	EVENT_MAX_PROPERTIES = 20
+	// the lengths of the columns of events
+	EVENT_MAX_DEVICE_ID_LENGTH = 100
+	EVENT_MAX_NAMESPACE_LENGTH = 50
+	// events older than this are rejected, e.g. when a device was offline for
+	// too long
+	EVENT_MAX_AGE = 7 * 24 * time.Hour
+)
+
+var (
+	ErrBadEventType        = errors.New("bad event type")
+	ErrBadEventTime        = errors.New("bad event time")
+	ErrNoEventNotification = errors.New("no notification_id")
+	ErrBadEventProperties  = errors.New("bad event properties")
+	ErrBadEventDeviceID    = errors.New("bad event device_id")
+	ErrBadEventNamespace   = errors.New("bad event namespace")
+)
+
+var eventTypeRegexp = regexp.MustCompile(`^[a-z0-9_]{1,50}$`)
+
+// Event is something that happened on a device, reported by the client. Other
+// than the predefined types any lowercase name can be used for custom events.
+type Event struct {
+	PID            string            `json:"pid"`
+	Type           string            `json:"type"`
+	Time           time.Time         `json:"time"`
+	DeviceID       string            `json:"device_id,omitempty"`
+	AppVersion     int               `json:"app_version,omitempty"`
+	NotificationID *int              `json:"notification_id,omitempty"`
+	Namespace      string            `json:"namespace,omitempty"`
+	Version        *int              `json:"version,omitempty"`
+	Properties     map[string]string `json:"properties,omitempty"`
+}
+
+func (e *Event) Validate(now time.Time) error {
+	if !eventTypeRegexp.MatchString(e.Type) {
+		return ErrBadEventType
+	}
+	if e.Time.IsZero() || e.Time.After(now.Add(time.Hour)) || e.Time.Before(now.Add(-EVENT_MAX_AGE)) {
+		return ErrBadEventTime
+	}
+	if len(e.DeviceID) > EVENT_MAX_DEVICE_ID_LENGTH {
+		return ErrBadEventDeviceID
+	}
+	if len(e.Namespace) > EVENT_MAX_NAMESPACE_LENGTH {
+		return ErrBadEventNamespace
+	}
+	if (e.Type == EVENT_NOTIFICATION_DISMISSED || e.Type == EVENT_NOTIFICATION_CONVERTED) && e.NotificationID == nil {
+		return ErrNoEventNotification
+	}
+	if len(e.Properties) > EVENT_MAX_PROPERTIES {
+		return ErrBadEventProperties
+	}
+	for k, v := range e.Properties {
+		if k == "" || len(k) > 50 || len(v) > 200 {
+			return ErrBadEventProperties
+		}
+	}
+	return nil
+}
+
+// EventCount is the number of times an event was reported and the number of
+// devices that reported it.
+type EventCount struct {
+	Type    string `json:"type"`
+	Count   int    `json:"count"`
+	Devices int    `json:"devices"`
+}
+
+// QueuedEvent is an event that is waiting to be persisted.
+type QueuedEvent struct {
+	ID    string
+	Event Event
+}
+
+type EventQueue interface {
+	LoadScripts(ctx context.Context) error
+	Add(ctx context.Context, events []Event) error
+	// Read returns up to count events that have not been acknowledged yet.
+	// Events that were read before but not acknowledged come first.
+	Read(ctx context.Context, count int) ([]QueuedEvent, error)
+	Ack(ctx context.Context, ids []string) error
+}
+
+type EventRepository interface {
+	// InsertBatch stores the events in one transaction. Events of projects
+	// that do not exist and events the database rejects for their values are
+	// dropped, the latter being counted in the returned number.
+	InsertBatch(ctx context.Context, events []Event) (int, error)
+	// GetCounts returns the counts of each event type of a project between
+	// from and to, optionally only for the events of one notification.
+	GetCounts(ctx context.Context, pid string, nid *int, from time.Time, to time.Time) ([]EventCount, error)
+}
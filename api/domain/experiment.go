@@ -0,0 +1,105 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	EXPERIMENT_STATUS_RUNNING = 1
+	EXPERIMENT_STATUS_STOPPED = 2
+)
+
+type ExperimentVariant struct {
+	Name      string          `json:"name"`
+	Weight    int             `json:"weight"`
+	Value     json.RawMessage `json:"value"`
+	Exposures int             `json:"exposures"`
+}
+
+// Experiment splits devices between variants of a single parameter of a remote
+// config namespace.
+type Experiment struct {
+	ID         int                 `json:"id"`
+	PID        string              `json:"pid"`
+	Namespace  string              `json:"namespace"`
+	Name       string              `json:"name"`
+	Parameter  string              `json:"parameter"`
+	Status     int                 `json:"status"`
+	Variants   []ExperimentVariant `json:"variants"`
+	CreateTime *time.Time          `json:"create_time"`
+	StopTime   *time.Time          `json:"stop_time"`
+}
+
+// Assign deterministically picks a variant for the device according to the
+// variant weights.
+func (e *Experiment) Assign(deviceID string) *ExperimentVariant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("experiment.%d.", e.ID)))
+	h.Write([]byte(deviceID))
+	bucket := int(h.Sum32() % uint32(total))
+	for i := range e.Variants {
+		bucket -= e.Variants[i].Weight
+		if bucket < 0 {
+			return &e.Variants[i]
+		}
+	}
+	return nil
+}
+
+// ExposureKey names the exposed devices of a variant.
+func (e *Experiment) ExposureKey(v *ExperimentVariant) string {
+	return fmt.Sprintf("%d.%s", e.ID, v.Name)
+}
+
+// ApplyExperiments sets the parameter of each running experiment in data to the
+// value of the variant assigned to the device. It returns the new data and the
+// exposure keys of the assigned variants.
+func ApplyExperiments(data string, experiments []Experiment, deviceID string) (string, []string, error) {
+	if len(experiments) == 0 || deviceID == "" {
+		return data, nil, nil
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		// only objects have parameters
+		return data, nil, nil
+	}
+	exposures := make([]string, 0, len(experiments))
+	for i := range experiments {
+		e := &experiments[i]
+		v := e.Assign(deviceID)
+		if v == nil {
+			continue
+		}
+		values[e.Parameter] = v.Value
+		exposures = append(exposures, e.ExposureKey(v))
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(b), exposures, nil
+}
+
+type ExperimentRepository interface {
+	GetByID(ctx context.Context, id int) (*Experiment, error)
+	GetByPID(ctx context.Context, pid string) ([]Experiment, error)
+	// Insert stores the experiment and a new version of the remote config of
+	// its namespace, for clients to pick it up, in one transaction.
+	Insert(ctx context.Context, e *Experiment) error
+	// Update is Insert for a change of the experiment.
+	Update(ctx context.Context, e *Experiment) error
+	// SetExposures stores the number of devices exposed to the variant. It
+	// never goes down, in case the devices are evicted from the cache.
+	SetExposures(ctx context.Context, id int, variant string, count int64) error
+}
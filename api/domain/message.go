@@ -0,0 +1,255 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	IN_APP_MESSAGE_LAYOUT_BANNER      = "banner"
+	IN_APP_MESSAGE_LAYOUT_MODAL       = "modal"
+	IN_APP_MESSAGE_LAYOUT_FULL_SCREEN = "full-screen"
+)
+
+// inAppMessageMaxButtons are the most buttons each layout has room for.
+var inAppMessageMaxButtons = map[string]int{
+	IN_APP_MESSAGE_LAYOUT_BANNER:      1,
+	IN_APP_MESSAGE_LAYOUT_MODAL:       2,
+	IN_APP_MESSAGE_LAYOUT_FULL_SCREEN: 3,
+}
+
+const (
+	IN_APP_MESSAGE_TRIGGER_APP_OPEN    = "app-open"
+	IN_APP_MESSAGE_TRIGGER_SCREEN_VIEW = "screen-view"
+	IN_APP_MESSAGE_TRIGGER_EVENT       = "event"
+)
+
+const (
+	IN_APP_MESSAGE_NAME_MAX_LENGTH  = 100
+	IN_APP_MESSAGE_IMAGE_MAX_LENGTH = 200
+	IN_APP_MESSAGE_MAX_TRIGGERS     = 10
+)
+
+// InAppMessageTrigger is a client event that shows the message. Screen limits
+// screen-view triggers to one screen and Event is the name of the custom event
+// of event triggers.
+type InAppMessageTrigger struct {
+	Type   string `json:"type"`
+	Screen string `json:"screen,omitempty"`
+	Event  string `json:"event,omitempty"`
+}
+
+func (t *InAppMessageTrigger) Validate() error {
+	switch t.Type {
+	case IN_APP_MESSAGE_TRIGGER_APP_OPEN:
+		if t.Screen != "" || t.Event != "" {
+			return errors.New("app-open trigger has no screen or event")
+		}
+	case IN_APP_MESSAGE_TRIGGER_SCREEN_VIEW:
+		if t.Event != "" {
+			return errors.New("screen-view trigger has no event")
+		}
+	case IN_APP_MESSAGE_TRIGGER_EVENT:
+		if t.Event == "" {
+			return errors.New("event trigger has no event")
+		}
+		if !eventTypeRegexp.MatchString(t.Event) {
+			return fmt.Errorf("bad event %s", t.Event)
+		}
+	default:
+		return fmt.Errorf("bad trigger %s", t.Type)
+	}
+	return nil
+}
+
+// Matches reports whether the client event of type typ on screen or named
+// event fires the trigger.
+func (t *InAppMessageTrigger) Matches(typ string, screen string, event string) bool {
+	if t.Type != typ {
+		return false
+	}
+	switch t.Type {
+	case IN_APP_MESSAGE_TRIGGER_SCREEN_VIEW:
+		return t.Screen == "" || t.Screen == screen
+	case IN_APP_MESSAGE_TRIGGER_EVENT:
+		return t.Event == event
+	}
+	return true
+}
+
+// InAppMessageFrequency caps how often a device shows the message: at most
+// Impressions times in each Period of minutes, or in total if Period is 0, and
+// MinInterval minutes apart. The impressions are also checked by the server
+// for the devices that report their id.
+type InAppMessageFrequency struct {
+	Impressions int `json:"impressions,omitempty"`
+	Period      int `json:"period,omitempty"`
+	MinInterval int `json:"min_interval,omitempty"`
+}
+
+func (f *InAppMessageFrequency) Validate() error {
+	if f.Impressions < 0 || f.Period < 0 || f.MinInterval < 0 {
+		return errors.New("bad frequency")
+	}
+	if f.Period > 0 && f.Impressions == 0 {
+		return errors.New("frequency period has no impressions")
+	}
+	return nil
+}
+
+// InAppMessage is shown inside the app when one of its triggers fires, as a
+// banner, a modal or a full-screen card. It goes through the statuses of
+// notifications.
+type InAppMessage struct {
+	ID              int                    `json:"id"`
+	PID             string                 `json:"pid"`
+	Status          int                    `json:"status"`
+	Name            string                 `json:"name"`
+	Layout          string                 `json:"layout"`
+	Title           string                 `json:"title"`
+	Text            string                 `json:"text"`
+	Image           *string                `json:"image,omitempty"`
+	BackgroundColor string                 `json:"background_color,omitempty"`
+	Buttons         []NotificationButton   `json:"buttons,omitempty"`
+	ClickAction     *NotificationAction    `json:"click_action,omitempty"`
+	Triggers        []InAppMessageTrigger  `json:"triggers"`
+	Frequency       *InAppMessageFrequency `json:"frequency,omitempty"`
+	SegmentID       *int                   `json:"segment_id,omitempty"`
+	ViewsCount      int                    `json:"views"`
+	ClicksCount     int                    `json:"clicks"`
+	CreateTime      *time.Time             `json:"create_time"`
+	ActiveTime      *time.Time             `json:"active_time"`
+	ScheduleTime    *time.Time             `json:"schedule_time"`
+	ExpireTime      *time.Time             `json:"expire_time"`
+}
+
+func (m *InAppMessage) Validate() error {
+	m.Name = strings.TrimSpace(m.Name)
+	if m.Name == "" {
+		return errors.New("no name")
+	}
+	if len(m.Name) > IN_APP_MESSAGE_NAME_MAX_LENGTH {
+		return errors.New("name is too long")
+	}
+	maxButtons, ok := inAppMessageMaxButtons[m.Layout]
+	if !ok {
+		return fmt.Errorf("bad layout %s", m.Layout)
+	}
+	if m.Title == "" && m.Text == "" {
+		return errors.New("no title or text")
+	}
+	if len(m.Title) > NOTIFICATION_TITLE_MAX_LENGTH {
+		return errors.New("title is too long")
+	}
+	if len(m.Text) > NOTIFICATION_BIG_TEXT_MAX_LENGTH {
+		return errors.New("text is too long")
+	}
+	if m.Image != nil {
+		if !isWebURL(*m.Image) {
+			return fmt.Errorf("bad image %s", *m.Image)
+		}
+		if len(*m.Image) > IN_APP_MESSAGE_IMAGE_MAX_LENGTH {
+			return errors.New("image is too long")
+		}
+	}
+	if m.Layout == IN_APP_MESSAGE_LAYOUT_FULL_SCREEN && m.Image == nil {
+		return errors.New("full-screen message has no image")
+	}
+	if m.BackgroundColor != "" && !colorRegexp.MatchString(m.BackgroundColor) {
+		return fmt.Errorf("bad background_color %s", m.BackgroundColor)
+	}
+	if len(m.Buttons) > maxButtons {
+		return fmt.Errorf("too much buttons for a %s. max length is %d", m.Layout, maxButtons)
+	}
+	payload := NotificationPayload{Buttons: m.Buttons}
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+	if m.ClickAction != nil {
+		if err := m.ClickAction.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(m.Triggers) == 0 {
+		return errors.New("no triggers")
+	}
+	if len(m.Triggers) > IN_APP_MESSAGE_MAX_TRIGGERS {
+		return fmt.Errorf("too much triggers. max length is %d", IN_APP_MESSAGE_MAX_TRIGGERS)
+	}
+	for i := range m.Triggers {
+		if err := m.Triggers[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if m.Frequency != nil {
+		if err := m.Frequency.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetStatus moves the message to the status to if the transition is allowed
+// for notifications.
+func (m *InAppMessage) SetStatus(to int) error {
+	if !CanTransitionNotification(m.Status, to) {
+		return fmt.Errorf("message can not go from %s to %s", NotificationStatusName(m.Status), NotificationStatusName(to))
+	}
+	m.Status = to
+	return nil
+}
+
+// Resume moves a paused message back to scheduled if it has not been active
+// yet and its schedule time is still ahead, or to active otherwise.
+func (m *InAppMessage) Resume(now time.Time) error {
+	if m.Status != NOTIFICATION_STATUS_PAUSED {
+		return fmt.Errorf("message is not paused. status: %s", NotificationStatusName(m.Status))
+	}
+	if m.ActiveTime == nil && m.ScheduleTime != nil && m.ScheduleTime.After(now) {
+		return m.SetStatus(NOTIFICATION_STATUS_SCHEDULED)
+	}
+	m.ActiveTime = &now
+	return m.SetStatus(NOTIFICATION_STATUS_ACTIVE)
+}
+
+type InAppMessageRepository interface {
+	GetByID(ctx context.Context, id int) (*InAppMessage, error)
+	GetByPID(ctx context.Context, pid string, limit int, offset int) ([]InAppMessage, error)
+	Insert(ctx context.Context, m *InAppMessage) error
+	// UpdateStatus stores the status and the active time of the message. It
+	// returns ErrNotificationStatusChanged if the message is no longer in from.
+	UpdateStatus(ctx context.Context, m *InAppMessage, from int) error
+	// ActivateScheduled makes the scheduled messages that are due at now
+	// active.
+	ActivateScheduled(ctx context.Context, now time.Time) (int64, error)
+	// FinishExpired finishes the scheduled, active and paused messages that
+	// have expired at now.
+	FinishExpired(ctx context.Context, now time.Time) (int64, error)
+	Delete(ctx context.Context, m *InAppMessage) error
+}
+
+// InAppMessageCache keeps the active messages of each project for the clients
+// like NotificationCache does for notifications, along with the impressions of
+// each device for the frequency caps.
+type InAppMessageCache interface {
+	LoadScripts(ctx context.Context) error
+	GetTimeByProjectID(ctx context.Context, pid string) (*time.Time, error)
+	GetDataByProjectID(ctx context.Context, pid string) (*string, error)
+	GetETagByProjectID(ctx context.Context, pid string) (string, error)
+	UpdateProjectData(ctx context.Context, pid string, ids string, data string, t time.Time, expire time.Duration) error
+	DeleteProjectData(ctx context.Context, pid string) error
+	GetAndResetViewsByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	GetAndResetClicksByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	IncrClicksIds(ctx context.Context, pid string, appVersion int, ids []string) error
+	IncrViewsIds(ctx context.Context, pid string, deviceID string, appVersion int, ids []string) error
+	// IncrDeviceImpressionsIds counts an impression by the device of each of
+	// the messages in the current period of its frequency cap, periods being
+	// the periods of the caps by message id.
+	IncrDeviceImpressionsIds(ctx context.Context, pid string, deviceID string, periods map[string]time.Duration) error
+	// GetDeviceImpressions returns the impressions of each of the messages by
+	// the device in the current periods of their frequency caps.
+	GetDeviceImpressions(ctx context.Context, pid string, deviceID string, ids []string) (map[string]int, error)
+}
@@ -2,6 +2,8 @@ package domain
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 )
 
@@ -10,36 +12,266 @@ const (
 	NOTIFICATION_STATUS_SCHEDULED = 2
 	NOTIFICATION_STATUS_CANCELED  = 3
 	NOTIFICATION_STATUS_FINISHED  = 4
+	NOTIFICATION_STATUS_PAUSED    = 5
 )
 
+var ErrNotificationStatusChanged = errors.New("notification status has changed")
+
+var notificationStatusNames = map[int]string{
+	NOTIFICATION_STATUS_ACTIVE:    "active",
+	NOTIFICATION_STATUS_SCHEDULED: "scheduled",
+	NOTIFICATION_STATUS_CANCELED:  "canceled",
+	NOTIFICATION_STATUS_FINISHED:  "finished",
+	NOTIFICATION_STATUS_PAUSED:    "paused",
+}
+
+// notificationTransitions are the statuses a notification can go to from each
+// status. Canceled and finished notifications never change again.
+var notificationTransitions = map[int][]int{
+	NOTIFICATION_STATUS_SCHEDULED: {
+		NOTIFICATION_STATUS_ACTIVE,
+		NOTIFICATION_STATUS_PAUSED,
+		NOTIFICATION_STATUS_CANCELED,
+		NOTIFICATION_STATUS_FINISHED,
+	},
+	NOTIFICATION_STATUS_ACTIVE: {
+		NOTIFICATION_STATUS_PAUSED,
+		NOTIFICATION_STATUS_CANCELED,
+		NOTIFICATION_STATUS_FINISHED,
+	},
+	NOTIFICATION_STATUS_PAUSED: {
+		NOTIFICATION_STATUS_ACTIVE,
+		NOTIFICATION_STATUS_SCHEDULED,
+		NOTIFICATION_STATUS_CANCELED,
+		NOTIFICATION_STATUS_FINISHED,
+	},
+}
+
+func NotificationStatusName(status int) string {
+	if name, ok := notificationStatusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+// CanTransitionNotification reports whether a notification can go from the
+// status from to the status to.
+func CanTransitionNotification(from int, to int) bool {
+	for _, s := range notificationTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	NOTIFICATION_ACTOR_USER = "user"
+	NOTIFICATION_ACTOR_LOOP = "loop"
+)
+
+// NotificationActor is who changes the status of a notification, either a user
+// or the loop.
+type NotificationActor struct {
+	Type   string `json:"actor"`
+	UserID *int   `json:"user_id,omitempty"`
+}
+
+func NotificationUserActor(uid int) NotificationActor {
+	return NotificationActor{Type: NOTIFICATION_ACTOR_USER, UserID: &uid}
+}
+
+var NotificationLoopActor = NotificationActor{Type: NOTIFICATION_ACTOR_LOOP}
+
+// NotificationEvent is one transition of a notification. From is nil for the
+// creation of the notification.
+type NotificationEvent struct {
+	ID   int  `json:"id"`
+	NID  int  `json:"nid"`
+	From *int `json:"from"`
+	To   int  `json:"to"`
+	NotificationActor
+	Time time.Time `json:"time"`
+}
+
+const (
+	NOTIFICATION_CHANNEL_PULL = "pull"
+	NOTIFICATION_CHANNEL_FCM  = "fcm"
+)
+
+// FCMTarget is who a notification of the fcm channel is pushed to. Exactly one
+// of the fields is set.
+type FCMTarget struct {
+	Topic     string   `json:"topic,omitempty"`
+	Condition string   `json:"condition,omitempty"`
+	Tokens    []string `json:"tokens,omitempty"`
+	// Devices sends to the tokens of all registered devices of the project.
+	Devices bool `json:"devices,omitempty"`
+}
+
 type Notification struct {
-	ID           int        `json:"id"`
-	PID          string     `json:"pid"`
-	Status       int        `json:"status"`
-	Title        string     `json:"title"`
-	Text         string     `json:"text"`
-	BigText      *string    `json:"big-text,omitempty"`
-	Image        *string    `json:"image,omitempty"`
-	BigImage     *string    `json:"big-image,omitempty"`
-	Priority     string     `json:"priority"`
-	Style        string     `json:"style"`
+	ID       int     `json:"id"`
+	PID      string  `json:"pid"`
+	Status   int     `json:"status"`
+	Title    string  `json:"title"`
+	Text     string  `json:"text"`
+	BigText  *string `json:"big-text,omitempty"`
+	Image    *string `json:"image,omitempty"`
+	BigImage *string `json:"big-image,omitempty"`
+	Priority string  `json:"priority"`
+	Style    string  `json:"style"`
+	// Action and Extra are ClickAction as old clients know it.
 	Action       *string    `json:"action,omitempty"`
 	Extra        *string    `json:"extra,omitempty"`
 	ViewsCount   int        `json:"views"`
 	ClicksCount  int        `json:"clicks"`
+	ReachCount   int        `json:"reach"`
 	CreateTime   *time.Time `json:"create_time"`
 	ActiveTime   *time.Time `json:"active_time"`
 	ExpireTime   *time.Time `json:"expire_time"`
 	ScheduleTime *time.Time `json:"schedule_time"`
-	ClickReport  bool       `json:"click_report"`
+	SegmentID    *int       `json:"segment_id,omitempty"`
+	TemplateID   *int       `json:"template_id,omitempty"`
+	// Localizations are the texts of the notification in other languages when
+	// it is made from a template, by locale.
+	Localizations map[string]NotificationContent `json:"localizations,omitempty"`
+	// LocalTime makes the schedule and expire times wall clock times in the
+	// timezone of each device.
+	LocalTime bool `json:"local_time"`
+	// Recurrence makes a scheduled notification repeat. It stays scheduled
+	// with the time of the next occurrence as its schedule time and each
+	// occurrence is a new notification with ParentID set to it.
+	Recurrence   *NotificationRecurrence `json:"recurrence,omitempty"`
+	ParentID     *int                    `json:"parent_id,omitempty"`
+	Channel      string                  `json:"channel"`
+	FCMTarget    *FCMTarget              `json:"fcm,omitempty"`
+	FCMMessageID *string                 `json:"fcm_message_id,omitempty"`
+	FCMError     *string                 `json:"fcm_error,omitempty"`
+	FCMSendTime  *time.Time              `json:"fcm_send_time,omitempty"`
+	ClickReport  bool                    `json:"click_report"`
+	ClickAction  *NotificationAction     `json:"click_action,omitempty"`
+	NotificationPayload
+}
+
+// SetClickAction sets what happens when the notification is clicked along with
+// its legacy encoding, or clears it if a is nil.
+func (n *Notification) SetClickAction(a *NotificationAction) {
+	n.ClickAction = a
+	if a == nil {
+		n.Action = nil
+		n.Extra = nil
+		return
+	}
+	action := a.Legacy()
+	extra := a.Extra()
+	n.Action = &action
+	n.Extra = &extra
+}
+
+// SetStatus moves the notification to the status to if the transition is
+// allowed.
+func (n *Notification) SetStatus(to int) error {
+	if !CanTransitionNotification(n.Status, to) {
+		return fmt.Errorf("notification can not go from %s to %s", NotificationStatusName(n.Status), NotificationStatusName(to))
+	}
+	n.Status = to
+	return nil
+}
+
+// Due returns the latest schedule time that is due at now. Local time
+// notifications are due once the earliest timezone reaches their time.
+func (n *Notification) Due(now time.Time) time.Time {
+	if n.LocalTime {
+		return now.Add(TZ_OFFSET_MAX)
+	}
+	return now
+}
+
+// Advance moves a recurring notification on to its first occurrence after the
+// due time. It returns false if there is no occurrence before the expire time.
+func (n *Notification) Advance(now time.Time) bool {
+	due := n.Due(now)
+	next := *n.ScheduleTime
+	for !next.IsZero() && !next.After(due) {
+		next = n.Recurrence.Next(next)
+	}
+	if next.IsZero() || (n.ExpireTime != nil && !next.Before(*n.ExpireTime)) {
+		return false
+	}
+	n.ScheduleTime = &next
+	return true
+}
+
+// Resume moves a paused notification back to scheduled if it has not been
+// active yet and its schedule time is still ahead, or to active otherwise.
+// Recurring notifications stay scheduled and skip the occurrences missed while
+// they were paused.
+func (n *Notification) Resume(now time.Time) error {
+	if n.Status != NOTIFICATION_STATUS_PAUSED {
+		return fmt.Errorf("notification is not paused. status: %s", NotificationStatusName(n.Status))
+	}
+	if n.Recurrence != nil {
+		if !n.Advance(now) {
+			return n.SetStatus(NOTIFICATION_STATUS_FINISHED)
+		}
+		return n.SetStatus(NOTIFICATION_STATUS_SCHEDULED)
+	}
+	if n.ActiveTime == nil && n.ScheduleTime != nil && n.ScheduleTime.After(n.Due(now)) {
+		return n.SetStatus(NOTIFICATION_STATUS_SCHEDULED)
+	}
+	n.ActiveTime = &now
+	return n.SetStatus(NOTIFICATION_STATUS_ACTIVE)
+}
+
+const (
+	NOTIFICATION_STATS_INTERVAL_HOUR = "hour"
+	NOTIFICATION_STATS_INTERVAL_DAY  = "day"
+)
+
+// NotificationStats are the views and clicks of a notification reported by the
+// devices running one app version during one interval.
+type NotificationStats struct {
+	Time       time.Time `json:"time"`
+	AppVersion int       `json:"app_version"`
+	Views      int       `json:"views"`
+	Clicks     int       `json:"clicks"`
 }
 
 type NotificationRepository interface {
 	GetByID(ctx context.Context, id int) (*Notification, error)
+	// GetByIDs returns the notifications with the ids that exist.
+	GetByIDs(ctx context.Context, ids []int) ([]Notification, error)
 	GetByPID(ctx context.Context, pid string, limit int, offset int) ([]Notification, error)
-	Insert(ctx context.Context, n *Notification) error
+	// Insert stores the notification and records its creation by actor.
+	Insert(ctx context.Context, n *Notification, actor NotificationActor) error
+	// InsertAll stores the notifications in one transaction.
+	InsertAll(ctx context.Context, ns []*Notification, actor NotificationActor) error
+	// Update stores the notification, which must still be in its status. It
+	// returns ErrNotificationStatusChanged otherwise.
 	Update(ctx context.Context, n *Notification) error
+	// UpdateAll is Update for many notifications in one transaction.
+	UpdateAll(ctx context.Context, ns []*Notification) error
+	// UpdateFCMResult stores the outcome of pushing the notification.
+	UpdateFCMResult(ctx context.Context, n *Notification) error
+	// UpdateStatus stores the status and the active and schedule times of the
+	// notification and records the transition from the status from. It returns
+	// ErrNotificationStatusChanged if the notification is no longer in from.
+	UpdateStatus(ctx context.Context, n *Notification, from int, actor NotificationActor) error
+	// UpdateStatusAll is UpdateStatus for many notifications in one
+	// transaction, from[i] being the status ns[i] goes from.
+	UpdateStatusAll(ctx context.Context, ns []*Notification, from []int, actor NotificationActor) error
+	// ActivateScheduled makes the non recurring scheduled notifications that
+	// are due at now active.
+	ActivateScheduled(ctx context.Context, now time.Time, actor NotificationActor) (int64, error)
+	// FinishExpired finishes the scheduled, active and paused notifications
+	// that have expired at now.
+	FinishExpired(ctx context.Context, now time.Time, actor NotificationActor) (int64, error)
+	// GetHistory returns the transitions of the notification in order.
+	GetHistory(ctx context.Context, id int) ([]NotificationEvent, error)
 	Delete(ctx context.Context, n *Notification) error
+	// GetStats returns the stats of the notification between from and to,
+	// grouped by interval and app version and ordered by time.
+	GetStats(ctx context.Context, id int, interval string, from time.Time, to time.Time) ([]NotificationStats, error)
 }
 
 type NotificationCache interface {
@@ -47,11 +279,16 @@ type NotificationCache interface {
 	GetTimeByProjectID(ctx context.Context, pid string) (*time.Time, error)
 	GetDataExistsByProjectID(ctx context.Context, pid string) (bool, error)
 	GetDataByProjectID(ctx context.Context, pid string) (*string, error)
-	GetViewsByProjectID(ctx context.Context, pid string) (string, error)
+	GetETagByProjectID(ctx context.Context, pid string) (string, error)
 	UpdateProjectData(ctx context.Context, pid string, ids string, data string, t time.Time, expire time.Duration) error
 	DeleteProjectData(ctx context.Context, pid string) error
 	SetProjectDataExpire(ctx context.Context, pid string, expiration time.Duration) error
-	GetClicksByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	GetAndResetViewsByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	GetAndResetClicksByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	GetAndResetAppVersionViewsByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	GetAndResetAppVersionClicksByProjectID(ctx context.Context, pid string) (map[string]string, error)
+	GetReachByProjectID(ctx context.Context, pid string, ids []string) (map[string]int64, error)
 	IncrClicks(ctx context.Context, pid string, id string) error
-	IncrClicksIds(ctx context.Context, pid string, ids []string) error
+	IncrClicksIds(ctx context.Context, pid string, appVersion int, ids []string) error
+	IncrViewsIds(ctx context.Context, pid string, deviceID string, appVersion int, ids []string) error
 }
@@ -0,0 +1,162 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	NOTIFICATION_ACTION_ACTIVITY  = "activity"
+	NOTIFICATION_ACTION_LINK      = "link"
+	NOTIFICATION_ACTION_UPDATE    = "update"
+	NOTIFICATION_ACTION_DEEP_LINK = "deep-link"
+)
+
+const (
+	NOTIFICATION_MAX_BUTTONS             = 3
+	NOTIFICATION_BUTTON_LABEL_MAX_LENGTH = 30
+	NOTIFICATION_EXTRA_MAX_LENGTH        = 200
+	// NOTIFICATION_DATA_MAX_SIZE leaves room for the rest of the notification
+	// in the 4KB payload of a push.
+	NOTIFICATION_DATA_MAX_SIZE = 2048
+)
+
+var (
+	resourceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,50}$`)
+	colorRegexp        = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+)
+
+// NotificationAction is what happens when a notification or one of its buttons
+// is clicked. Activity opens the activity Name of the app, optionally on top of
+// Parent. Link opens URL in the browser, update opens URL to update the app to
+// Version and deep-link opens the URI URL in the app that handles it.
+type NotificationAction struct {
+	Type    string `json:"type"`
+	Name    string `json:"name,omitempty"`
+	Parent  string `json:"parent,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (a *NotificationAction) Validate() error {
+	switch a.Type {
+	case NOTIFICATION_ACTION_ACTIVITY:
+		if a.Name == "" {
+			return errors.New("activity action has no name")
+		}
+	case NOTIFICATION_ACTION_LINK:
+		if !isWebURL(a.URL) {
+			return fmt.Errorf("bad link url %s", a.URL)
+		}
+	case NOTIFICATION_ACTION_UPDATE:
+		if !isWebURL(a.URL) {
+			return fmt.Errorf("bad update url %s", a.URL)
+		}
+		if a.Version <= 0 {
+			return errors.New("update action has no version")
+		}
+	case NOTIFICATION_ACTION_DEEP_LINK:
+		u, err := url.Parse(a.URL)
+		if err != nil || u.Scheme == "" {
+			return fmt.Errorf("bad deep link %s", a.URL)
+		}
+	default:
+		return fmt.Errorf("bad action %s", a.Type)
+	}
+	if len(a.Extra()) > NOTIFICATION_EXTRA_MAX_LENGTH {
+		return errors.New("action is too long")
+	}
+	return nil
+}
+
+// Legacy returns the action as old clients know it. Deep links are opened as
+// links, which old clients hand to the system as well.
+func (a *NotificationAction) Legacy() string {
+	if a.Type == NOTIFICATION_ACTION_DEEP_LINK {
+		return NOTIFICATION_ACTION_LINK
+	}
+	return a.Type
+}
+
+// Extra returns the space separated encoding of the action that old clients
+// read from the extra field, e.g. "url 12" for an update.
+func (a *NotificationAction) Extra() string {
+	switch a.Type {
+	case NOTIFICATION_ACTION_ACTIVITY:
+		if a.Parent == "" {
+			return a.Name
+		}
+		return fmt.Sprintf("%s %s", a.Parent, a.Name)
+	case NOTIFICATION_ACTION_UPDATE:
+		return fmt.Sprintf("%s %d", a.URL, a.Version)
+	default:
+		return a.URL
+	}
+}
+
+type NotificationButton struct {
+	Label  string             `json:"label"`
+	Action NotificationAction `json:"action"`
+}
+
+// NotificationPayload is what a notification carries besides its texts and
+// images. Data is passed to the app as is. Sound, ChannelID and Icon are names
+// of resources of the app and Color is like #RRGGBB.
+type NotificationPayload struct {
+	Buttons   []NotificationButton   `json:"buttons,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Sound     string                 `json:"sound,omitempty"`
+	ChannelID string                 `json:"channel_id,omitempty"`
+	Color     string                 `json:"color,omitempty"`
+	Icon      string                 `json:"icon,omitempty"`
+}
+
+func (p *NotificationPayload) Validate() error {
+	if len(p.Buttons) > NOTIFICATION_MAX_BUTTONS {
+		return fmt.Errorf("too much buttons. max length is %d", NOTIFICATION_MAX_BUTTONS)
+	}
+	for i := range p.Buttons {
+		b := &p.Buttons[i]
+		b.Label = strings.TrimSpace(b.Label)
+		if b.Label == "" {
+			return fmt.Errorf("button %d has no label", i+1)
+		}
+		if len(b.Label) > NOTIFICATION_BUTTON_LABEL_MAX_LENGTH {
+			return fmt.Errorf("label of button %d is too long", i+1)
+		}
+		if err := b.Action.Validate(); err != nil {
+			return fmt.Errorf("button %d: %s", i+1, err)
+		}
+	}
+	if len(p.Data) > 0 {
+		b, err := json.Marshal(p.Data)
+		if err != nil {
+			return errors.New("bad data")
+		}
+		if len(b) > NOTIFICATION_DATA_MAX_SIZE {
+			return fmt.Errorf("data is too big. max size is %d bytes", NOTIFICATION_DATA_MAX_SIZE)
+		}
+	}
+	if p.Sound != "" && !resourceNameRegexp.MatchString(p.Sound) {
+		return fmt.Errorf("bad sound %s", p.Sound)
+	}
+	if p.ChannelID != "" && !resourceNameRegexp.MatchString(p.ChannelID) {
+		return fmt.Errorf("bad channel_id %s", p.ChannelID)
+	}
+	if p.Color != "" && !colorRegexp.MatchString(p.Color) {
+		return fmt.Errorf("bad color %s", p.Color)
+	}
+	if p.Icon != "" && !resourceNameRegexp.MatchString(p.Icon) {
+		return fmt.Errorf("bad icon %s", p.Icon)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package domain
+
+import "context"
+
+// PushProviders are the providers a notification can be pushed through.
+var PushProviders = []string{PUSH_PROVIDER_FCM, PUSH_PROVIDER_APNS, PUSH_PROVIDER_WEBPUSH}
+
+// PushMessage is what a device receives. Providers that only show visible
+// alerts use the title, text and sound, the data is passed to the app as is.
+type PushMessage struct {
+	Title string
+	Text  string
+	Sound string
+	Data  map[string]string
+}
+
+// PushFailure is a token that a message could not be sent to. Invalid tokens
+// are not registered anymore and should not be used again.
+type PushFailure struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+	Error    string `json:"error"`
+	Invalid  bool   `json:"invalid"`
+}
+
+// PushResult is the outcome of sending a message to a list of tokens.
+type PushResult struct {
+	SuccessCount int           `json:"success"`
+	FailureCount int           `json:"failure"`
+	Failures     []PushFailure `json:"failures"`
+}
+
+func NewPushResult() *PushResult {
+	return &PushResult{
+		Failures: make([]PushFailure, 0),
+	}
+}
+
+// Add merges the outcome of another send into the result.
+func (r *PushResult) Add(o *PushResult) {
+	r.SuccessCount += o.SuccessCount
+	r.FailureCount += o.FailureCount
+	r.Failures = append(r.Failures, o.Failures...)
+}
+
+// InvalidTokens returns the tokens of the provider that were reported as not
+// registered or malformed.
+func (r *PushResult) InvalidTokens(provider string) []string {
+	ret := make([]string, 0)
+	for _, f := range r.Failures {
+		if f.Invalid && f.Provider == provider {
+			ret = append(ret, f.Token)
+		}
+	}
+	return ret
+}
+
+// PushSender delivers messages to the devices of a project through one push
+// provider, using the credential of the project for that provider.
+type PushSender interface {
+	Provider() string
+	// Send delivers the message to each of the tokens. An error is returned
+	// only if nothing could be sent, the failures of single tokens are
+	// reported in the result.
+	Send(ctx context.Context, pid string, tokens []string, message *PushMessage) (*PushResult, error)
+	// Invalidate drops what is cached for the project, e.g. after its
+	// credential is rotated or deleted.
+	Invalidate(pid string)
+}
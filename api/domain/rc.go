@@ -3,18 +3,71 @@ package domain
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
 )
 
+const RC_DEFAULT_NAMESPACE = "default"
+
+var (
+	ErrRemoteConfigVersionMismatch = errors.New("remote config version mismatch")
+	ErrBadRemoteConfigNamespace    = errors.New("bad namespace")
+)
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9_-]{1,50}$`)
+
+// reservedNamespaces are the path segments used by the remote config endpoints
+// under /{id}/rc.
+var reservedNamespaces = []string{
+	"diff",
+	"experiments",
+	"fcm",
+	"namespaces",
+	"rollback",
+	"rules",
+	"schedules",
+	"schema",
+	"versions",
+}
+
+// ValidateNamespace checks that ns can be used as the name of a remote config
+// namespace.
+func ValidateNamespace(ns string) error {
+	if !namespacePattern.MatchString(ns) || containsString(reservedNamespaces, ns) {
+		return ErrBadRemoteConfigNamespace
+	}
+	return nil
+}
+
+// RemoteConfig is the published config of a namespace of a project. Rules is the compiled
+// RemoteConfigRules json or nil when the config has no conditions. Experiments
+// is the json array of the running experiments of the namespace.
 type RemoteConfig struct {
-	ProjectID string
-	Data      string
-	Version   int
+	ProjectID   string
+	Namespace   string
+	Data        string
+	Rules       *string
+	Experiments *string
+	Version     int
+	UpdateTime  *time.Time
 }
 
 func (r *RemoteConfig) MarshalJSON() ([]byte, error) {
 	ret := make(map[string]interface{})
 	ret["version"] = r.Version
-	ret["data"] = json.RawMessage(r.Data)
+	if r.Data != "" {
+		ret["data"] = json.RawMessage(r.Data)
+	}
+	if r.Namespace != "" && r.Namespace != RC_DEFAULT_NAMESPACE {
+		ret["namespace"] = r.Namespace
+	}
+	if r.Rules != nil {
+		ret["rules"] = json.RawMessage(*r.Rules)
+	}
+	if r.UpdateTime != nil {
+		ret["update_time"] = r.UpdateTime
+	}
 	b, err := json.Marshal(ret)
 	if err != nil {
 		return nil, err
@@ -22,16 +75,82 @@ func (r *RemoteConfig) MarshalJSON() ([]byte, error) {
 	return b, nil
 }
 
+// Resolve returns the data of the remote config as seen by the device, with
+// conditional values and experiment variants applied, along with the exposure
+// keys of the experiment variants assigned to the device.
+func (r *RemoteConfig) Resolve(device *DeviceInfo) (string, []string, error) {
+	data := r.Data
+	if r.Rules != nil {
+		var rules RemoteConfigRules
+		if err := json.Unmarshal([]byte(*r.Rules), &rules); err != nil {
+			return "", nil, err
+		}
+		var err error
+		data, err = rules.Resolve(data, device)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if r.Experiments == nil {
+		return data, nil, nil
+	}
+	var experiments []Experiment
+	if err := json.Unmarshal([]byte(*r.Experiments), &experiments); err != nil {
+		return "", nil, err
+	}
+	return ApplyExperiments(data, experiments, device.ID)
+}
+
+// RemoteConfigVersion is a published version of a remote config namespace.
+// Data is empty when the version is loaded as a list item.
+type RemoteConfigVersion struct {
+	ProjectID  string
+	Namespace  string
+	Version    int
+	Data       string
+	Rules      *string
+	CreateTime time.Time
+}
+
+func (r *RemoteConfigVersion) MarshalJSON() ([]byte, error) {
+	ret := make(map[string]interface{})
+	ret["version"] = r.Version
+	ret["create_time"] = r.CreateTime
+	if r.Data != "" {
+		ret["data"] = json.RawMessage(r.Data)
+	}
+	if r.Rules != nil {
+		ret["rules"] = json.RawMessage(*r.Rules)
+	}
+	return json.Marshal(ret)
+}
+
 type RemoteConfigRepository interface {
-	GetByProjectID(ctx context.Context, pid string) (*RemoteConfig, error)
+	GetByProjectID(ctx context.Context, pid string, namespace string) (*RemoteConfig, error)
+	GetNamespaces(ctx context.Context, pid string) ([]RemoteConfig, error)
+	GetVersions(ctx context.Context, pid string, namespace string, limit int, offset int) ([]RemoteConfigVersion, error)
+	GetVersion(ctx context.Context, pid string, namespace string, version int) (*RemoteConfigVersion, error)
 	Insert(ctx context.Context, rc *RemoteConfig) error
 	Update(ctx context.Context, rc *RemoteConfig) error
+	Patch(ctx context.Context, pid string, namespace string, version int, fn func(rc *RemoteConfig) error) (*RemoteConfig, error)
+	GetSchema(ctx context.Context, pid string, namespace string) (*string, error)
+	UpdateSchema(ctx context.Context, pid string, namespace string, schema string) error
+	DeleteSchema(ctx context.Context, pid string, namespace string) error
 }
 
 type RemoteConfigCache interface {
 	LoadScripts(ctx context.Context) error
-	GetDataExistsByProjectID(ctx context.Context, pid string) (bool, error)
-	GetDataByProjectID(ctx context.Context, pid string) (*string, error)
-	GetVersionByProjectID(ctx context.Context, pid string) (*int, error)
+	GetDataExistsByProjectID(ctx context.Context, pid string, namespace string) (bool, error)
+	GetDataByProjectID(ctx context.Context, pid string, namespace string) (*string, error)
+	GetVersionByProjectID(ctx context.Context, pid string, namespace string) (*int, error)
+	GetUpdateTimeByProjectID(ctx context.Context, pid string, namespace string) (*time.Time, error)
+	GetRulesByProjectID(ctx context.Context, pid string, namespace string) (*string, error)
+	GetExperimentsByProjectID(ctx context.Context, pid string, namespace string) (*string, error)
+	GetByVersion(ctx context.Context, pid string, namespace string, version int) (*RemoteConfig, error)
+	// AddExposures counts the device as exposed to each of the variants.
+	AddExposures(ctx context.Context, pid string, deviceID string, keys []string) error
+	// GetExposures returns the estimated number of devices exposed to each
+	// variant by exposure key.
+	GetExposures(ctx context.Context, pid string) (map[string]int64, error)
 	Update(ctx context.Context, rc *RemoteConfig) error
 }
@@ -0,0 +1,151 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	NOTIFICATION_RECURRENCE_DAILY  = "daily"
+	NOTIFICATION_RECURRENCE_WEEKLY = "weekly"
+)
+
+// NOTIFICATION_TIMEZONE_LOCAL makes the times of a notification wall clock
+// times in the timezone of each device.
+const NOTIFICATION_TIMEZONE_LOCAL = "local"
+
+// NOTIFICATION_RECURRENCE_MIN_INTERVAL is the least time between two
+// occurrences of a recurring notification.
+const NOTIFICATION_RECURRENCE_MIN_INTERVAL = time.Hour
+
+// Timezones range from UTC-12:00 to UTC+14:00, so a wall clock time is reached
+// between 14 hours before and 12 hours after the same time in UTC.
+const (
+	TZ_OFFSET_MIN = -12 * time.Hour
+	TZ_OFFSET_MAX = 14 * time.Hour
+)
+
+// NotificationRecurrence makes a notification repeat. Either Cron is set or
+// Frequency with Time and, for weekly ones, Weekdays. Each occurrence is a
+// notification of its own that stays active for Duration minutes.
+type NotificationRecurrence struct {
+	Cron      string `json:"cron,omitempty"`
+	Frequency string `json:"frequency,omitempty"`
+	// Time is the time of day, e.g. "09:00".
+	Time string `json:"time,omitempty"`
+	// Weekdays are the days of week from 0 for sunday to 6 for saturday.
+	Weekdays []int `json:"weekdays,omitempty"`
+	// Timezone is the IANA timezone the rule is evaluated in, UTC if empty or
+	// the timezone of each device if "local".
+	Timezone string `json:"timezone,omitempty"`
+	Duration int    `json:"duration"`
+
+	schedule *CronSchedule
+	location *time.Location
+}
+
+// Compile validates the rule and prepares it for Next.
+func (r *NotificationRecurrence) Compile() error {
+	expr := r.Cron
+	switch r.Frequency {
+	case "":
+		if expr == "" {
+			return errors.New("recurrence needs cron or frequency")
+		}
+	case NOTIFICATION_RECURRENCE_DAILY, NOTIFICATION_RECURRENCE_WEEKLY:
+		if expr != "" {
+			return errors.New("recurrence can not have both cron and frequency")
+		}
+		t, err := time.Parse("15:04", r.Time)
+		if err != nil {
+			return fmt.Errorf("bad recurrence time %s", r.Time)
+		}
+		days := "*"
+		if r.Frequency == NOTIFICATION_RECURRENCE_WEEKLY {
+			if len(r.Weekdays) == 0 {
+				return errors.New("weekly recurrence has no weekdays")
+			}
+			d := make([]string, 0, len(r.Weekdays))
+			for _, w := range r.Weekdays {
+				if w < 0 || w > 6 {
+					return fmt.Errorf("bad weekday %d", w)
+				}
+				d = append(d, fmt.Sprint(w))
+			}
+			days = strings.Join(d, ",")
+		}
+		expr = fmt.Sprintf("%d %d * * %s", t.Minute(), t.Hour(), days)
+	default:
+		return fmt.Errorf("bad recurrence frequency %s", r.Frequency)
+	}
+	schedule, err := ParseCron(expr)
+	if err != nil {
+		return err
+	}
+
+	location := time.UTC
+	if r.Timezone != "" && r.Timezone != NOTIFICATION_TIMEZONE_LOCAL {
+		location, err = time.LoadLocation(r.Timezone)
+		if err != nil {
+			return fmt.Errorf("bad timezone %s", r.Timezone)
+		}
+	}
+
+	if r.Duration <= 0 {
+		return errors.New("recurrence has no duration")
+	}
+
+	r.schedule = schedule
+	r.location = location
+
+	// occurrences must not overlap or come too often
+	t := time.Now()
+	for i := 0; i < 24; i++ {
+		next := r.Next(t)
+		if next.IsZero() {
+			if i == 0 {
+				return errors.New("recurrence never occurs")
+			}
+			break
+		}
+		if i > 0 {
+			gap := next.Sub(t)
+			if gap < NOTIFICATION_RECURRENCE_MIN_INTERVAL {
+				return fmt.Errorf("occurrences must be at least %s apart", NOTIFICATION_RECURRENCE_MIN_INTERVAL)
+			}
+			if gap < time.Duration(r.Duration)*time.Minute {
+				return errors.New("duration is longer than the time between occurrences")
+			}
+		}
+		t = next
+	}
+	return nil
+}
+
+// Local reports whether the occurrences are in the timezone of each device.
+func (r *NotificationRecurrence) Local() bool {
+	return r.Timezone == NOTIFICATION_TIMEZONE_LOCAL
+}
+
+// Next returns the first occurrence after t or the zero time if there is none.
+// Occurrences of local recurrences are wall clock times expressed in UTC.
+func (r *NotificationRecurrence) Next(t time.Time) time.Time {
+	if r.schedule == nil {
+		if err := r.Compile(); err != nil {
+			return time.Time{}
+		}
+	}
+	next := r.schedule.Next(t.In(r.location))
+	if next.IsZero() {
+		return next
+	}
+	return next.UTC()
+}
+
+// WallClock returns the clock reading of t as a time in UTC, e.g. 09:00 UTC
+// for 09:00+03:30. Times of local notifications are kept this way.
+func WallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
@@ -0,0 +1,42 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	RC_SCHEDULE_STATUS_SCHEDULED = 1
+	RC_SCHEDULE_STATUS_PUBLISHED = 2
+	RC_SCHEDULE_STATUS_FINISHED  = 3
+	RC_SCHEDULE_STATUS_CANCELED  = 4
+)
+
+// RemoteConfigSchedule is a remote config staged to go live at PublishTime.
+// When RevertTime is set the version that was live before the publish is
+// restored at that time, unless the remote config has changed in between.
+// Rules are kept as they are at publish time when the schedule has none.
+type RemoteConfigSchedule struct {
+	ID             int             `json:"id"`
+	PID            string          `json:"pid"`
+	Namespace      string          `json:"namespace"`
+	Data           json.RawMessage `json:"data"`
+	Rules          json.RawMessage `json:"rules,omitempty"`
+	Status         int             `json:"status"`
+	PublishTime    *time.Time      `json:"publish_time"`
+	RevertTime     *time.Time      `json:"revert_time"`
+	BaseVersion    *int            `json:"base_version"`
+	PublishVersion *int            `json:"publish_version"`
+	RevertVersion  *int            `json:"revert_version"`
+	CreateTime     *time.Time      `json:"create_time"`
+}
+
+type RemoteConfigScheduleRepository interface {
+	GetByID(ctx context.Context, id int) (*RemoteConfigSchedule, error)
+	GetByPID(ctx context.Context, pid string) ([]RemoteConfigSchedule, error)
+	// GetDue returns the schedules that have to be published or reverted at t.
+	GetDue(ctx context.Context, t time.Time) ([]RemoteConfigSchedule, error)
+	Insert(ctx context.Context, s *RemoteConfigSchedule) error
+	Update(ctx context.Context, s *RemoteConfigSchedule) error
+}
@@ -0,0 +1,28 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// Segment is a reusable group of devices of a project that notifications can
+// target. A device is in the segment when it matches the segment condition.
+type Segment struct {
+	ID         int                   `json:"id"`
+	PID        string                `json:"pid"`
+	Name       string                `json:"name"`
+	Condition  RemoteConfigCondition `json:"condition"`
+	CreateTime *time.Time            `json:"create_time"`
+	UpdateTime *time.Time            `json:"update_time"`
+}
+
+type SegmentRepository interface {
+	GetByID(ctx context.Context, id int) (*Segment, error)
+	GetByPID(ctx context.Context, pid string) ([]Segment, error)
+	Insert(ctx context.Context, s *Segment) error
+	Update(ctx context.Context, s *Segment) error
+	Delete(ctx context.Context, s *Segment) error
+	// InUse reports whether active or scheduled notifications or in-app
+	// messages target the segment.
+	InUse(ctx context.Context, id int) (bool, error)
+}
@@ -0,0 +1,28 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	STREAM_EVENT_RC            = "rc"
+	STREAM_EVENT_NOTIFICATIONS = "notifications"
+	STREAM_EVENT_MESSAGES      = "messages"
+)
+
+// StreamEvent tells the clients of a project that its public data has changed
+// and should be fetched again.
+type StreamEvent struct {
+	Type      string     `json:"type"`
+	Namespace string     `json:"namespace,omitempty"`
+	Version   int        `json:"version,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+}
+
+type StreamPubSub interface {
+	Publish(ctx context.Context, pid string, e *StreamEvent) error
+	// Subscribe returns the events of the project until unsubscribe is
+	// called.
+	Subscribe(ctx context.Context, pid string) (events <-chan *StreamEvent, unsubscribe func(), err error)
+}
@@ -0,0 +1,240 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NOTIFICATION_TITLE_MAX_LENGTH    = 100
+	NOTIFICATION_TEXT_MAX_LENGTH     = 200
+	NOTIFICATION_BIG_TEXT_MAX_LENGTH = 400
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// FillPlaceholders replaces the {{placeholders}} of s that have a value. The
+// rest are kept if keep is true and removed otherwise.
+func FillPlaceholders(s string, values map[string]string, keep bool) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return placeholderRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		name := placeholderRegexp.FindStringSubmatch(m)[1]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		if keep {
+			return m
+		}
+		return ""
+	})
+}
+
+// HasPlaceholders reports whether s has {{placeholders}}.
+func HasPlaceholders(s string) bool {
+	return placeholderRegexp.MatchString(s)
+}
+
+// NormalizeLocale lowercases the locale and uses "-" as its separator, e.g.
+// "fa-ir" for "fa_IR".
+func NormalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// MatchLocale picks the best of the available locales for the preferred ones,
+// which are in order of preference. A preferred locale matches exactly or by
+// its language, e.g. "fa-IR" matches "fa" and "fa" matches "fa-af". An empty
+// string is returned if none match.
+func MatchLocale(available []string, preferred []string) string {
+	for _, p := range preferred {
+		p = NormalizeLocale(p)
+		if p == "" {
+			continue
+		}
+		for _, a := range available {
+			if a == p {
+				return a
+			}
+		}
+		language := strings.SplitN(p, "-", 2)[0]
+		for _, a := range available {
+			if a == language {
+				return a
+			}
+		}
+		for _, a := range available {
+			if strings.SplitN(a, "-", 2)[0] == language {
+				return a
+			}
+		}
+	}
+	return ""
+}
+
+// ParseAcceptLanguage returns the locales of an Accept-Language header in
+// order of preference.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	locales := make([]weighted, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		locales = append(locales, weighted{locale, q})
+	}
+	sort.SliceStable(locales, func(i, j int) bool {
+		return locales[i].q > locales[j].q
+	})
+	ret := make([]string, 0, len(locales))
+	for _, l := range locales {
+		ret = append(ret, l.locale)
+	}
+	return ret
+}
+
+// Values are what the placeholders of a notification can be filled with from
+// the device. Custom properties come first, then the device attributes.
+func (d *DeviceInfo) Values() map[string]string {
+	ret := map[string]string{
+		"app_version": strconv.Itoa(d.AppVersion),
+		"platform":    d.Platform,
+		"locale":      d.Locale,
+		"language":    d.Language(),
+		"country":     d.Region(),
+		"model":       d.Model,
+	}
+	for k, v := range d.Properties {
+		ret[k] = v
+	}
+	return ret
+}
+
+// NotificationContent is the text of a notification in one language.
+type NotificationContent struct {
+	Title   string  `json:"title"`
+	Text    string  `json:"text"`
+	BigText *string `json:"big-text,omitempty"`
+}
+
+// Fill fills the placeholders of the texts, see FillPlaceholders.
+func (c NotificationContent) Fill(values map[string]string, keep bool) NotificationContent {
+	ret := NotificationContent{
+		Title: FillPlaceholders(c.Title, values, keep),
+		Text:  FillPlaceholders(c.Text, values, keep),
+	}
+	if c.BigText != nil {
+		bigText := FillPlaceholders(*c.BigText, values, keep)
+		ret.BigText = &bigText
+	}
+	return ret
+}
+
+func (c *NotificationContent) Validate() error {
+	if c.Title == "" {
+		return errors.New("no title")
+	}
+	if len(c.Title) > NOTIFICATION_TITLE_MAX_LENGTH {
+		return errors.New("title is too long")
+	}
+	if c.Text == "" {
+		return errors.New("no text")
+	}
+	if len(c.Text) > NOTIFICATION_TEXT_MAX_LENGTH {
+		return errors.New("text is too long")
+	}
+	if c.BigText != nil && len(*c.BigText) > NOTIFICATION_BIG_TEXT_MAX_LENGTH {
+		return errors.New("big-text is too long")
+	}
+	return nil
+}
+
+// NotificationTemplate is reusable notification text of a project with a
+// variant per locale. The texts can have {{placeholders}} that are filled
+// from the parameters of a notification when it is created and from the
+// device when it is fetched.
+type NotificationTemplate struct {
+	ID            int                            `json:"id"`
+	PID           string                         `json:"pid"`
+	Name          string                         `json:"name"`
+	DefaultLocale string                         `json:"default_locale"`
+	Variants      map[string]NotificationContent `json:"variants"`
+	CreateTime    *time.Time                     `json:"create_time"`
+	UpdateTime    *time.Time                     `json:"update_time"`
+}
+
+// Compile validates the template and normalizes its locales.
+func (t *NotificationTemplate) Compile() error {
+	if t.Name == "" {
+		return errors.New("no name")
+	}
+	if len(t.Variants) == 0 {
+		return errors.New("no variants")
+	}
+	variants := make(map[string]NotificationContent)
+	for locale, content := range t.Variants {
+		l := NormalizeLocale(locale)
+		if l == "" {
+			return errors.New("variant has no locale")
+		}
+		if _, ok := variants[l]; ok {
+			return fmt.Errorf("duplicate variant %s", l)
+		}
+		if err := content.Validate(); err != nil {
+			return fmt.Errorf("variant %s: %v", l, err)
+		}
+		variants[l] = content
+	}
+	t.Variants = variants
+	t.DefaultLocale = NormalizeLocale(t.DefaultLocale)
+	if t.DefaultLocale == "" && len(variants) == 1 {
+		for l := range variants {
+			t.DefaultLocale = l
+		}
+	}
+	if _, ok := variants[t.DefaultLocale]; !ok {
+		return fmt.Errorf("no variant for default_locale %s", t.DefaultLocale)
+	}
+	return nil
+}
+
+// Render fills the placeholders of each variant with the parameters. The
+// placeholders without a parameter are kept to be filled from the device.
+func (t *NotificationTemplate) Render(params map[string]string) map[string]NotificationContent {
+	ret := make(map[string]NotificationContent, len(t.Variants))
+	for locale, content := range t.Variants {
+		ret[locale] = content.Fill(params, true)
+	}
+	return ret
+}
+
+type NotificationTemplateRepository interface {
+	GetByID(ctx context.Context, id int) (*NotificationTemplate, error)
+	GetByPID(ctx context.Context, pid string) ([]NotificationTemplate, error)
+	Insert(ctx context.Context, t *NotificationTemplate) error
+	Update(ctx context.Context, t *NotificationTemplate) error
+	Delete(ctx context.Context, t *NotificationTemplate) error
+}
@@ -0,0 +1,466 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+)
+
+// NOTIFICATIONS_MAX_BULK_SIZE is the most notifications a bulk request or an
+// import can have.
+const NOTIFICATIONS_MAX_BULK_SIZE = 100
+
+// NOTIFICATIONS_MAX_IMPORT_SIZE is the most bytes an import can have.
+const NOTIFICATIONS_MAX_IMPORT_SIZE = 1 << 20
+
+// bulkError is why one notification of a bulk request was rejected. Row is the
+// 1-based position of a new notification in the request and ID is the id of an
+// existing one.
+type bulkError struct {
+	Row   int    `json:"row,omitempty"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// csvColumnTypes are the types of the import columns that are not plain
+// strings.
+var csvColumnTypes = map[string]string{
+	"buttons":      "json",
+	"click_action": "json",
+	"data":         "json",
+	"fcm":          "json",
+	"params":       "json",
+	"recurrence":   "json",
+	"segment_id":   "number",
+	"template_id":  "number",
+	"version":      "number",
+	"local_time":   "bool",
+}
+
+func getBulkIDs(body map[string]interface{}) ([]int, error) {
+	values, ok := body["ids"].([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, errors.New("no ids")
+	}
+	if len(values) > NOTIFICATIONS_MAX_BULK_SIZE {
+		return nil, fmt.Errorf("too much ids. max length is %d", NOTIFICATIONS_MAX_BULK_SIZE)
+	}
+	ids := make([]int, 0, len(values))
+	seen := make(map[int]bool)
+	for _, v := range values {
+		id, ok := v.(float64)
+		if !ok {
+			return nil, errors.New("bad ids")
+		}
+		if seen[int(id)] {
+			return nil, fmt.Errorf("duplicate id %d", int(id))
+		}
+		seen[int(id)] = true
+		ids = append(ids, int(id))
+	}
+	return ids, nil
+}
+
+// getUserNotifications returns the notifications with the ids in the body if
+// all of them belong to projects of the user.
+func (n *NotificationHandler) getUserNotifications(w http.ResponseWriter, r *http.Request) ([]*domain.Notification, bool) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+
+	body, ok := r.Context().Value("json").(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return nil, false
+	}
+
+	ids, err := getBulkIDs(body)
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	found, err := n.noRepo.GetByIDs(ctx, ids)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return nil, false
+	}
+	byID := make(map[int]*domain.Notification)
+	owners := make(map[string]int)
+	for i := range found {
+		no := &found[i]
+		byID[no.ID] = no
+		if _, ok := owners[no.PID]; ok {
+			continue
+		}
+		project, err := n.prRepo.GetByID(ctx, no.PID)
+		if err != nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+			return nil, false
+		}
+		owners[no.PID] = project.UserID
+	}
+
+	notifications := make([]*domain.Notification, 0, len(ids))
+	errs := make([]bulkError, 0)
+	for _, id := range ids {
+		no, ok := byID[id]
+		if !ok || owners[no.PID] != authUser.ID {
+			errs = append(errs, bulkError{ID: id, Error: "notification not found"})
+			continue
+		}
+		notifications = append(notifications, no)
+	}
+	if len(errs) > 0 {
+		util.WriteErrorDetails(w, http.StatusNotFound, "notifications not found", errs)
+		return nil, false
+	}
+
+	return notifications, true
+}
+
+// createNotifications validates all the notification definitions with the
+// rules of NewNotificationHandler and stores them in one transaction, or none
+// of them if any is rejected. Notifications pushed now are left to the loop.
+func (n *NotificationHandler) createNotifications(w http.ResponseWriter, r *http.Request, definitions []interface{}) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+
+	if len(definitions) == 0 {
+		util.WriteError(w, http.StatusBadRequest, "no notifications")
+		return
+	}
+	if len(definitions) > NOTIFICATIONS_MAX_BULK_SIZE {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("too much notifications. max length is %d", NOTIFICATIONS_MAX_BULK_SIZE))
+		return
+	}
+
+	project, ok := getUserProject(w, r, n.prRepo)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	notifications := make([]*domain.Notification, 0, len(definitions))
+	errs := make([]bulkError, 0)
+	for i, d := range definitions {
+		var body map[string]interface{}
+		switch d := d.(type) {
+		case map[string]interface{}:
+			body = d
+		case error:
+			errs = append(errs, bulkError{Row: i + 1, Error: d.Error()})
+			continue
+		default:
+			errs = append(errs, bulkError{Row: i + 1, Error: "bad notification"})
+			continue
+		}
+		no, err := n.newNotification(r, project, body, now)
+		if err != nil {
+			if _, ok := err.(*notificationError); !ok {
+				log.Println(err)
+				util.WriteInternalServerError(w)
+				return
+			}
+			errs = append(errs, bulkError{Row: i + 1, Error: err.Error()})
+			continue
+		}
+		notifications = append(notifications, no)
+	}
+	if len(errs) > 0 {
+		util.WriteErrorDetails(w, http.StatusBadRequest, "bad notifications", errs)
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := n.noRepo.InsertAll(ctx, notifications, domain.NotificationUserActor(authUser.ID))
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	util.WriteJson(w, notifications)
+}
+
+func (n *NotificationHandler) BulkNewNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := r.Context().Value("json").(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+	definitions, ok := body["notifications"].([]interface{})
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no notifications")
+		return
+	}
+	n.createNotifications(w, r, definitions)
+}
+
+// readCSVNotifications reads notification definitions from a csv file with a
+// header of the fields of the definitions. The cells of object and array fields
+// are json and empty cells are left out. A row with a bad cell or with more or
+// less cells than the header is read as the error of the row.
+func readCSVNotifications(reader io.Reader) ([]interface{}, error) {
+	cr := csv.NewReader(reader)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("no header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad csv: %s", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	definitions := make([]interface{}, 0)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad csv: %s", err)
+		}
+		if len(definitions) == NOTIFICATIONS_MAX_BULK_SIZE {
+			return nil, fmt.Errorf("too much notifications. max length is %d", NOTIFICATIONS_MAX_BULK_SIZE)
+		}
+		if len(record) != len(header) {
+			definitions = append(definitions, fmt.Errorf("row has %d fields, header has %d", len(record), len(header)))
+			continue
+		}
+		body := make(map[string]interface{})
+		var cellErr error
+		for i, cell := range record {
+			if cell == "" {
+				continue
+			}
+			column := header[i]
+			var v interface{}
+			var err error
+			switch csvColumnTypes[column] {
+			case "json":
+				err = json.Unmarshal([]byte(cell), &v)
+			case "number":
+				v, err = strconv.ParseFloat(cell, 64)
+			case "bool":
+				v, err = strconv.ParseBool(cell)
+			default:
+				v = cell
+			}
+			if err != nil {
+				cellErr = fmt.Errorf("bad %s", column)
+				break
+			}
+			body[column] = v
+		}
+		if cellErr != nil {
+			definitions = append(definitions, cellErr)
+		} else {
+			definitions = append(definitions, body)
+		}
+	}
+	return definitions, nil
+}
+
+// ImportNotificationsHandler creates the notifications of a csv file or a json
+// array of at most NOTIFICATIONS_MAX_IMPORT_SIZE bytes. The request fails with
+// the error of each rejected row if any of them is rejected.
+func (n *NotificationHandler) ImportNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, NOTIFICATIONS_MAX_IMPORT_SIZE)
+	var definitions []interface{}
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	switch contentType {
+	case "text/csv":
+		var err error
+		definitions, err = readCSVNotifications(r.Body)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case "", "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&definitions); err != nil {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad json: %s", err))
+			return
+		}
+	default:
+		util.WriteError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type %s", contentType))
+		return
+	}
+	n.createNotifications(w, r, definitions)
+}
+
+func (n *NotificationHandler) BulkCancelNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+
+	notifications, ok := n.getUserNotifications(w, r)
+	if !ok {
+		return
+	}
+
+	from := make([]int, 0, len(notifications))
+	errs := make([]bulkError, 0)
+	for _, no := range notifications {
+		from = append(from, no.Status)
+		if err := no.SetStatus(domain.NOTIFICATION_STATUS_CANCELED); err != nil {
+			errs = append(errs, bulkError{ID: no.ID, Error: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		util.WriteErrorDetails(w, http.StatusBadRequest, "bad notifications", errs)
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := n.noRepo.UpdateStatusAll(ctx, notifications, from, domain.NotificationUserActor(authUser.ID))
+	if err != nil {
+		if err == domain.ErrNotificationStatusChanged {
+			util.WriteError(w, http.StatusConflict, err.Error())
+		} else {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	util.WriteJson(w, notifications)
+}
+
+// BulkRescheduleNotificationsHandler moves scheduled notifications to the
+// schedule_time and expire_time of the body with the rules of
+// UpdateNotificationHandler.
+func (n *NotificationHandler) BulkRescheduleNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := r.Context().Value("json").(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+	st, _ := body["schedule_time"].(string)
+	et, _ := body["expire_time"].(string)
+	if st == "" && et == "" {
+		util.WriteError(w, http.StatusBadRequest, "no schedule_time or expire_time")
+		return
+	}
+
+	notifications, ok := n.getUserNotifications(w, r)
+	if !ok {
+		return
+	}
+
+	errs := make([]bulkError, 0)
+	for _, no := range notifications {
+		if no.Status != domain.NOTIFICATION_STATUS_SCHEDULED {
+			errs = append(errs, bulkError{ID: no.ID, Error: fmt.Sprintf("notification is not scheduled. status:%d", no.Status)})
+			continue
+		}
+		if err := rescheduleNotification(no, st, et); err != nil {
+			errs = append(errs, bulkError{ID: no.ID, Error: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		util.WriteErrorDetails(w, http.StatusBadRequest, "bad notifications", errs)
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := n.noRepo.UpdateAll(ctx, notifications)
+	if err != nil {
+		if err == domain.ErrNotificationStatusChanged {
+			util.WriteError(w, http.StatusConflict, err.Error())
+		} else {
+			log.Println(err)
+			util.WriteStatus(w, http.StatusBadRequest)
+		}
+		return
+	}
+
+	util.WriteJson(w, notifications)
+}
+
+// BulkCloneNotificationsHandler makes new notifications with the contents and
+// the targets of existing ones. Their times are read from the body like those
+// of a new notification.
+func (n *NotificationHandler) BulkCloneNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+
+	// the body is checked to be an object by getUserNotifications
+	notifications, ok := n.getUserNotifications(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	clones := make([]*domain.Notification, 0, len(notifications))
+	errs := make([]bulkError, 0)
+	for _, no := range notifications {
+		var recurrence *domain.NotificationRecurrence
+		if no.Recurrence != nil {
+			rec := *no.Recurrence
+			recurrence = &rec
+		}
+		body := r.Context().Value("json").(map[string]interface{})
+		when, scheduleTime, expireTime, err := getNotificationTimes(body, recurrence, no.LocalTime)
+		if err != nil {
+			errs = append(errs, bulkError{ID: no.ID, Error: err.Error()})
+			continue
+		}
+		clone := &domain.Notification{
+			PID:           no.PID,
+			Title:         no.Title,
+			Text:          no.Text,
+			BigText:       no.BigText,
+			Image:         no.Image,
+			BigImage:      no.BigImage,
+			Priority:      no.Priority,
+			Style:         no.Style,
+			Action:        no.Action,
+			Extra:         no.Extra,
+			CreateTime:    &now,
+			SegmentID:     no.SegmentID,
+			TemplateID:    no.TemplateID,
+			Localizations: no.Localizations,
+			Channel:       no.Channel,
+			FCMTarget:     no.FCMTarget,
+			ClickAction:   no.ClickAction,
+		}
+		clone.NotificationPayload = no.NotificationPayload
+		setNotificationTimes(clone, when, scheduleTime, expireTime, now)
+		if when == "later" {
+			clone.LocalTime = no.LocalTime
+			clone.Recurrence = recurrence
+		}
+		clones = append(clones, clone)
+	}
+	if len(errs) > 0 {
+		util.WriteErrorDetails(w, http.StatusBadRequest, "bad notifications", errs)
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := n.noRepo.InsertAll(ctx, clones, domain.NotificationUserActor(authUser.ID))
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	util.WriteJson(w, clones)
+}
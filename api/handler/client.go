@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+)
+
+// getDeviceInfo reads the device properties a client sends with public
+// requests. Missing or malformed values are left empty. User properties are
+// sent as prop.{name}={value} query parameters.
+func getDeviceInfo(r *http.Request) *domain.DeviceInfo {
+	query := r.URL.Query()
+	appVersion, _ := strconv.Atoi(query.Get("app_version"))
+	tzOffset, _ := strconv.Atoi(query.Get("tz_offset"))
+	if offset := time.Duration(tzOffset) * time.Minute; offset < domain.TZ_OFFSET_MIN || offset > domain.TZ_OFFSET_MAX {
+		tzOffset = 0
+	}
+	properties := make(map[string]string)
+	for k, v := range query {
+		if name := strings.TrimPrefix(k, "prop."); name != k && name != "" && len(v) > 0 {
+			properties[name] = v[0]
+		}
+	}
+	return &domain.DeviceInfo{
+		ID:         query.Get("device_id"),
+		AppVersion: appVersion,
+		Platform:   query.Get("platform"),
+		Locale:     query.Get("locale"),
+		Country:    query.Get("country"),
+		Model:      query.Get("model"),
+		TZOffset:   tzOffset,
+		Properties: properties,
+	}
+}
+
+// getPreferredLocales returns the locales the client wants texts in, in order
+// of preference. The locale query parameter wins over Accept-Language.
+func getPreferredLocales(r *http.Request) []string {
+	if locale := r.URL.Query().Get("locale"); locale != "" {
+		return []string{locale}
+	}
+	return domain.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+}
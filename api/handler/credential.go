@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type PushCredentialHandler struct {
+	crRepo  domain.PushCredentialRepository
+	prRepo  domain.ProjectRepository
+	senders util.PushSenders
+	router  *mux.Router
+}
+
+// validateFCMCredential checks that the body is a google service account key.
+func validateFCMCredential(body map[string]interface{}) error {
+	if t, _ := body["type"].(string); t != "service_account" {
+		return fmt.Errorf("type must be service_account")
+	}
+	for _, k := range []string{"project_id", "private_key", "client_email"} {
+		if v, _ := body[k].(string); v == "" {
+			return fmt.Errorf("no %s", k)
+		}
+	}
+	return nil
+}
+
+func (c *PushCredentialHandler) GetCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, c.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	credentials, err := c.crRepo.GetByPID(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, credentials)
+}
+
+// UpdateCredentialHandler uploads or rotates the credential of a provider. The
+// body is the credential itself, e.g. the service account JSON for fcm, the
+// .p8 key with its key_id, team_id and topic for apns or the VAPID key pair
+// with its subject for webpush.
+func (c *PushCredentialHandler) UpdateCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	provider := mux.Vars(r)["provider"]
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	switch provider {
+	case domain.PUSH_PROVIDER_FCM:
+		err = validateFCMCredential(body)
+	case domain.PUSH_PROVIDER_APNS:
+		err = util.ValidateAPNsCredential(data)
+	case domain.PUSH_PROVIDER_WEBPUSH:
+		err = util.ValidateWebPushCredential(data)
+	default:
+		err = fmt.Errorf("bad provider %s", provider)
+	}
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	project, ok := getUserProject(w, r, c.prRepo)
+	if !ok {
+		return
+	}
+	credential := &domain.PushCredential{
+		PID:      project.ID,
+		Provider: provider,
+		Data:     data,
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = c.crRepo.Upsert(ctx, credential)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	if sender, ok := c.senders[provider]; ok {
+		sender.Invalidate(project.ID)
+	}
+
+	util.WriteJson(w, credential)
+}
+
+func (c *PushCredentialHandler) DeleteCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	provider := mux.Vars(r)["provider"]
+
+	project, ok := getUserProject(w, r, c.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := c.crRepo.Delete(ctx, project.ID, provider)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, "credential not found")
+		} else {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	if sender, ok := c.senders[provider]; ok {
+		sender.Invalidate(project.ID)
+	}
+
+	util.WriteOK(w)
+}
+
+func NewPushCredentialHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	crRepo domain.PushCredentialRepository,
+	prRepo domain.ProjectRepository,
+	senders util.PushSenders,
+) *PushCredentialHandler {
+	c := &PushCredentialHandler{
+		crRepo:  crRepo,
+		prRepo:  prRepo,
+		senders: senders,
+		router:  r.NewRoute().Subrouter(),
+	}
+
+	c.router.Use(authMiddleware)
+	c.router.HandleFunc("/{id}/credentials", c.GetCredentialsHandler).Methods("GET")
+	c.router.HandleFunc("/{id}/credentials/{provider}/delete", c.DeleteCredentialHandler).Methods("POST")
+
+	// the credentials are private keys which must not be logged
+	jsonRouter := c.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.SecretJsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/credentials/{provider}", c.UpdateCredentialHandler).Methods("POST")
+
+	return c
+}
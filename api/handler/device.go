@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+)
+
+type DeviceHandler struct {
+	dvRepo domain.DeviceRepository
+	prRepo domain.ProjectRepository
+	router *mux.Router
+}
+
+// RegisterDeviceHandler is called by clients on start and whenever one of the
+// reported values changes, e.g. when a new FCM or APNs token is issued or the
+// browser renews its push subscription.
+func (d *DeviceHandler) RegisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	installID, ok := body["install_id"].(string)
+	if !ok || installID == "" || len(installID) > 100 {
+		util.WriteError(w, http.StatusBadRequest, "bad install_id")
+		return
+	}
+
+	device := &domain.Device{
+		PID:       pid,
+		InstallID: installID,
+	}
+
+	if appVersion, ok := body["app_version"].(float64); ok {
+		device.AppVersion = int(appVersion)
+	}
+
+	if osVersion, ok := body["os_version"].(string); ok {
+		if len(osVersion) > 50 {
+			util.WriteError(w, http.StatusBadRequest, "bad os_version")
+			return
+		}
+		device.OSVersion = osVersion
+	}
+
+	if locale, ok := body["locale"].(string); ok {
+		if len(locale) > 20 {
+			util.WriteError(w, http.StatusBadRequest, "bad locale")
+			return
+		}
+		device.Locale = locale
+	}
+
+	if fcmToken, ok := body["fcm_token"].(string); ok && fcmToken != "" {
+		device.FCMToken = &fcmToken
+	}
+
+	if apnsToken, ok := body["apns_token"].(string); ok && apnsToken != "" {
+		if len(apnsToken) > 200 || !isHex(apnsToken) {
+			util.WriteError(w, http.StatusBadRequest, "bad apns_token")
+			return
+		}
+		device.APNsToken = &apnsToken
+	}
+
+	if s, ok := body["web_push_subscription"]; ok && s != nil {
+		b, err := json.Marshal(s)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad web_push_subscription")
+			return
+		}
+		_, err = util.ParseWebPushSubscription(b)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad web_push_subscription")
+			return
+		}
+		subscriptionJson := string(b)
+		device.WebPushSubscription = &subscriptionJson
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := d.dvRepo.Register(ctx, device)
+	if err != nil {
+		log.Println(err)
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			util.WriteError(w, http.StatusNotFound, "project not found")
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	util.WriteOK(w)
+}
+
+func (d *DeviceHandler) GetDeviceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, d.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	stats, err := d.dvRepo.GetStats(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, stats)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func NewDeviceHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	dvRepo domain.DeviceRepository,
+	prRepo domain.ProjectRepository,
+) *DeviceHandler {
+	d := &DeviceHandler{
+		dvRepo: dvRepo,
+		prRepo: prRepo,
+		router: r.NewRoute().Subrouter(),
+	}
+
+	jsonRouter := d.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/devices/register", d.RegisterDeviceHandler).Methods("POST")
+
+	authRouter := d.router.NewRoute().Subrouter()
+	authRouter.Use(authMiddleware)
+	authRouter.HandleFunc("/{id}/devices/stats", d.GetDeviceStatsHandler).Methods("GET")
+
+	return d
+}
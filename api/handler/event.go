@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+)
+
+const EVENTS_MAX_BATCH_SIZE = 100
+
+type EventHandler struct {
+	evQueue domain.EventQueue
+	evRepo  domain.EventRepository
+	prRepo  domain.ProjectRepository
+	router  *mux.Router
+}
+
+// NewEventsHandler queues a batch of events reported by a device. The device
+// id and app version can be sent once for the batch, either in the body or as
+// query parameters.
+func (e *EventHandler) NewEventsHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	jsonBody := r.Context().Value("json")
+
+	b, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	var body struct {
+		DeviceID   string         `json:"device_id"`
+		AppVersion int            `json:"app_version"`
+		Events     []domain.Event `json:"events"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad events: %s", err))
+		return
+	}
+	if len(body.Events) == 0 {
+		util.WriteError(w, http.StatusBadRequest, "no events")
+		return
+	}
+	if len(body.Events) > EVENTS_MAX_BATCH_SIZE {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("too much events. max length is %d", EVENTS_MAX_BATCH_SIZE))
+		return
+	}
+
+	if len(body.DeviceID) > domain.EVENT_MAX_DEVICE_ID_LENGTH {
+		util.WriteError(w, http.StatusBadRequest, "bad device_id")
+		return
+	}
+
+	device := getDeviceInfo(r)
+	if body.DeviceID == "" {
+		body.DeviceID = device.ID
+	}
+	if body.AppVersion == 0 {
+		body.AppVersion = device.AppVersion
+	}
+
+	now := time.Now()
+	for i := range body.Events {
+		event := &body.Events[i]
+		event.PID = pid
+		if event.DeviceID == "" {
+			event.DeviceID = body.DeviceID
+		}
+		if event.AppVersion == 0 {
+			event.AppVersion = body.AppVersion
+		}
+		if event.Time.IsZero() {
+			event.Time = now
+		}
+		if err := event.Validate(now); err != nil {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("event %d: %s", i, err))
+			return
+		}
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = e.evQueue.Add(ctx, body.Events)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteOK(w)
+}
+
+// GetEventStatsHandler returns the count of each event type of the project,
+// by default over the last 30 days. With notification_id only the events of
+// that notification are counted.
+func (e *EventHandler) GetEventStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var nid *int
+	if n := query.Get("notification_id"); n != "" {
+		id, err := strconv.Atoi(n)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad notification_id")
+			return
+		}
+		nid = &id
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if f := query.Get("from"); f != "" {
+		from, err = time.Parse(time.RFC3339, f)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad from")
+			return
+		}
+	}
+	if t := query.Get("to"); t != "" {
+		to, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad to")
+			return
+		}
+	}
+	if !from.Before(to) {
+		util.WriteError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	project, ok := getUserProject(w, r, e.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	counts, err := e.evRepo.GetCounts(ctx, project.ID, nid, from, to)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteJson(w, map[string]interface{}{
+		"from":   from,
+		"to":     to,
+		"events": counts,
+	})
+}
+
+func NewEventHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	evQueue domain.EventQueue,
+	evRepo domain.EventRepository,
+	prRepo domain.ProjectRepository,
+) *EventHandler {
+	e := &EventHandler{
+		evQueue: evQueue,
+		evRepo:  evRepo,
+		prRepo:  prRepo,
+		router:  r.NewRoute().Subrouter(),
+	}
+
+	jsonRouter := e.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/events", e.NewEventsHandler).Methods("POST")
+
+	authRouter := e.router.NewRoute().Subrouter()
+	authRouter.Use(authMiddleware)
+	authRouter.HandleFunc("/{id}/events/stats", e.GetEventStatsHandler).Methods("GET")
+
+	return e
+}
@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type ExperimentHandler struct {
+	exRepo       domain.ExperimentRepository
+	rcRepo       domain.RemoteConfigRepository
+	prRepo       domain.ProjectRepository
+	rcCache      domain.RemoteConfigCache
+	streamPubSub domain.StreamPubSub
+	router       *mux.Router
+}
+
+func (e *ExperimentHandler) GetExperimentsHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, e.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	experiments, err := e.exRepo.GetByPID(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, experiments)
+}
+
+func (e *ExperimentHandler) GetExperimentResultsHandler(w http.ResponseWriter, r *http.Request) {
+	eid, err := strconv.Atoi(mux.Vars(r)["eid"])
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, "bad experiment id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, e.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	experiment, err := e.exRepo.GetByID(ctx, eid)
+	if err != nil || experiment.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "experiment not found")
+		}
+		return
+	}
+
+	total := 0
+	for _, v := range experiment.Variants {
+		total += v.Exposures
+	}
+	variants := make([]map[string]interface{}, 0, len(experiment.Variants))
+	for _, v := range experiment.Variants {
+		var share float64
+		if total > 0 {
+			share = float64(v.Exposures) / float64(total)
+		}
+		variants = append(variants, map[string]interface{}{
+			"name":      v.Name,
+			"weight":    v.Weight,
+			"exposures": v.Exposures,
+			"share":     share,
+		})
+	}
+
+	util.WriteJson(w, map[string]interface{}{
+		"experiment": experiment,
+		"exposures":  total,
+		"variants":   variants,
+	})
+}
+
+func (e *ExperimentHandler) NewExperimentHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	b, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	experiment := &domain.Experiment{}
+	if err := json.Unmarshal(b, experiment); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad experiment: %s", err))
+		return
+	}
+
+	if experiment.Name == "" {
+		util.WriteError(w, http.StatusBadRequest, "no name")
+		return
+	}
+	if experiment.Parameter == "" {
+		util.WriteError(w, http.StatusBadRequest, "no parameter")
+		return
+	}
+	if experiment.Namespace == "" {
+		experiment.Namespace = domain.RC_DEFAULT_NAMESPACE
+	} else if err := domain.ValidateNamespace(experiment.Namespace); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad namespace %s", experiment.Namespace))
+		return
+	}
+	if len(experiment.Variants) < 2 {
+		util.WriteError(w, http.StatusBadRequest, "an experiment needs at least 2 variants")
+		return
+	}
+	names := make(map[string]bool)
+	for _, v := range experiment.Variants {
+		if v.Name == "" {
+			util.WriteError(w, http.StatusBadRequest, "variant has no name")
+			return
+		}
+		if names[v.Name] {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("duplicate variant name %s", v.Name))
+			return
+		}
+		names[v.Name] = true
+		if v.Weight <= 0 {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad weight for variant %s", v.Name))
+			return
+		}
+		if len(v.Value) == 0 {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("no value for variant %s", v.Name))
+			return
+		}
+	}
+
+	project, ok := getUserProject(w, r, e.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	experiments, err := e.exRepo.GetByPID(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	for _, ex := range experiments {
+		if ex.Status == domain.EXPERIMENT_STATUS_RUNNING && ex.Namespace == experiment.Namespace && ex.Parameter == experiment.Parameter {
+			util.WriteError(w, http.StatusConflict, fmt.Sprintf("experiment %d is already running on %s", ex.ID, ex.Parameter))
+			return
+		}
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := e.rcRepo.GetByProjectID(ctx, project.ID, experiment.Namespace)
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, fmt.Sprintf("project has no remote config in namespace %s", experiment.Namespace))
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	b, err = json.Marshal([]domain.Experiment{*experiment})
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	candidate := string(b)
+	if !checkSchema(w, r, e.rcRepo, &domain.RemoteConfig{
+		ProjectID:   project.ID,
+		Namespace:   experiment.Namespace,
+		Data:        remoteConfig.Data,
+		Experiments: &candidate,
+	}) {
+		return
+	}
+
+	experiment.ID = 0
+	experiment.PID = project.ID
+	experiment.Status = domain.EXPERIMENT_STATUS_RUNNING
+	experiment.StopTime = nil
+	for i := range experiment.Variants {
+		experiment.Variants[i].Exposures = 0
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = e.exRepo.Insert(ctx, experiment)
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	publishRemoteConfig(r, e.rcRepo, e.rcCache, e.streamPubSub, project.ID, experiment.Namespace)
+
+	util.WriteJson(w, experiment)
+}
+
+func (e *ExperimentHandler) StopExperimentHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	id, ok := body["id"].(float64)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, e.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	experiment, err := e.exRepo.GetByID(ctx, int(id))
+	if err != nil || experiment.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "experiment not found")
+		}
+		return
+	}
+
+	if experiment.Status != domain.EXPERIMENT_STATUS_RUNNING {
+		util.WriteError(w, http.StatusBadRequest, "experiment is not running")
+		return
+	}
+
+	now := time.Now()
+	experiment.Status = domain.EXPERIMENT_STATUS_STOPPED
+	experiment.StopTime = &now
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = e.exRepo.Update(ctx, experiment)
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	publishRemoteConfig(r, e.rcRepo, e.rcCache, e.streamPubSub, project.ID, experiment.Namespace)
+
+	util.WriteJson(w, experiment)
+}
+
+func NewExperimentHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	exRepo domain.ExperimentRepository,
+	rcRepo domain.RemoteConfigRepository,
+	prRepo domain.ProjectRepository,
+	rcCache domain.RemoteConfigCache,
+	streamPubSub domain.StreamPubSub,
+) *ExperimentHandler {
+	e := &ExperimentHandler{
+		exRepo:       exRepo,
+		rcRepo:       rcRepo,
+		prRepo:       prRepo,
+		rcCache:      rcCache,
+		streamPubSub: streamPubSub,
+		router:       r.NewRoute().Subrouter(),
+	}
+
+	e.router.Use(authMiddleware)
+	e.router.HandleFunc("/{id}/rc/experiments", e.GetExperimentsHandler).Methods("GET")
+	e.router.HandleFunc("/{id}/rc/experiments/{eid:[0-9]+}", e.GetExperimentResultsHandler).Methods("GET")
+
+	jsonRouter := e.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/rc/experiments/new", e.NewExperimentHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/rc/experiments/stop", e.StopExperimentHandler).Methods("POST")
+
+	return e
+}
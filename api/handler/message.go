@@ -0,0 +1,539 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// IN_APP_MESSAGES_MAX_AGE is how long shared caches may serve the in-app
+// messages of a project before revalidating them.
+const IN_APP_MESSAGES_MAX_AGE = time.Minute
+
+type InAppMessageHandler struct {
+	msCache domain.InAppMessageCache
+	msRepo  domain.InAppMessageRepository
+	prRepo  domain.ProjectRepository
+	sgRepo  domain.SegmentRepository
+	router  *mux.Router
+}
+
+// GetMessagesHandler returns the active in-app messages of the project that
+// match the device. With trigger, and screen or event, only the messages that
+// the client event shows are returned. Devices that send their device_id do
+// not get the messages they have shown as many times as their frequency caps
+// allow.
+func (m *InAppMessageHandler) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	trigger := query.Get("trigger")
+	switch trigger {
+	case "",
+		domain.IN_APP_MESSAGE_TRIGGER_APP_OPEN,
+		domain.IN_APP_MESSAGE_TRIGGER_SCREEN_VIEW,
+		domain.IN_APP_MESSAGE_TRIGGER_EVENT:
+	default:
+		util.WriteError(w, http.StatusBadRequest, "bad trigger")
+		return
+	}
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	activeTime, err := m.msCache.GetTimeByProjectID(ctx, pid)
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusNotFound)
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	data, err := m.msCache.GetDataByProjectID(ctx, pid)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	device := getDeviceInfo(r)
+	messages, err := prepareInAppMessages(*data, device, trigger, query.Get("screen"), query.Get("event"))
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	messages, capped, err := m.capInAppMessages(r, pid, device.ID, messages)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	etag, err := m.msCache.GetETagByProjectID(ctx, pid)
+	if err != nil && err != redis.Nil {
+		log.Println(err)
+	}
+	// the messages of a device change as it reaches their frequency caps, so
+	// they are only validated by the etag then
+	lastModified := activeTime
+	if len(capped) > 0 {
+		lastModified = nil
+		if etag != "" {
+			etag = fmt.Sprintf("%s-%s", etag, strings.Join(capped, "."))
+		}
+	}
+	if etag != "" {
+		// the body carries the server time so only a weak validator fits
+		etag = fmt.Sprintf("W/\"%s\"", etag)
+	}
+	if util.CheckNotModified(w, r, etag, lastModified, IN_APP_MESSAGES_MAX_AGE) {
+		return
+	}
+	util.WriteJson(w, map[string]interface{}{
+		"time":     time.Now().Format(time.RFC3339),
+		"messages": messages,
+	})
+}
+
+// prepareInAppMessages drops the messages whose segment does not match the
+// device, or that none of their triggers show on the client event if trigger
+// is not empty, and strips the segment from the rest.
+func prepareInAppMessages(data string, device *domain.DeviceInfo, trigger string, screen string, event string) ([]map[string]json.RawMessage, error) {
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &messages); err != nil {
+		return nil, err
+	}
+	ret := make([]map[string]json.RawMessage, 0, len(messages))
+	for _, ms := range messages {
+		if segment, ok := ms["segment"]; ok {
+			var condition domain.RemoteConfigCondition
+			if err := json.Unmarshal(segment, &condition); err != nil {
+				return nil, err
+			}
+			if !condition.Matches(device) {
+				continue
+			}
+			delete(ms, "segment")
+		}
+		if trigger != "" {
+			var triggers []domain.InAppMessageTrigger
+			if err := json.Unmarshal(ms["triggers"], &triggers); err != nil {
+				return nil, err
+			}
+			matches := false
+			for i := range triggers {
+				if triggers[i].Matches(trigger, screen, event) {
+					matches = true
+					break
+				}
+			}
+			if !matches {
+				continue
+			}
+		}
+		ret = append(ret, ms)
+	}
+	return ret, nil
+}
+
+// inAppMessageFrequency returns the frequency cap of a cached message, or nil
+// if its impressions are not capped.
+func inAppMessageFrequency(ms map[string]json.RawMessage) (*domain.InAppMessageFrequency, error) {
+	f, ok := ms["frequency"]
+	if !ok {
+		return nil, nil
+	}
+	frequency := &domain.InAppMessageFrequency{}
+	if err := json.Unmarshal(f, frequency); err != nil {
+		return nil, err
+	}
+	if frequency.Impressions == 0 {
+		return nil, nil
+	}
+	return frequency, nil
+}
+
+// capInAppMessages drops the messages that the device has shown as many times
+// as their frequency caps allow and returns the ids of the dropped ones.
+func (m *InAppMessageHandler) capInAppMessages(
+	r *http.Request,
+	pid string,
+	deviceID string,
+	messages []map[string]json.RawMessage,
+) ([]map[string]json.RawMessage, []string, error) {
+	if deviceID == "" {
+		return messages, nil, nil
+	}
+	limits := make(map[string]int)
+	ids := make([]string, 0)
+	for _, ms := range messages {
+		frequency, err := inAppMessageFrequency(ms)
+		if err != nil {
+			return nil, nil, err
+		}
+		if frequency == nil {
+			continue
+		}
+		id := string(ms["id"])
+		limits[id] = frequency.Impressions
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return messages, nil, nil
+	}
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	impressions, err := m.msCache.GetDeviceImpressions(ctx, pid, deviceID, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret := make([]map[string]json.RawMessage, 0, len(messages))
+	capped := make([]string, 0)
+	for _, ms := range messages {
+		id := string(ms["id"])
+		if limit, ok := limits[id]; ok && impressions[id] >= limit {
+			capped = append(capped, id)
+			continue
+		}
+		ret = append(ret, ms)
+	}
+	return ret, capped, nil
+}
+
+func (m *InAppMessageHandler) MessageClickedHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	ids := r.URL.Query().Get("ids")
+	idArr := strings.Split(ids, ",")
+	if len(idArr) > 10 {
+		util.WriteError(w, http.StatusBadRequest, "too much ids. max length is 10")
+		return
+	}
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := m.msCache.IncrClicksIds(ctx, pid, getDeviceInfo(r).AppVersion, idArr)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteOK(w)
+}
+
+// MessageViewedHandler is called by clients when in-app messages are shown to
+// the user. The impressions of devices that send their device_id are also
+// counted against the frequency caps of the messages.
+func (m *InAppMessageHandler) MessageViewedHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	ids := r.URL.Query().Get("ids")
+	idArr := strings.Split(ids, ",")
+	if len(idArr) > 10 {
+		util.WriteError(w, http.StatusBadRequest, "too much ids. max length is 10")
+		return
+	}
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	device := getDeviceInfo(r)
+	err := m.msCache.IncrViewsIds(ctx, pid, device.ID, device.AppVersion, idArr)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	if device.ID == "" {
+		util.WriteOK(w)
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	data, err := m.msCache.GetDataByProjectID(ctx, pid)
+	if err != nil {
+		if err != redis.Nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteOK(w)
+		}
+		return
+	}
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*data), &messages); err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	viewed := make(map[string]bool, len(idArr))
+	for _, id := range idArr {
+		viewed[id] = true
+	}
+	periods := make(map[string]time.Duration)
+	for _, ms := range messages {
+		id := string(ms["id"])
+		if !viewed[id] {
+			continue
+		}
+		frequency, err := inAppMessageFrequency(ms)
+		if err != nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+			return
+		}
+		if frequency == nil {
+			continue
+		}
+		periods[id] = time.Duration(frequency.Period) * time.Minute
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = m.msCache.IncrDeviceImpressionsIds(ctx, pid, device.ID, periods)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteOK(w)
+}
+
+func (m *InAppMessageHandler) GetAllMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		util.WriteError(w, http.StatusBadRequest, "bad limit")
+		return
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		util.WriteError(w, http.StatusBadRequest, "bad offset")
+		return
+	}
+
+	project, ok := getUserProject(w, r, m.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	messages, err := m.msRepo.GetByPID(ctx, project.ID, limit, offset)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, messages)
+}
+
+// NewMessageHandler makes an in-app message that is shown from now or from
+// schedule_time until expire_time, like a notification.
+func (m *InAppMessageHandler) NewMessageHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	project, ok := getUserProject(w, r, m.prRepo)
+	if !ok {
+		return
+	}
+
+	when, scheduleTime, expireTime, err := getNotificationTimes(body, nil, false)
+	if err != nil {
+		writeNotificationError(w, err)
+		return
+	}
+	// the times are read above
+	delete(body, "when")
+	delete(body, "schedule_time")
+	delete(body, "expire_time")
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	message := &domain.InAppMessage{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(message); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad message: %s", err))
+		return
+	}
+	if err := message.Validate(); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if message.SegmentID != nil {
+		ctx, cancel := util.GetContextWithTimeout(r.Context())
+		defer cancel()
+		segment, err := m.sgRepo.GetByID(ctx, *message.SegmentID)
+		if err != nil || segment.PID != project.ID {
+			if err != nil && err != pgx.ErrNoRows {
+				log.Println(err)
+				util.WriteInternalServerError(w)
+			} else {
+				util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("segment %d not found", *message.SegmentID))
+			}
+			return
+		}
+	}
+
+	now := time.Now()
+	message.ID = 0
+	message.PID = project.ID
+	message.ViewsCount = 0
+	message.ClicksCount = 0
+	message.CreateTime = &now
+	switch when {
+	case "now":
+		message.Status = domain.NOTIFICATION_STATUS_ACTIVE
+		message.ActiveTime = &now
+		message.ScheduleTime = nil
+	case "later":
+		message.Status = domain.NOTIFICATION_STATUS_SCHEDULED
+		message.ActiveTime = nil
+		message.ScheduleTime = &scheduleTime
+	}
+	message.ExpireTime = &expireTime
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	if err := m.msRepo.Insert(ctx, message); err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteJson(w, message)
+}
+
+// changeStatus reads the message with the id in the body, lets change move it
+// to its new status and stores it.
+func (m *InAppMessageHandler) changeStatus(w http.ResponseWriter, r *http.Request, change func(ms *domain.InAppMessage) error) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	id, ok := body["id"].(float64)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	ms, err := m.msRepo.GetByID(ctx, int(id))
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "message not found")
+		}
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	project, err := m.prRepo.GetByID(ctx, ms.PID)
+	if err != nil {
+		util.WriteError(w, http.StatusNotFound, "no project found")
+		return
+	}
+
+	if project.UserID != authUser.ID {
+		util.WriteStatus(w, http.StatusForbidden)
+		return
+	}
+
+	from := ms.Status
+	if err := change(ms); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = m.msRepo.UpdateStatus(ctx, ms, from)
+	if err != nil {
+		if err == domain.ErrNotificationStatusChanged {
+			util.WriteError(w, http.StatusConflict, err.Error())
+		} else {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	util.WriteJson(w, ms)
+}
+
+func (m *InAppMessageHandler) CancelMessageHandler(w http.ResponseWriter, r *http.Request) {
+	m.changeStatus(w, r, func(ms *domain.InAppMessage) error {
+		return ms.SetStatus(domain.NOTIFICATION_STATUS_CANCELED)
+	})
+}
+
+func (m *InAppMessageHandler) PauseMessageHandler(w http.ResponseWriter, r *http.Request) {
+	m.changeStatus(w, r, func(ms *domain.InAppMessage) error {
+		return ms.SetStatus(domain.NOTIFICATION_STATUS_PAUSED)
+	})
+}
+
+func (m *InAppMessageHandler) ResumeMessageHandler(w http.ResponseWriter, r *http.Request) {
+	m.changeStatus(w, r, func(ms *domain.InAppMessage) error {
+		return ms.Resume(time.Now())
+	})
+}
+
+func NewInAppMessageHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	msRepo domain.InAppMessageRepository,
+	prRepo domain.ProjectRepository,
+	sgRepo domain.SegmentRepository,
+	msCache domain.InAppMessageCache,
+) *InAppMessageHandler {
+	m := &InAppMessageHandler{
+		msCache: msCache,
+		msRepo:  msRepo,
+		prRepo:  prRepo,
+		sgRepo:  sgRepo,
+		router:  r,
+	}
+
+	m.router.HandleFunc("/{id}/messages", m.GetMessagesHandler).Methods("GET")
+	m.router.HandleFunc("/{id}/messages/clicked", m.MessageClickedHandler).Methods("GET")
+	m.router.HandleFunc("/{id}/messages/viewed", m.MessageViewedHandler).Methods("GET")
+
+	authRouter := m.router.NewRoute().Subrouter()
+	authRouter.Use(authMiddleware)
+	authRouter.HandleFunc("/{id}/messages/all", m.GetAllMessagesHandler).Methods("GET")
+
+	jsonRouter := authRouter.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/messages/new", m.NewMessageHandler).Methods("POST")
+	jsonRouter.HandleFunc("/messages/cancel", m.CancelMessageHandler).Methods("POST")
+	jsonRouter.HandleFunc("/messages/pause", m.PauseMessageHandler).Methods("POST")
+	jsonRouter.HandleFunc("/messages/resume", m.ResumeMessageHandler).Methods("POST")
+
+	return m
+}
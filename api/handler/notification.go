@@ -1,11 +1,13 @@
 package handler
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -13,17 +15,85 @@ import (
 	"github.com/doorbash/backend-services/api/domain"
 	"github.com/doorbash/backend-services/api/util"
 	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
 )
 
+// NOTIFICATIONS_MAX_AGE is how long shared caches may serve the notifications
+// of a project before revalidating them.
+const NOTIFICATIONS_MAX_AGE = time.Minute
+
 type NotificationHandler struct {
 	noCache domain.NotificationCache
 	noRepo  domain.NotificationRepository
 	prRepo  domain.ProjectRepository
+	sgRepo  domain.SegmentRepository
+	tpRepo  domain.NotificationTemplateRepository
+	dvRepo  domain.DeviceRepository
+	senders util.PushSenders
 	router  *mux.Router
 }
 
+// FCM_MAX_TOKENS is the most registration tokens a notification can be sent to
+// in one request.
+const FCM_MAX_TOKENS = 10 * util.FCM_MULTICAST_MAX_TOKENS
+
+// getFCMTarget reads the FCM target of a new notification, either the topic
+// of the route or the "fcm" object of the body with one of "condition",
+// "tokens" or "devices". It returns nil if the notification is not pushed.
+func getFCMTarget(r *http.Request, body map[string]interface{}) (*domain.FCMTarget, error) {
+	target := &domain.FCMTarget{}
+	n := 0
+	if topic := mux.Vars(r)["topic"]; topic != "" {
+		target.Topic = topic
+		n++
+	}
+	if f, ok := body["fcm"]; ok {
+		fcm, ok := f.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("bad fcm")
+		}
+		if c, ok := fcm["condition"]; ok {
+			condition, ok := c.(string)
+			if !ok || !strings.Contains(condition, "in topics") || len(condition) > 500 {
+				return nil, errors.New("bad fcm condition")
+			}
+			target.Condition = condition
+			n++
+		}
+		if t, ok := fcm["tokens"]; ok {
+			tokens, ok := t.([]interface{})
+			if !ok || len(tokens) == 0 {
+				return nil, errors.New("bad fcm tokens")
+			}
+			if len(tokens) > FCM_MAX_TOKENS {
+				return nil, fmt.Errorf("too much fcm tokens. max length is %d", FCM_MAX_TOKENS)
+			}
+			for _, t := range tokens {
+				token, ok := t.(string)
+				if !ok || token == "" {
+					return nil, errors.New("bad fcm tokens")
+				}
+				target.Tokens = append(target.Tokens, token)
+			}
+			n++
+		}
+		if devices, _ := fcm["devices"].(bool); devices {
+			target.Devices = true
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return nil, nil
+	case 1:
+		return target, nil
+	default:
+		return nil, errors.New("only one of fcm topic, condition, tokens and devices can be used")
+	}
+}
+
 func (n *NotificationHandler) GetNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 	pid := mux.Vars(r)["id"]
 	t := r.URL.Query().Get("time")
@@ -46,10 +116,6 @@ func (n *NotificationHandler) GetNotificationsHandler(w http.ResponseWriter, r *
 		util.WriteStatus(w, http.StatusNotFound)
 		return
 	}
-	if _time != nil && !_time.Before(*activeTime) {
-		util.WriteStatus(w, http.StatusNotFound)
-		return
-	}
 	ctx, cancel = util.GetContextWithTimeout(r.Context())
 	defer cancel()
 	data, err := n.noCache.GetDataByProjectID(ctx, pid)
@@ -59,13 +125,402 @@ func (n *NotificationHandler) GetNotificationsHandler(w http.ResponseWriter, r *
 		return
 	}
 	log.Println(*data)
+	now := time.Now()
+	device := getDeviceInfo(r)
+	notifications, localTime, err := prepareNotifications(*data, device, getPreferredLocales(r), now)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	// local time notifications show up for a device when its clock reaches
+	// them, which is later than when they became active
+	if localTime != nil && localTime.After(*activeTime) {
+		activeTime = localTime
+	}
+	if _time != nil && !_time.Before(*activeTime) {
+		util.WriteStatus(w, http.StatusNotFound)
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	etag, err := n.noCache.GetETagByProjectID(ctx, pid)
+	if err != nil && err != redis.Nil {
+		log.Println(err)
+	}
+	if etag != "" {
+		if localTime != nil {
+			etag = fmt.Sprintf("%s-%d", etag, localTime.Unix())
+		}
+		// the body carries the server time so only a weak validator fits
+		etag = fmt.Sprintf("W/\"%s\"", etag)
+	}
+	// the texts depend on the locale of the client
+	w.Header().Add("Vary", "Accept-Language")
+	if util.CheckNotModified(w, r, etag, activeTime, NOTIFICATIONS_MAX_AGE) {
+		return
+	}
+	// clients that do not send their device_id predate the viewed endpoint
+	// and have each fetch of new notifications counted as a view of them, as
+	// before
+	if device.ID == "" {
+		if err := n.countLegacyViews(r, pid, device.AppVersion, notifications); err != nil {
+			log.Println(err)
+		}
+	}
 	ret := map[string]interface{}{
-		"time":          time.Now().Format(time.RFC3339),
-		"notifications": json.RawMessage(*data),
+		"time":          now.Format(time.RFC3339),
+		"notifications": json.RawMessage(notifications),
 	}
 	util.WriteJson(w, ret)
 }
 
+// countLegacyViews counts a view of each of the prepared notifications.
+func (n *NotificationHandler) countLegacyViews(r *http.Request, pid string, appVersion int, notifications string) error {
+	var ids []struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(notifications), &ids); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	idArr := make([]string, len(ids))
+	for i, no := range ids {
+		idArr[i] = strconv.Itoa(no.ID)
+	}
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	return n.noCache.IncrViewsIds(ctx, pid, "", appVersion, idArr)
+}
+
+// prepareNotifications drops the notifications whose segment does not match
+// the device and strips the segment from the rest. Notifications made from a
+// template get the texts of the locale that best matches the preferred ones,
+// and the placeholders of the texts are filled from the device. Local time
+// notifications are only kept between their times on the device clock, and
+// the latest time one of them showed up is returned.
+func prepareNotifications(data string, device *domain.DeviceInfo, locales []string, now time.Time) (string, *time.Time, error) {
+	if !strings.Contains(data, `"segment":`) &&
+		!strings.Contains(data, `"localizations":`) &&
+		!strings.Contains(data, `"local_time":`) &&
+		!strings.Contains(data, "{{") {
+		return data, nil, nil
+	}
+	var notifications []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &notifications); err != nil {
+		return "", nil, err
+	}
+	values := device.Values()
+	var localTime *time.Time
+	ret := make([]map[string]json.RawMessage, 0, len(notifications))
+	for _, no := range notifications {
+		if segment, ok := no["segment"]; ok {
+			var condition domain.RemoteConfigCondition
+			if err := json.Unmarshal(segment, &condition); err != nil {
+				return "", nil, err
+			}
+			if !condition.Matches(device) {
+				continue
+			}
+			delete(no, "segment")
+		}
+		if _, ok := no["local_time"]; ok {
+			activeTime, visible, err := localizeNotificationTime(no, device, now)
+			if err != nil {
+				return "", nil, err
+			}
+			if !visible {
+				continue
+			}
+			if localTime == nil || activeTime.After(*localTime) {
+				localTime = &activeTime
+			}
+		}
+		if err := localizeNotification(no, values, locales); err != nil {
+			return "", nil, err
+		}
+		ret = append(ret, no)
+	}
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(b), localTime, nil
+}
+
+// localizeNotificationTime reports whether the device clock is between the
+// local times of the notification and sets its active time to when it showed
+// up on the device.
+func localizeNotificationTime(no map[string]json.RawMessage, device *domain.DeviceInfo, now time.Time) (time.Time, bool, error) {
+	var start, end time.Time
+	if err := json.Unmarshal(no["local_time"], &start); err != nil {
+		return start, false, err
+	}
+	if err := json.Unmarshal(no["local_expire_time"], &end); err != nil {
+		return start, false, err
+	}
+	delete(no, "local_time")
+	delete(no, "local_expire_time")
+	offset := time.Duration(device.TZOffset) * time.Minute
+	start = start.Add(-offset)
+	end = end.Add(-offset)
+	if now.Before(start) || !now.Before(end) {
+		return start, false, nil
+	}
+	b, err := json.Marshal(start.Format(time.RFC3339))
+	if err != nil {
+		return start, false, err
+	}
+	no["active_time"] = b
+	return start, true, nil
+}
+
+// localizeNotification replaces the texts of a notification with those of its
+// best matching localization and fills their placeholders.
+func localizeNotification(no map[string]json.RawMessage, values map[string]string, locales []string) error {
+	texts := map[string]string{}
+	for _, k := range []string{"title", "text", "big-text"} {
+		if v, ok := no[k]; ok {
+			var t string
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			texts[k] = t
+		}
+	}
+	if l, ok := no["localizations"]; ok {
+		var localizations map[string]domain.NotificationContent
+		if err := json.Unmarshal(l, &localizations); err != nil {
+			return err
+		}
+		available := make([]string, 0, len(localizations))
+		for locale := range localizations {
+			available = append(available, locale)
+		}
+		if locale := domain.MatchLocale(available, locales); locale != "" {
+			content := localizations[locale]
+			texts["title"] = content.Title
+			texts["text"] = content.Text
+			if content.BigText != nil {
+				texts["big-text"] = *content.BigText
+			}
+		}
+		delete(no, "localizations")
+	}
+	for k, t := range texts {
+		b, err := json.Marshal(domain.FillPlaceholders(t, values, false))
+		if err != nil {
+			return err
+		}
+		no[k] = b
+	}
+	return nil
+}
+
+// getRecurrence reads the recurrence of a new notification from the body. nil
+// is returned if it has none.
+func getRecurrence(body map[string]interface{}) (*domain.NotificationRecurrence, error) {
+	v, ok := body["recurrence"]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	recurrence := &domain.NotificationRecurrence{}
+	if err := json.Unmarshal(b, recurrence); err != nil {
+		return nil, fmt.Errorf("bad recurrence: %s", err)
+	}
+	if err := recurrence.Compile(); err != nil {
+		return nil, err
+	}
+	return recurrence, nil
+}
+
+// notificationError is a notification definition that can not be accepted,
+// with the status of the response for it.
+type notificationError struct {
+	status  int
+	message string
+}
+
+func (e *notificationError) Error() string {
+	return e.message
+}
+
+func badNotification(format string, a ...interface{}) error {
+	return &notificationError{status: http.StatusBadRequest, message: fmt.Sprintf(format, a...)}
+}
+
+// writeNotificationError writes the response for an error of a notification
+// definition. Other errors are internal.
+func writeNotificationError(w http.ResponseWriter, err error) {
+	if ne, ok := err.(*notificationError); ok {
+		util.WriteError(w, ne.status, ne.message)
+		return
+	}
+	log.Println(err)
+	util.WriteInternalServerError(w)
+}
+
+// getClickAction reads what happens when the notification is clicked, either
+// as click_action or in the legacy form of action with name, parent, url and
+// version. It returns nil if there is no action or it is null.
+func getClickAction(body map[string]interface{}) (*domain.NotificationAction, error) {
+	var action *domain.NotificationAction
+	if v, ok := body["click_action"]; ok {
+		if v == nil {
+			return nil, nil
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		action = &domain.NotificationAction{}
+		if err := json.Unmarshal(b, action); err != nil {
+			return nil, fmt.Errorf("bad click_action: %s", err)
+		}
+	} else {
+		t, _ := body["action"].(string)
+		if t == "" {
+			return nil, nil
+		}
+		action = &domain.NotificationAction{Type: t}
+		action.Name, _ = body["name"].(string)
+		action.Parent, _ = body["parent"].(string)
+		action.URL, _ = body["url"].(string)
+		switch version := body["version"].(type) {
+		case float64:
+			action.Version = int(version)
+		case string:
+			action.Version, _ = strconv.Atoi(version)
+		}
+	}
+	if err := action.Validate(); err != nil {
+		return nil, err
+	}
+	return action, nil
+}
+
+// payloadFields are the fields of domain.NotificationPayload in a body.
+var payloadFields = []string{"buttons", "data", "sound", "channel_id", "color", "icon"}
+
+// getPayload sets the payload fields of the body on payload. A null field is
+// cleared and the rest are kept.
+func getPayload(body map[string]interface{}, payload *domain.NotificationPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	changed := false
+	for _, k := range payloadFields {
+		v, ok := body[k]
+		if !ok {
+			continue
+		}
+		changed = true
+		if v == nil {
+			delete(fields, k)
+		} else {
+			fields[k] = v
+		}
+	}
+	if !changed {
+		return nil
+	}
+	b, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	p := domain.NotificationPayload{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("bad payload: %s", err)
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	*payload = p
+	return nil
+}
+
+// applyTemplate sets the texts of the notification from the template of
+// body["template_id"]. The placeholders are filled from body["params"] and the
+// rest are left to be filled from the device.
+func (n *NotificationHandler) applyTemplate(
+	r *http.Request,
+	project *domain.Project,
+	no *domain.Notification,
+	body map[string]interface{},
+) error {
+	tid, ok := body["template_id"].(float64)
+	if !ok {
+		return badNotification("bad template_id")
+	}
+	params := make(map[string]string)
+	if p, ok := body["params"]; ok {
+		values, ok := p.(map[string]interface{})
+		if !ok {
+			return badNotification("bad params")
+		}
+		for k, v := range values {
+			switch v := v.(type) {
+			case string:
+				params[k] = v
+			case float64, bool:
+				params[k] = fmt.Sprint(v)
+			default:
+				return badNotification("bad param %s", k)
+			}
+		}
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	template, err := n.tpRepo.GetByID(ctx, int(tid))
+	if err != nil || template.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		return &notificationError{status: http.StatusNotFound, message: fmt.Sprintf("template %d not found", int(tid))}
+	}
+
+	localizations := template.Render(params)
+	content := localizations[template.DefaultLocale]
+	if err := content.Validate(); err != nil {
+		return badNotification(err.Error())
+	}
+	no.Title = content.Title
+	no.Text = content.Text
+	if content.BigText != nil {
+		no.BigText = content.BigText
+	}
+	id := template.ID
+	no.TemplateID = &id
+	no.Localizations = localizations
+	return nil
+}
+
+// checkSegment makes sure that the segment belongs to the project.
+func (n *NotificationHandler) checkSegment(r *http.Request, pid string, id int) error {
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	segment, err := n.sgRepo.GetByID(ctx, id)
+	if err != nil || segment.PID != pid {
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		return badNotification("segment %d not found", id)
+	}
+	return nil
+}
+
 func (n *NotificationHandler) NotificationClickedHandler(w http.ResponseWriter, r *http.Request) {
 	pid := mux.Vars(r)["id"]
 	ids := r.URL.Query().Get("ids")
@@ -76,7 +531,30 @@ func (n *NotificationHandler) NotificationClickedHandler(w http.ResponseWriter,
 	}
 	ctx, cancel := util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	err := n.noCache.IncrClicksIds(ctx, pid, idArr)
+	err := n.noCache.IncrClicksIds(ctx, pid, getDeviceInfo(r).AppVersion, idArr)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteOK(w)
+}
+
+// NotificationViewedHandler is called by clients when notifications are shown
+// to the user. Devices that send their device_id are counted once in the reach
+// of a notification no matter how many times they report it.
+func (n *NotificationHandler) NotificationViewedHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	ids := r.URL.Query().Get("ids")
+	idArr := strings.Split(ids, ",")
+	if len(idArr) > 10 {
+		util.WriteError(w, http.StatusBadRequest, "too much ids. max length is 10")
+		return
+	}
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	device := getDeviceInfo(r)
+	err := n.noCache.IncrViewsIds(ctx, pid, device.ID, device.AppVersion, idArr)
 	if err != nil {
 		log.Println(err)
 		util.WriteInternalServerError(w)
@@ -131,115 +609,320 @@ func (n *NotificationHandler) GetAllNotificationsHandler(w http.ResponseWriter,
 	util.WriteJson(w, notifications)
 }
 
-func (n *NotificationHandler) NewNotificationHandler(w http.ResponseWriter, r *http.Request) {
-	authUser := r.Context().Value("user").(middleware.AuthUserValue)
-	jsonbody := r.Context().Value("json")
+// ctr is the click-through rate of a notification.
+func ctr(views int, clicks int) float64 {
+	if views == 0 {
+		return 0
+	}
+	return float64(clicks) / float64(views)
+}
 
-	pid, ok := mux.Vars(r)["id"]
-	if !ok {
-		log.Println("no id")
-		util.WriteInternalServerError(w)
+// GetNotificationStatsHandler returns the views and clicks of a notification
+// over time and by app version. The interval is hour or day and the range
+// defaults to the lifetime of the notification. With format=csv the stats are
+// exported as one row per interval and app version.
+func (n *NotificationHandler) GetNotificationStatsHandler(w http.ResponseWriter, r *http.Request) {
+	nid, err := strconv.Atoi(mux.Vars(r)["nid"])
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, "bad notification id")
 		return
 	}
 
-	body, ok := jsonbody.(map[string]interface{})
-	if !ok {
-		util.WriteStatus(w, http.StatusBadRequest)
+	query := r.URL.Query()
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = domain.NOTIFICATION_STATS_INTERVAL_HOUR
+	} else if interval != domain.NOTIFICATION_STATS_INTERVAL_HOUR && interval != domain.NOTIFICATION_STATS_INTERVAL_DAY {
+		util.WriteError(w, http.StatusBadRequest, "bad interval")
+		return
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		util.WriteError(w, http.StatusBadRequest, "bad format")
 		return
 	}
 
-	when, _ := body["when"].(string)
-	if when == "" {
-		when = "now"
+	project, ok := getUserProject(w, r, n.prRepo)
+	if !ok {
+		return
 	}
 
-	var scheduleTime time.Time
-	var expireTime time.Time
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	notification, err := n.noRepo.GetByID(ctx, nid)
+	if err != nil || notification.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "notification not found")
+		}
+		return
+	}
 
-	switch when {
-	case "later":
-		st, _ := body["schedule_time"].(string)
-		if st == "" {
-			util.WriteError(w, http.StatusBadRequest, "no schedule_time")
+	to := time.Now()
+	from := to.AddDate(0, 0, -7)
+	if notification.CreateTime != nil {
+		from = *notification.CreateTime
+	}
+	if f := query.Get("from"); f != "" {
+		from, err = time.Parse(time.RFC3339, f)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad from")
 			return
 		}
-		var err error
-		scheduleTime, err = time.Parse(time.RFC3339, st)
+	}
+	if t := query.Get("to"); t != "" {
+		to, err = time.Parse(time.RFC3339, t)
 		if err != nil {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad schedule_time: %s", st))
+			util.WriteError(w, http.StatusBadRequest, "bad to")
 			return
 		}
-		if scheduleTime.Before(time.Now().Add(15 * time.Minute)) {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("schedule_time: %s must be after %s", st, time.Now().Add(15*time.Minute).Format(time.RFC3339)))
+	}
+	if !from.Before(to) {
+		util.WriteError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	stats, err := n.noRepo.GetStats(ctx, nid, interval, from, to)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"notification-%d-stats.csv\"", nid))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "app_version", "views", "clicks", "ctr"})
+		for _, st := range stats {
+			cw.Write([]string{
+				st.Time.UTC().Format(time.RFC3339),
+				strconv.Itoa(st.AppVersion),
+				strconv.Itoa(st.Views),
+				strconv.Itoa(st.Clicks),
+				strconv.FormatFloat(ctr(st.Views, st.Clicks), 'f', 4, 64),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	series := make([]map[string]interface{}, 0)
+	appVersions := make(map[int]*domain.NotificationStats)
+	for i, st := range stats {
+		if i == 0 || !st.Time.Equal(stats[i-1].Time) {
+			series = append(series, map[string]interface{}{
+				"time":   st.Time,
+				"views":  0,
+				"clicks": 0,
+			})
+		}
+		last := series[len(series)-1]
+		last["views"] = last["views"].(int) + st.Views
+		last["clicks"] = last["clicks"].(int) + st.Clicks
+		if _, ok := appVersions[st.AppVersion]; !ok {
+			appVersions[st.AppVersion] = &domain.NotificationStats{AppVersion: st.AppVersion}
+		}
+		appVersions[st.AppVersion].Views += st.Views
+		appVersions[st.AppVersion].Clicks += st.Clicks
+	}
+	for _, point := range series {
+		point["ctr"] = ctr(point["views"].(int), point["clicks"].(int))
+	}
+	versions := make([]int, 0, len(appVersions))
+	for v := range appVersions {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	breakdown := make([]map[string]interface{}, 0, len(versions))
+	for _, v := range versions {
+		st := appVersions[v]
+		breakdown = append(breakdown, map[string]interface{}{
+			"app_version": v,
+			"views":       st.Views,
+			"clicks":      st.Clicks,
+			"ctr":         ctr(st.Views, st.Clicks),
+		})
+	}
+
+	util.WriteJson(w, map[string]interface{}{
+		"id":           notification.ID,
+		"views":        notification.ViewsCount,
+		"clicks":       notification.ClicksCount,
+		"reach":        notification.ReachCount,
+		"ctr":          ctr(notification.ViewsCount, notification.ClicksCount),
+		"interval":     interval,
+		"from":         from,
+		"to":           to,
+		"series":       series,
+		"app_versions": breakdown,
+	})
+}
+
+// getNotificationTimes reads when, schedule_time and expire_time of the body.
+// A recurring notification waits for its first occurrence and its expire time
+// is the end of the series.
+func getNotificationTimes(
+	body map[string]interface{},
+	recurrence *domain.NotificationRecurrence,
+	localTime bool,
+) (when string, scheduleTime time.Time, expireTime time.Time, err error) {
+	when, _ = body["when"].(string)
+	if when == "" {
+		if recurrence != nil || localTime {
+			when = "later"
+		} else {
+			when = "now"
+		}
+	}
+	if when == "now" && (recurrence != nil || localTime) {
+		err = badNotification("recurring and local time notifications can not be sent now")
+		return
+	}
+
+	switch when {
+	case "later":
+		st, _ := body["schedule_time"].(string)
+		switch {
+		case st == "" && recurrence != nil:
+			// the series starts now
+			scheduleTime = time.Now()
+			if localTime {
+				scheduleTime = domain.WallClock(scheduleTime)
+			}
+		case st == "":
+			err = badNotification("no schedule_time")
 			return
+		default:
+			scheduleTime, err = time.Parse(time.RFC3339, st)
+			if err != nil {
+				err = badNotification("bad schedule_time: %s", st)
+				return
+			}
+			// local times are read off the clock whatever the offset
+			if localTime {
+				scheduleTime = domain.WallClock(scheduleTime)
+			}
+			if scheduleTime.Before(time.Now().Add(15 * time.Minute)) {
+				err = badNotification("schedule_time: %s must be after %s", st, time.Now().Add(15*time.Minute).Format(time.RFC3339))
+				return
+			}
 		}
 		fallthrough
 	case "now":
 		et, _ := body["expire_time"].(string)
 		if et == "" {
-			util.WriteError(w, http.StatusBadRequest, "no expire_time")
+			err = badNotification("no expire_time")
 			return
 		}
-		var err error
 		expireTime, err = time.Parse(time.RFC3339, et)
 		if err != nil {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad expire_time: %s", et))
+			err = badNotification("bad expire_time: %s", et)
 			return
 		}
+		if localTime {
+			expireTime = domain.WallClock(expireTime)
+		}
 		if expireTime.Before(time.Now().Add(30 * time.Minute)) {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("expire_time: %s must be after %s", et, time.Now().Add(30*time.Minute).Format(time.RFC3339)))
+			err = badNotification("expire_time: %s must be after %s", et, time.Now().Add(30*time.Minute).Format(time.RFC3339))
 			return
 		}
 	default:
-		util.WriteError(w, http.StatusBadRequest, "bad when")
+		err = badNotification("bad when")
 		return
 	}
 
 	if when == "later" && expireTime.Before(scheduleTime.Add(30*time.Minute)) {
-		util.WriteError(w, http.StatusBadRequest, "bad expire time")
+		err = badNotification("bad expire time")
 		return
 	}
 
+	if recurrence != nil {
+		first := recurrence.Next(scheduleTime.Add(-time.Minute))
+		if first.IsZero() || !first.Before(expireTime) {
+			err = badNotification("recurrence has no occurrence before expire_time")
+			return
+		}
+		scheduleTime = first
+	}
+	return
+}
+
+// setNotificationTimes makes the notification active at now or schedules it.
+func setNotificationTimes(
+	no *domain.Notification,
+	when string,
+	scheduleTime time.Time,
+	expireTime time.Time,
+	now time.Time,
+) {
+	switch when {
+	case "now":
+		no.Status = domain.NOTIFICATION_STATUS_ACTIVE
+		no.ActiveTime = &now
+		no.ScheduleTime = nil
+	case "later":
+		no.Status = domain.NOTIFICATION_STATUS_SCHEDULED
+		no.ActiveTime = nil
+		no.ScheduleTime = &scheduleTime
+	}
+	no.ExpireTime = &expireTime
+}
+
+// newNotification makes a notification of the project from the definition in
+// the body. It is not stored.
+func (n *NotificationHandler) newNotification(
+	r *http.Request,
+	project *domain.Project,
+	body map[string]interface{},
+	now time.Time,
+) (*domain.Notification, error) {
+	recurrence, err := getRecurrence(body)
+	if err != nil {
+		return nil, badNotification(err.Error())
+	}
+	localTime, _ := body["local_time"].(bool)
+	if recurrence != nil && recurrence.Local() {
+		localTime = true
+	}
+
+	when, scheduleTime, expireTime, err := getNotificationTimes(body, recurrence, localTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// the texts come from the template if there is one
+	_, hasTemplate := body["template_id"]
+
 	title, _ := body["title"].(string)
-	if title == "" {
-		util.WriteError(w, http.StatusBadRequest, "no title")
-		return
+	if title == "" && !hasTemplate {
+		return nil, badNotification("no title")
 	}
 	text, _ := body["text"].(string)
-	if text == "" {
-		util.WriteError(w, http.StatusBadRequest, "no text")
-		return
+	if text == "" && !hasTemplate {
+		return nil, badNotification("no text")
 	}
 
 	image, _ := body["image"].(string)
 	if image != "" && !strings.HasPrefix(image, "http") {
-		log.Println("bad image:", image)
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad image:%s", image))
-		return
+		return nil, badNotification("bad image:%s", image)
 	}
 
-	action, _ := body["action"].(string)
-	var extra string
-	switch action {
-	case "":
-	case "activity":
-		name, _ := body["name"].(string)
-		parent, _ := body["parent"].(string)
-		if parent == "" {
-			extra = name
-		} else {
-			extra = fmt.Sprintf("%s %s", parent, name)
-		}
-	case "link":
-		extra, _ = body["url"].(string)
-	case "update":
-		url, _ := body["url"].(string)
-		version, _ := body["version"].(float64)
-		extra = fmt.Sprintf("%s %d", url, int(version))
-	default:
-		log.Println("bad action:", action)
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad action %s", action))
-		return
+	clickAction, err := getClickAction(body)
+	if err != nil {
+		return nil, badNotification(err.Error())
+	}
+
+	var payload domain.NotificationPayload
+	if err := getPayload(body, &payload); err != nil {
+		return nil, badNotification(err.Error())
 	}
 
 	priority, _ := body["priority"].(string)
@@ -248,9 +931,7 @@ func (n *NotificationHandler) NewNotificationHandler(w http.ResponseWriter, r *h
 	case "":
 		priority = "default"
 	default:
-		log.Println("bad priority:", priority)
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad priority %s", priority))
-		return
+		return nil, badNotification("bad priority %s", priority)
 	}
 
 	var bigText string
@@ -263,42 +944,38 @@ func (n *NotificationHandler) NewNotificationHandler(w http.ResponseWriter, r *h
 		style = "normal"
 	case "big-text":
 		bigText, _ = body["big-text"].(string)
-		if bigText == "" {
-			log.Println("no big-text")
-			util.WriteError(w, http.StatusBadRequest, "no big-text")
-			return
+		if bigText == "" && !hasTemplate {
+			return nil, badNotification("no big-text")
 		}
 	case "big-image":
 		bigImage, _ = body["big-image"].(string)
 		if bigImage == "" {
-			log.Println("no big-image")
-			util.WriteError(w, http.StatusBadRequest, "no big-image")
-			return
+			return nil, badNotification("no big-image")
 		}
 	default:
-		log.Println("bad style:", style)
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad style %s", style))
-		return
+		return nil, badNotification("bad style %s", style)
 	}
 
-	ctx, cancel := util.GetContextWithTimeout(r.Context())
-	defer cancel()
-	project, err := n.prRepo.GetByID(ctx, pid)
+	fcm, err := getFCMTarget(r, body)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			util.WriteError(w, http.StatusNotFound, "project not found.")
-		} else {
-			util.WriteInternalServerError(w)
-		}
-		return
+		return nil, badNotification(err.Error())
+	}
+	if fcm != nil && localTime {
+		return nil, badNotification("local time can not be used with fcm")
 	}
 
-	if project.UserID != authUser.ID {
-		util.WriteStatus(w, http.StatusForbidden)
-		return
+	var segmentID *int
+	if sid, ok := body["segment_id"].(float64); ok {
+		if fcm != nil {
+			return nil, badNotification("segments can not be used with fcm")
+		}
+		if err := n.checkSegment(r, project.ID, int(sid)); err != nil {
+			return nil, err
+		}
+		id := int(sid)
+		segmentID = &id
 	}
 
-	now := time.Now()
 	no := &domain.Notification{
 		PID:        project.ID,
 		Title:      title,
@@ -306,6 +983,13 @@ func (n *NotificationHandler) NewNotificationHandler(w http.ResponseWriter, r *h
 		CreateTime: &now,
 		Priority:   priority,
 		Style:      style,
+		SegmentID:  segmentID,
+		Channel:    domain.NOTIFICATION_CHANNEL_PULL,
+	}
+
+	if fcm != nil {
+		no.Channel = domain.NOTIFICATION_CHANNEL_FCM
+		no.FCMTarget = fcm
 	}
 
 	if bigText != "" {
@@ -320,50 +1004,84 @@ func (n *NotificationHandler) NewNotificationHandler(w http.ResponseWriter, r *h
 		no.Image = &image
 	}
 
-	if action != "" {
-		no.Action = &action
-		no.Extra = &extra
+	no.SetClickAction(clickAction)
+	no.NotificationPayload = payload
+
+	if hasTemplate {
+		if err := n.applyTemplate(r, project, no, body); err != nil {
+			return nil, err
+		}
+		if no.Style == "big-text" && no.BigText == nil {
+			return nil, badNotification("no big-text")
+		}
 	}
 
-	switch when {
-	case "now":
-		no.Status = domain.NOTIFICATION_STATUS_ACTIVE
-		no.ActiveTime = &now
-		no.ExpireTime = &expireTime
-	case "later":
-		no.Status = domain.NOTIFICATION_STATUS_SCHEDULED
-		no.ScheduleTime = &scheduleTime
-		no.ExpireTime = &expireTime
+	setNotificationTimes(no, when, scheduleTime, expireTime, now)
+	if when == "later" {
+		no.LocalTime = localTime
+		no.Recurrence = recurrence
+	}
+
+	return no, nil
+}
+
+func (n *NotificationHandler) NewNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+	jsonbody := r.Context().Value("json")
+
+	body, ok := jsonbody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	project, ok := getUserProject(w, r, n.prRepo)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	no, err := n.newNotification(r, project, body, now)
+	if err != nil {
+		writeNotificationError(w, err)
+		return
+	}
+
+	// scheduled pushes are sent by the loop service once they are active. the
+	// send time is set on insert so that the loop does not push this one too.
+	pushNow := no.Channel == domain.NOTIFICATION_CHANNEL_FCM && no.Status == domain.NOTIFICATION_STATUS_ACTIVE
+	if pushNow {
+		no.FCMSendTime = &now
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = n.noRepo.Insert(ctx, no, domain.NotificationUserActor(authUser.ID))
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
 	}
 
-	topic, ok := mux.Vars(r)["topic"]
-	if !ok || topic == "" {
+	if pushNow {
+		result, err := util.PushNotification(r.Context(), n.senders, no, n.dvRepo)
+		if err != nil {
+			log.Println(err)
+		}
 		ctx, cancel = util.GetContextWithTimeout(r.Context())
 		defer cancel()
-		err = n.noRepo.Insert(ctx, no)
-		if err != nil {
+		if err := n.noRepo.UpdateFCMResult(ctx, no); err != nil {
 			log.Println(err)
-			util.WriteStatus(w, http.StatusBadRequest)
-			return
 		}
-	} else {
-		rand.Seed(time.Now().UnixNano())
-		no.ID = rand.Intn(10000000) + 1
-		b, err := json.Marshal(no)
 		if err != nil {
-			log.Println(err)
-			util.WriteStatus(w, http.StatusBadRequest)
+			util.WriteErrorDetails(w, http.StatusBadGateway, "can not push notification", no)
 			return
 		}
-		ctx, cancel = util.GetContextWithThisTimeout(r.Context(), 20*time.Second)
-		defer cancel()
-		err = util.SendNotification(ctx, project.ID, topic, map[string]string{
-			"type": "notification",
-			"data": string(b),
-		})
-		if err != nil {
-			log.Println(err)
-			util.WriteStatus(w, http.StatusBadRequest)
+		if result != nil {
+			util.WriteJson(w, map[string]interface{}{
+				"notification": no,
+				"fcm":          result,
+			})
 			return
 		}
 	}
@@ -390,30 +1108,15 @@ func (n *NotificationHandler) UpdateNotificationHandler(w http.ResponseWriter, r
 	text, _ := body["text"].(string)
 	st, _ := body["schedule_time"].(string)
 	et, _ := body["expire_time"].(string)
-	action, _ := body["action"].(string)
 	bigText, _ := body["big-text"].(string)
 	bigImage, _ := body["big-image"].(string)
 
-	var extra string
-	switch action {
-	case "":
-	case "activity":
-		name, _ := body["name"].(string)
-		parent, _ := body["parent"].(string)
-		if parent == "" {
-			extra = name
-		} else {
-			extra = fmt.Sprintf("%s %s", parent, name)
-		}
-	case "link":
-		extra, _ = body["url"].(string)
-	case "update":
-		url, _ := body["url"].(string)
-		version, _ := body["version"].(string)
-		extra = fmt.Sprintf("%s%s", url, version)
-	default:
-		log.Println("bad action:", action)
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad action %s", action))
+	action, _ := body["action"].(string)
+	_, hasAction := body["click_action"]
+	hasAction = hasAction || action != ""
+	clickAction, err := getClickAction(body)
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -463,6 +1166,18 @@ func (n *NotificationHandler) UpdateNotificationHandler(w http.ResponseWriter, r
 		return
 	}
 
+	if no.FCMSendTime != nil {
+		util.WriteError(w, http.StatusBadRequest, "notification is already pushed")
+		return
+	}
+
+	if _, ok := body["template_id"]; ok {
+		if err := n.applyTemplate(r, project, no, body); err != nil {
+			writeNotificationError(w, err)
+			return
+		}
+	}
+
 	if title != "" {
 		no.Title = title
 	}
@@ -487,74 +1202,154 @@ func (n *NotificationHandler) UpdateNotificationHandler(w http.ResponseWriter, r
 		no.BigImage = &bigImage
 	}
 
-	if action != "" {
-		no.Action = &action
-		no.Extra = &extra
+	if hasAction {
+		no.SetClickAction(clickAction)
+	}
+
+	if err := getPayload(body, &no.NotificationPayload); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	if priority != "" {
 		no.Priority = priority
 	}
 
+	if sid, ok := body["segment_id"]; ok {
+		if sid == nil {
+			no.SegmentID = nil
+		} else if id, ok := sid.(float64); ok {
+			if no.Channel == domain.NOTIFICATION_CHANNEL_FCM {
+				util.WriteError(w, http.StatusBadRequest, "segments can not be used with fcm")
+				return
+			}
+			if err := n.checkSegment(r, project.ID, int(id)); err != nil {
+				writeNotificationError(w, err)
+				return
+			}
+			segmentID := int(id)
+			no.SegmentID = &segmentID
+		} else {
+			util.WriteError(w, http.StatusBadRequest, "bad segment_id")
+			return
+		}
+	}
+
 	if style != "" {
 		no.Style = style
 	}
 
-	var scheduleTime time.Time
+	if err := rescheduleNotification(no, st, et); err != nil {
+		writeNotificationError(w, err)
+		return
+	}
+
+	image, _ := body["image"].(string)
+	if image != "" && !strings.HasPrefix(image, "http") {
+		log.Println("bad image url:", image)
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad image url: %s", image))
+		return
+	}
+
+	if image != "" {
+		no.Image = &image
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = n.noRepo.Update(ctx, no)
+
+	if err != nil {
+		if err == domain.ErrNotificationStatusChanged {
+			util.WriteError(w, http.StatusConflict, err.Error())
+		} else {
+			log.Println(err)
+			util.WriteStatus(w, http.StatusBadRequest)
+		}
+		return
+	}
+
+	util.WriteJson(w, no)
+}
+
+// rescheduleNotification moves the notification to the schedule time st and
+// the expire time et. Either of them can be empty to keep the current one.
+func rescheduleNotification(no *domain.Notification, st string, et string) error {
 	if st != "" {
 		if no.Status != domain.NOTIFICATION_STATUS_SCHEDULED {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("notification is not scheduled. status:%d", no.Status))
-			return
+			return badNotification("notification is not scheduled. status:%d", no.Status)
+		}
+		scheduleTime, err := time.Parse(time.RFC3339, st)
+		if err == nil && no.LocalTime {
+			scheduleTime = domain.WallClock(scheduleTime)
 		}
-		var err error
-		scheduleTime, err = time.Parse(time.RFC3339, st)
 		if err != nil || scheduleTime.Before(time.Now().Add(15*time.Minute)) {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad schedule_time: %s", st))
-			return
+			return badNotification("bad schedule_time: %s", st)
+		}
+		if no.Recurrence != nil {
+			// the series restarts from the first occurrence after the time
+			scheduleTime = no.Recurrence.Next(scheduleTime.Add(-time.Minute))
+			if scheduleTime.IsZero() {
+				return badNotification("recurrence has no occurrence after schedule_time")
+			}
 		}
 		no.ScheduleTime = &scheduleTime
 	}
 
-	var expireTime time.Time
 	if et != "" {
-		var err error
-		expireTime, err = time.Parse(time.RFC3339, et)
-		if err != nil || expireTime.Before(time.Now().Add(30*time.Minute)) {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad expire_time: %s", et))
-			return
+		expireTime, err := time.Parse(time.RFC3339, et)
+		if err == nil && no.LocalTime {
+			expireTime = domain.WallClock(expireTime)
 		}
-		if no.Status == domain.NOTIFICATION_STATUS_SCHEDULED && expireTime.Before(scheduleTime.Add(30*time.Minute)) {
-			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("expire_time (%s) < schedule_time + 30min (%s)", et, scheduleTime.Add(30*time.Minute)))
-			return
+		if err != nil || expireTime.Before(time.Now().Add(30*time.Minute)) {
+			return badNotification("bad expire_time: %s", et)
 		}
 		no.ExpireTime = &expireTime
 	}
 
-	image, _ := body["image"].(string)
-	if image != "" && !strings.HasPrefix(image, "http") {
-		log.Println("bad image url:", image)
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad image url: %s", image))
-		return
+	if (st != "" || et != "") && no.Status == domain.NOTIFICATION_STATUS_SCHEDULED && no.ExpireTime.Before(no.ScheduleTime.Add(30*time.Minute)) {
+		return badNotification("expire_time (%s) < schedule_time + 30min (%s)", no.ExpireTime.Format(time.RFC3339), no.ScheduleTime.Add(30*time.Minute).Format(time.RFC3339))
 	}
+	return nil
+}
 
-	if image != "" {
-		no.Image = &image
+// getUserNotification returns the notification with the id if it belongs to a
+// project of the user.
+func (n *NotificationHandler) getUserNotification(w http.ResponseWriter, r *http.Request, id int) (*domain.Notification, bool) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	no, err := n.noRepo.GetByID(ctx, id)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "notification not found")
+		}
+		return nil, false
 	}
 
 	ctx, cancel = util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	err = n.noRepo.Update(ctx, no)
-
+	project, err := n.prRepo.GetByID(ctx, no.PID)
 	if err != nil {
-		log.Println(err)
-		util.WriteStatus(w, http.StatusBadRequest)
-		return
+		util.WriteError(w, http.StatusNotFound, "no project found")
+		return nil, false
 	}
 
-	util.WriteJson(w, no)
+	if project.UserID != authUser.ID {
+		util.WriteStatus(w, http.StatusForbidden)
+		return nil, false
+	}
+
+	return no, true
 }
 
-func (n *NotificationHandler) CancelNotificationHandler(w http.ResponseWriter, r *http.Request) {
+// changeStatus reads the notification with the id in the body, lets change
+// move it to its new status and stores the transition as made by the user.
+func (n *NotificationHandler) changeStatus(w http.ResponseWriter, r *http.Request, change func(no *domain.Notification) error) {
 	authUser := r.Context().Value("user").(middleware.AuthUserValue)
 	jsonBody := r.Context().Value("json")
 
@@ -570,47 +1365,83 @@ func (n *NotificationHandler) CancelNotificationHandler(w http.ResponseWriter, r
 		return
 	}
 
-	ctx, cancel := util.GetContextWithTimeout(r.Context())
-	defer cancel()
-	no, err := n.noRepo.GetByID(ctx, int(id))
-
-	if err != nil {
-		util.WriteStatus(w, http.StatusNotFound)
+	no, ok := n.getUserNotification(w, r, int(id))
+	if !ok {
 		return
 	}
 
-	if no.Status != domain.NOTIFICATION_STATUS_ACTIVE && no.Status != domain.NOTIFICATION_STATUS_SCHEDULED {
-		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("notification status must be active or scheduled. status: %d", no.Status))
+	from := no.Status
+	if err := change(no); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	project, err := n.prRepo.GetByID(ctx, no.PID)
-
+	err := n.noRepo.UpdateStatus(ctx, no, from, domain.NotificationUserActor(authUser.ID))
 	if err != nil {
-		util.WriteError(w, http.StatusNotFound, "no project found")
+		if err == domain.ErrNotificationStatusChanged {
+			util.WriteError(w, http.StatusConflict, err.Error())
+		} else {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		}
 		return
 	}
 
-	if project.UserID != authUser.ID {
-		util.WriteStatus(w, http.StatusForbidden)
+	util.WriteJson(w, no)
+}
+
+func (n *NotificationHandler) CancelNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	n.changeStatus(w, r, func(no *domain.Notification) error {
+		return no.SetStatus(domain.NOTIFICATION_STATUS_CANCELED)
+	})
+}
+
+// PauseNotificationHandler takes a notification off the clients, or holds it
+// back from being activated or pushed, until it is resumed.
+func (n *NotificationHandler) PauseNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	n.changeStatus(w, r, func(no *domain.Notification) error {
+		if no.Status == domain.NOTIFICATION_STATUS_ACTIVE && no.FCMSendTime != nil {
+			return errors.New("notification is already pushed")
+		}
+		return no.SetStatus(domain.NOTIFICATION_STATUS_PAUSED)
+	})
+}
+
+func (n *NotificationHandler) ResumeNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	n.changeStatus(w, r, func(no *domain.Notification) error {
+		return no.Resume(time.Now())
+	})
+}
+
+// GetNotificationHistoryHandler returns the status transitions of a
+// notification, oldest first.
+func (n *NotificationHandler) GetNotificationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	nid, err := strconv.Atoi(mux.Vars(r)["nid"])
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, "bad notification id")
 		return
 	}
 
-	no.Status = domain.NOTIFICATION_STATUS_CANCELED
+	no, ok := n.getUserNotification(w, r, nid)
+	if !ok {
+		return
+	}
 
-	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	err = n.noRepo.Update(ctx, no)
-
+	events, err := n.noRepo.GetHistory(ctx, no.ID)
 	if err != nil {
 		log.Println(err)
-		util.WriteStatus(w, http.StatusBadRequest)
+		util.WriteInternalServerError(w)
 		return
 	}
 
-	util.WriteJson(w, no)
+	util.WriteJson(w, map[string]interface{}{
+		"notification": no,
+		"history":      events,
+	})
 }
 
 func NewNotificationHandler(
@@ -618,28 +1449,47 @@ func NewNotificationHandler(
 	authMiddleware mux.MiddlewareFunc,
 	noRepo domain.NotificationRepository,
 	prRepo domain.ProjectRepository,
+	sgRepo domain.SegmentRepository,
+	tpRepo domain.NotificationTemplateRepository,
+	dvRepo domain.DeviceRepository,
 	noCache domain.NotificationCache,
+	senders util.PushSenders,
 ) *NotificationHandler {
 	n := &NotificationHandler{
 		noCache: noCache,
 		noRepo:  noRepo,
 		prRepo:  prRepo,
+		sgRepo:  sgRepo,
+		tpRepo:  tpRepo,
+		dvRepo:  dvRepo,
+		senders: senders,
 		router:  r,
 	}
 
 	n.router.HandleFunc("/{id}/notifications", n.GetNotificationsHandler).Methods("GET")
 	n.router.HandleFunc("/{id}/notifications/clicked", n.NotificationClickedHandler).Methods("GET")
+	n.router.HandleFunc("/{id}/notifications/viewed", n.NotificationViewedHandler).Methods("GET")
 
 	authRouter := n.router.NewRoute().Subrouter()
 	authRouter.Use(authMiddleware)
 	authRouter.HandleFunc("/{id}/notifications/all", n.GetAllNotificationsHandler).Methods("GET")
+	authRouter.HandleFunc("/{id}/notifications/{nid:[0-9]+}/stats", n.GetNotificationStatsHandler).Methods("GET")
+	authRouter.HandleFunc("/notifications/{nid:[0-9]+}/history", n.GetNotificationHistoryHandler).Methods("GET")
+	authRouter.HandleFunc("/{id}/notifications/import", n.ImportNotificationsHandler).Methods("POST")
 
 	jsonRouter := authRouter.NewRoute().Subrouter()
 	jsonRouter.Use(middleware.JsonBodyMiddleware)
 	jsonRouter.HandleFunc("/{id}/notifications/new", n.NewNotificationHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/notifications/new/fcm", n.NewNotificationHandler).Methods("POST")
 	jsonRouter.HandleFunc("/{id}/notifications/new/fcm/{topic}", n.NewNotificationHandler).Methods("POST")
 	jsonRouter.HandleFunc("/notifications/update", n.UpdateNotificationHandler).Methods("POST")
 	jsonRouter.HandleFunc("/notifications/cancel", n.CancelNotificationHandler).Methods("POST")
+	jsonRouter.HandleFunc("/notifications/pause", n.PauseNotificationHandler).Methods("POST")
+	jsonRouter.HandleFunc("/notifications/resume", n.ResumeNotificationHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/notifications/bulk/new", n.BulkNewNotificationsHandler).Methods("POST")
+	jsonRouter.HandleFunc("/notifications/bulk/cancel", n.BulkCancelNotificationsHandler).Methods("POST")
+	jsonRouter.HandleFunc("/notifications/bulk/reschedule", n.BulkRescheduleNotificationsHandler).Methods("POST")
+	jsonRouter.HandleFunc("/notifications/bulk/clone", n.BulkCloneNotificationsHandler).Methods("POST")
 
 	return n
 }
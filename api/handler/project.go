@@ -255,3 +255,37 @@ func NewProjectHandler(r *mux.Router, authMiddleware mux.MiddlewareFunc, prRepo
 
 	return p
 }
+
+// getUserProject loads the project named by the {id} route variable and checks
+// that it belongs to the authenticated user. On failure the response is written
+// and false is returned.
+func getUserProject(w http.ResponseWriter, r *http.Request, prRepo domain.ProjectRepository) (*domain.Project, bool) {
+	authUser := r.Context().Value("user").(middleware.AuthUserValue)
+
+	pid, ok := mux.Vars(r)["id"]
+	if !ok {
+		log.Println("no id")
+		util.WriteInternalServerError(w)
+		return nil, false
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	project, err := prRepo.GetByID(ctx, pid)
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, "project not found.")
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return nil, false
+	}
+
+	if project.UserID != authUser.ID {
+		util.WriteStatus(w, http.StatusForbidden)
+		return nil, false
+	}
+
+	return project, true
+}
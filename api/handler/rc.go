@@ -1,27 +1,83 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/doorbash/backend-services/api/domain"
 	"github.com/doorbash/backend-services/api/util"
 	"github.com/doorbash/backend-services/api/util/middleware"
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/go-redis/redis/v8"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
 )
 
+// RC_MAX_AGE is how long shared caches may serve a remote config before
+// revalidating it.
+const RC_MAX_AGE = time.Minute
+
 type RemoteConfigHandler struct {
-	rcCache domain.RemoteConfigCache
-	rcRepo  domain.RemoteConfigRepository
-	prRepo  domain.ProjectRepository
-	router  *mux.Router
+	rcCache      domain.RemoteConfigCache
+	rcRepo       domain.RemoteConfigRepository
+	prRepo       domain.ProjectRepository
+	streamPubSub domain.StreamPubSub
+	fcm          *util.FCMClients
+	router       *mux.Router
+}
+
+// publishRemoteConfig caches the version of the remote config that was just
+// stored and tells the live clients of the project about it, rather than
+// leaving both to the next run of the loop service. Failures are only logged
+// since the loop service catches up with them.
+func publishRemoteConfig(
+	r *http.Request,
+	rcRepo domain.RemoteConfigRepository,
+	rcCache domain.RemoteConfigCache,
+	streamPubSub domain.StreamPubSub,
+	pid string,
+	namespace string,
+) {
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := rcRepo.GetByProjectID(ctx, pid, namespace)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = rcCache.Update(ctx, remoteConfig)
+	if err != nil {
+		// the cache already has a newer version, which was published
+		// along with it
+		if err != redis.Nil {
+			log.Println(err)
+		}
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = streamPubSub.Publish(ctx, pid, &domain.StreamEvent{
+		Type:      domain.STREAM_EVENT_RC,
+		Namespace: namespace,
+		Version:   remoteConfig.Version,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (rc *RemoteConfigHandler) publish(r *http.Request, pid string, namespace string) {
+	publishRemoteConfig(r, rc.rcRepo, rc.rcCache, rc.streamPubSub, pid, namespace)
 }
 
 func (rc *RemoteConfigHandler) GetDataHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,6 +86,10 @@ func (rc *RemoteConfigHandler) GetDataHandler(w http.ResponseWriter, r *http.Req
 		util.WriteInternalServerError(w)
 		return
 	}
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
 	version := r.URL.Query().Get("version")
 	var vi int
 	if version != "" {
@@ -42,7 +102,7 @@ func (rc *RemoteConfigHandler) GetDataHandler(w http.ResponseWriter, r *http.Req
 	}
 	ctx, cancel := util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	v, err := rc.rcCache.GetVersionByProjectID(ctx, pid)
+	v, err := rc.rcCache.GetVersionByProjectID(ctx, pid, namespace)
 	if err != nil {
 		util.WriteStatus(w, http.StatusNotFound)
 		return
@@ -53,7 +113,16 @@ func (rc *RemoteConfigHandler) GetDataHandler(w http.ResponseWriter, r *http.Req
 	}
 	ctx, cancel = util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	data, err := rc.rcCache.GetDataByProjectID(ctx, pid)
+	updateTime, err := rc.rcCache.GetUpdateTimeByProjectID(ctx, pid, namespace)
+	if err != nil && err != redis.Nil {
+		log.Println(err)
+	}
+	if util.CheckNotModified(w, r, fmt.Sprintf("\"%d\"", *v), updateTime, RC_MAX_AGE) {
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	data, err := rc.rcCache.GetDataByProjectID(ctx, pid, namespace)
 	if err != nil {
 		log.Println(err)
 		if err == redis.Nil {
@@ -63,12 +132,95 @@ func (rc *RemoteConfigHandler) GetDataHandler(w http.ResponseWriter, r *http.Req
 		}
 		return
 	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	rules, err := rc.rcCache.GetRulesByProjectID(ctx, pid, namespace)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	experiments, err := rc.rcCache.GetExperimentsByProjectID(ctx, pid, namespace)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
 	remoteConfig := &domain.RemoteConfig{
+		ProjectID:   pid,
+		Namespace:   namespace,
+		Data:        *data,
+		Rules:       rules,
+		Experiments: experiments,
+		Version:     *v,
+	}
+	device := getDeviceInfo(r)
+	resolved, exposures, err := remoteConfig.Resolve(device)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	if len(exposures) > 0 {
+		ctx, cancel = util.GetContextWithTimeout(r.Context())
+		defer cancel()
+		if err := rc.rcCache.AddExposures(ctx, pid, device.ID, exposures); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if vi > 0 && r.URL.Query().Get("delta") == "true" {
+		ctx, cancel = util.GetContextWithTimeout(r.Context())
+		defer cancel()
+		base, err := rc.rcCache.GetByVersion(ctx, pid, namespace, vi)
+		if err != nil && err != redis.Nil {
+			log.Println(err)
+		}
+		if err == nil {
+			if patch, ok := createDelta(base, resolved, device); ok {
+				util.WriteJson(w, map[string]interface{}{
+					"version":      *v,
+					"base_version": vi,
+					"patch":        patch,
+				})
+				return
+			}
+		}
+	}
+
+	util.WriteJson(w, &domain.RemoteConfig{
 		ProjectID: pid,
-		Data:      *data,
+		Namespace: namespace,
+		Data:      resolved,
 		Version:   *v,
+	})
+}
+
+// createDelta returns the json patch from the base version of the remote config,
+// as seen by the device, to data. It returns false when the patch is not
+// smaller than data itself.
+func createDelta(base *domain.RemoteConfig, data string, device *domain.DeviceInfo) (json.RawMessage, bool) {
+	from, _, err := base.Resolve(device)
+	if err != nil {
+		log.Println(err)
+		return nil, false
 	}
-	util.WriteJson(w, remoteConfig)
+	ops, err := util.CreateJsonPatch(from, data)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	if len(patch) >= len(data) {
+		return nil, false
+	}
+	return patch, true
 }
 
 func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.Request) {
@@ -82,6 +234,11 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
 	ctx, cancel := util.GetContextWithTimeout(r.Context())
 	defer cancel()
 	project, err := rc.prRepo.GetByID(ctx, pid)
@@ -109,14 +266,18 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 
 	ctx, cancel = util.GetContextWithTimeout(r.Context())
 	defer cancel()
-	remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID)
+	remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID, namespace)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			remoteConfig := &domain.RemoteConfig{
 				ProjectID: project.ID,
+				Namespace: namespace,
 				Data:      string(data),
 			}
 			log.Println(remoteConfig)
+			if !checkSchema(w, r, rc.rcRepo, remoteConfig) {
+				return
+			}
 			ctx, cancel = util.GetContextWithTimeout(r.Context())
 			defer cancel()
 			err = rc.rcRepo.Insert(ctx, remoteConfig)
@@ -125,6 +286,7 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 				util.WriteInternalServerError(w)
 				return
 			}
+			rc.publish(r, project.ID, namespace)
 			util.WriteJson(w, remoteConfig)
 		} else {
 			log.Println(err)
@@ -133,6 +295,9 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 		return
 	}
 	remoteConfig.Data = string(data)
+	if !checkSchema(w, r, rc.rcRepo, remoteConfig) {
+		return
+	}
 	ctx, cancel = util.GetContextWithTimeout(r.Context())
 	defer cancel()
 	err = rc.rcRepo.Update(ctx, remoteConfig)
@@ -141,6 +306,7 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 		util.WriteInternalServerError(w)
 		return
 	}
+	rc.publish(r, project.ID, namespace)
 
 	topic, ok := mux.Vars(r)["topic"]
 	if ok && topic != "" {
@@ -153,7 +319,7 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 		}
 		ctx, cancel = util.GetContextWithThisTimeout(r.Context(), 20*time.Second)
 		defer cancel()
-		err = util.SendNotification(ctx, project.ID, topic, map[string]string{
+		err = rc.fcm.SendNotification(ctx, project.ID, topic, map[string]string{
 			"type": "rc",
 			"data": string(b),
 		})
@@ -167,25 +333,705 @@ func (rc *RemoteConfigHandler) UpdateDataHandler(w http.ResponseWriter, r *http.
 	util.WriteJson(w, remoteConfig)
 }
 
+type schemaViolationsError []util.JsonSchemaViolation
+
+func (e schemaViolationsError) Error() string {
+	return "remote config does not match the schema"
+}
+
+type patchError struct {
+	err error
+}
+
+func (e patchError) Error() string {
+	return fmt.Sprintf("can not apply patch: %s", e.err)
+}
+
+func (rc *RemoteConfigHandler) PatchDataHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	var version int
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		var err error
+		version, err = strconv.Atoi(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`))
+		if err != nil || version <= 0 {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad If-Match: %s", ifMatch))
+			return
+		}
+	}
+
+	patch, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if contentType == "" || contentType == "application/json" {
+		if _, ok := jsonBody.([]interface{}); ok {
+			contentType = "application/json-patch+json"
+		} else {
+			contentType = "application/merge-patch+json"
+		}
+	}
+
+	var apply func(data []byte) ([]byte, error)
+	switch contentType {
+	case "application/json-patch+json":
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad json patch: %s", err))
+			return
+		}
+		apply = p.Apply
+	case "application/merge-patch+json":
+		apply = func(data []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(data, patch)
+		}
+	default:
+		util.WriteError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type %s", contentType))
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := rc.rcRepo.Patch(ctx, project.ID, namespace, version, func(remoteConfig *domain.RemoteConfig) error {
+		data, err := apply([]byte(remoteConfig.Data))
+		if err != nil {
+			return patchError{err}
+		}
+		remoteConfig.Data = string(data)
+		violations, err := validateSchema(ctx, rc.rcRepo, remoteConfig)
+		if err != nil {
+			return err
+		}
+		if len(violations) > 0 {
+			return schemaViolationsError(violations)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		switch e := err.(type) {
+		case schemaViolationsError:
+			util.WriteErrorDetails(w, http.StatusBadRequest, e.Error(), []util.JsonSchemaViolation(e))
+		case patchError:
+			if errors.Is(e.err, jsonpatch.ErrTestFailed) {
+				util.WriteError(w, http.StatusConflict, e.Error())
+			} else {
+				util.WriteError(w, http.StatusBadRequest, e.Error())
+			}
+		default:
+			if err == pgx.ErrNoRows {
+				util.WriteError(w, http.StatusNotFound, "project has no remote config")
+			} else if err == domain.ErrRemoteConfigVersionMismatch {
+				util.WriteError(w, http.StatusConflict, err.Error())
+			} else {
+				util.WriteInternalServerError(w)
+			}
+		}
+		return
+	}
+	rc.publish(r, project.ID, namespace)
+
+	util.WriteJson(w, remoteConfig)
+}
+
+func (rc *RemoteConfigHandler) GetVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		util.WriteError(w, http.StatusBadRequest, "bad limit")
+		return
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		util.WriteError(w, http.StatusBadRequest, "bad offset")
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	versions, err := rc.rcRepo.GetVersions(ctx, project.ID, namespace, limit, offset)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, versions)
+}
+
+func (rc *RemoteConfigHandler) GetVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, "bad version")
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	v, err := rc.rcRepo.GetVersion(ctx, project.ID, namespace, version)
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, fmt.Sprintf("version %d not found", version))
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+	util.WriteJson(w, v)
+}
+
+func (rc *RemoteConfigHandler) DiffHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, "bad from")
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	var to int
+	if query.Get("to") == "" {
+		ctx, cancel := util.GetContextWithTimeout(r.Context())
+		defer cancel()
+		remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID, namespace)
+		if err != nil {
+			log.Println(err)
+			if err == pgx.ErrNoRows {
+				util.WriteStatus(w, http.StatusNotFound)
+			} else {
+				util.WriteInternalServerError(w)
+			}
+			return
+		}
+		to = remoteConfig.Version
+	} else {
+		to, err = strconv.Atoi(query.Get("to"))
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, "bad to")
+			return
+		}
+	}
+
+	versions := make([]*domain.RemoteConfigVersion, 2)
+	for i, version := range []int{from, to} {
+		ctx, cancel := util.GetContextWithTimeout(r.Context())
+		defer cancel()
+		versions[i], err = rc.rcRepo.GetVersion(ctx, project.ID, namespace, version)
+		if err != nil {
+			log.Println(err)
+			if err == pgx.ErrNoRows {
+				util.WriteError(w, http.StatusNotFound, fmt.Sprintf("version %d not found", version))
+			} else {
+				util.WriteInternalServerError(w)
+			}
+			return
+		}
+	}
+
+	patch, err := util.CreateJsonPatch(versions[0].Data, versions[1].Data)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteJson(w, map[string]interface{}{
+		"from":  from,
+		"to":    to,
+		"patch": patch,
+	})
+}
+
+func (rc *RemoteConfigHandler) RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	version, ok := body["version"].(float64)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no version")
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	v, err := rc.rcRepo.GetVersion(ctx, project.ID, namespace, int(version))
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, fmt.Sprintf("version %d not found", int(version)))
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID, namespace)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	// a rollback is published as a new version so that caches and clients
+	// pick it up like any other update.
+	remoteConfig.Data = v.Data
+	remoteConfig.Rules = v.Rules
+	if !checkSchema(w, r, rc.rcRepo, remoteConfig) {
+		return
+	}
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = rc.rcRepo.Update(ctx, remoteConfig)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	rc.publish(r, remoteConfig.ProjectID, remoteConfig.Namespace)
+
+	util.WriteJson(w, remoteConfig)
+}
+
+func (rc *RemoteConfigHandler) GetRulesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID, namespace)
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteStatus(w, http.StatusNotFound)
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	if remoteConfig.Rules == nil {
+		util.WriteJson(w, &domain.RemoteConfigRules{
+			Conditions: []domain.RemoteConfigCondition{},
+			Parameters: map[string]map[string]json.RawMessage{},
+		})
+		return
+	}
+	util.WriteJson(w, json.RawMessage(*remoteConfig.Rules))
+}
+
+func (rc *RemoteConfigHandler) UpdateRulesHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	b, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	var rules domain.RemoteConfigRules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad rules: %s", err))
+		return
+	}
+	if err := rules.Compile(); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID, namespace)
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, "project has no remote config")
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	if rules.IsEmpty() {
+		remoteConfig.Rules = nil
+	} else {
+		compiled, err := json.Marshal(rules)
+		if err != nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+			return
+		}
+		c := string(compiled)
+		remoteConfig.Rules = &c
+	}
+	if !checkSchema(w, r, rc.rcRepo, remoteConfig) {
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = rc.rcRepo.Update(ctx, remoteConfig)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	rc.publish(r, remoteConfig.ProjectID, remoteConfig.Namespace)
+
+	util.WriteJson(w, remoteConfig)
+}
+
+func (rc *RemoteConfigHandler) GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	schema, err := rc.rcRepo.GetSchema(ctx, project.ID, namespace)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	if schema == nil {
+		util.WriteError(w, http.StatusNotFound, "project has no schema")
+		return
+	}
+	util.WriteJson(w, json.RawMessage(*schema))
+}
+
+func (rc *RemoteConfigHandler) UpdateSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	b, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	schema := string(b)
+	if _, err := util.CompileJsonSchema(schema); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad schema: %s", err))
+		return
+	}
+
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := rc.rcRepo.GetByProjectID(ctx, project.ID, namespace)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	if remoteConfig != nil {
+		documents, err := remoteConfigDocuments(remoteConfig)
+		if err != nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+			return
+		}
+		violations, err := util.ValidateJsonSchema(schema, documents...)
+		if err != nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+			return
+		}
+		if len(violations) > 0 {
+			util.WriteErrorDetails(w, http.StatusBadRequest, "current remote config does not match the schema", violations)
+			return
+		}
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = rc.rcRepo.UpdateSchema(ctx, project.ID, namespace, schema)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteOK(w)
+}
+
+func (rc *RemoteConfigHandler) DeleteSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, ok := getNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := rc.rcRepo.DeleteSchema(ctx, project.ID, namespace)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteOK(w)
+}
+
+// GetNamespacesHandler returns the remote config namespaces of the project.
+func (rc *RemoteConfigHandler) GetNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, rc.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	namespaces, err := rc.rcRepo.GetNamespaces(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, namespaces)
+}
+
+// getNamespace returns the remote config namespace of the request, which is
+// the default one for the routes without a {namespace} segment. On failure the
+// response is written and false is returned.
+func getNamespace(w http.ResponseWriter, r *http.Request) (string, bool) {
+	namespace, ok := mux.Vars(r)["namespace"]
+	if !ok {
+		return domain.RC_DEFAULT_NAMESPACE, true
+	}
+	if err := domain.ValidateNamespace(namespace); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad namespace %s", namespace))
+		return "", false
+	}
+	return namespace, true
+}
+
+// remoteConfigDocuments returns the remote config data followed by the data as
+// it looks with each conditional value and experiment variant applied.
+func remoteConfigDocuments(remoteConfig *domain.RemoteConfig) ([]string, error) {
+	documents := []string{remoteConfig.Data}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(remoteConfig.Data), &values); err != nil {
+		return documents, nil
+	}
+	type override struct {
+		key   string
+		value json.RawMessage
+	}
+	overrides := make([]override, 0)
+	if remoteConfig.Rules != nil {
+		var rules domain.RemoteConfigRules
+		if err := json.Unmarshal([]byte(*remoteConfig.Rules), &rules); err != nil {
+			return nil, err
+		}
+		for key, conditionalValues := range rules.Parameters {
+			for _, value := range conditionalValues {
+				overrides = append(overrides, override{key, value})
+			}
+		}
+	}
+	if remoteConfig.Experiments != nil {
+		var experiments []domain.Experiment
+		if err := json.Unmarshal([]byte(*remoteConfig.Experiments), &experiments); err != nil {
+			return nil, err
+		}
+		for _, e := range experiments {
+			for _, v := range e.Variants {
+				overrides = append(overrides, override{e.Parameter, v.Value})
+			}
+		}
+	}
+	for _, o := range overrides {
+		original, ok := values[o.key]
+		values[o.key] = o.value
+		b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, string(b))
+		if ok {
+			values[o.key] = original
+		} else {
+			delete(values, o.key)
+		}
+	}
+	return documents, nil
+}
+
+// validateSchema validates the remote config against the json schema of its
+// project and returns the violations found.
+func validateSchema(ctx context.Context, rcRepo domain.RemoteConfigRepository, remoteConfig *domain.RemoteConfig) ([]util.JsonSchemaViolation, error) {
+	schema, err := rcRepo.GetSchema(ctx, remoteConfig.ProjectID, remoteConfig.Namespace)
+	if err != nil || schema == nil {
+		return nil, err
+	}
+	documents, err := remoteConfigDocuments(remoteConfig)
+	if err != nil {
+		return nil, err
+	}
+	return util.ValidateJsonSchema(*schema, documents...)
+}
+
+// checkSchema validates the remote config against the json schema of its
+// project. On failure the response is written and false is returned.
+func checkSchema(w http.ResponseWriter, r *http.Request, rcRepo domain.RemoteConfigRepository, remoteConfig *domain.RemoteConfig) bool {
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	violations, err := validateSchema(ctx, rcRepo, remoteConfig)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return false
+	}
+	if len(violations) > 0 {
+		util.WriteErrorDetails(w, http.StatusBadRequest, "remote config does not match the schema", violations)
+		return false
+	}
+	return true
+}
+
 func NewRemoteConfigHandler(
 	r *mux.Router,
 	authMiddleware mux.MiddlewareFunc,
 	rcRepo domain.RemoteConfigRepository,
 	prRepo domain.ProjectRepository,
 	rcCache domain.RemoteConfigCache,
+	streamPubSub domain.StreamPubSub,
+	fcm *util.FCMClients,
 ) *RemoteConfigHandler {
 	rc := &RemoteConfigHandler{
-		rcCache: rcCache,
-		rcRepo:  rcRepo,
-		prRepo:  prRepo,
-		router:  r,
+		rcCache:      rcCache,
+		rcRepo:       rcRepo,
+		prRepo:       prRepo,
+		streamPubSub: streamPubSub,
+		fcm:          fcm,
+		router:       r,
 	}
 	rc.router.HandleFunc("/{id}/rc", rc.GetDataHandler).Methods("GET")
 
 	authRouter := rc.router.NewRoute().Subrouter()
-	authRouter.Use(authMiddleware, middleware.JsonBodyMiddleware)
-	authRouter.HandleFunc("/{id}/rc", rc.UpdateDataHandler).Methods("POST")
-	authRouter.HandleFunc("/{id}/rc/fcm/{topic}", rc.UpdateDataHandler).Methods("POST")
+	authRouter.Use(authMiddleware)
+	authRouter.HandleFunc("/{id}/rc/namespaces", rc.GetNamespacesHandler).Methods("GET")
+
+	jsonRouter := authRouter.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+
+	// the default namespace is managed under /{id}/rc and the other ones under
+	// /{id}/rc/{namespace}. routes of the default namespace come first so that
+	// their paths are never taken for a namespace.
+	for _, prefix := range []string{"/{id}/rc", "/{id}/rc/{namespace:[a-z0-9_-]+}"} {
+		authRouter.HandleFunc(prefix+"/versions", rc.GetVersionsHandler).Methods("GET")
+		authRouter.HandleFunc(prefix+"/versions/{version:[0-9]+}", rc.GetVersionHandler).Methods("GET")
+		authRouter.HandleFunc(prefix+"/diff", rc.DiffHandler).Methods("GET")
+		authRouter.HandleFunc(prefix+"/rules", rc.GetRulesHandler).Methods("GET")
+		authRouter.HandleFunc(prefix+"/schema", rc.GetSchemaHandler).Methods("GET")
+		authRouter.HandleFunc(prefix+"/schema/delete", rc.DeleteSchemaHandler).Methods("POST")
+
+		jsonRouter.HandleFunc(prefix, rc.UpdateDataHandler).Methods("POST")
+		jsonRouter.HandleFunc(prefix, rc.PatchDataHandler).Methods("PATCH")
+		jsonRouter.HandleFunc(prefix+"/fcm/{topic}", rc.UpdateDataHandler).Methods("POST")
+		jsonRouter.HandleFunc(prefix+"/rollback", rc.RollbackHandler).Methods("POST")
+		jsonRouter.HandleFunc(prefix+"/rules", rc.UpdateRulesHandler).Methods("POST")
+		jsonRouter.HandleFunc(prefix+"/schema", rc.UpdateSchemaHandler).Methods("POST")
+	}
+
+	// registered last since it matches every path under /{id}/rc
+	rc.router.HandleFunc("/{id}/rc/{namespace:[a-z0-9_-]+}", rc.GetDataHandler).Methods("GET")
 
 	return rc
 }
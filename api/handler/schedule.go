@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type RemoteConfigScheduleHandler struct {
+	scRepo domain.RemoteConfigScheduleRepository
+	rcRepo domain.RemoteConfigRepository
+	prRepo domain.ProjectRepository
+	router *mux.Router
+}
+
+func (s *RemoteConfigScheduleHandler) GetSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	schedules, err := s.scRepo.GetByPID(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, schedules)
+}
+
+func (s *RemoteConfigScheduleHandler) NewScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	if body["data"] == nil {
+		util.WriteError(w, http.StatusBadRequest, "no data")
+		return
+	}
+	data, err := json.Marshal(body["data"])
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	var rules []byte
+	if body["rules"] != nil {
+		b, err := json.Marshal(body["rules"])
+		if err != nil {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+			return
+		}
+		var rr domain.RemoteConfigRules
+		if err := json.Unmarshal(b, &rr); err != nil {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad rules: %s", err))
+			return
+		}
+		if err := rr.Compile(); err != nil {
+			util.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !rr.IsEmpty() {
+			rules, err = json.Marshal(rr)
+			if err != nil {
+				log.Println(err)
+				util.WriteInternalServerError(w)
+				return
+			}
+		}
+	}
+
+	namespace, _ := body["namespace"].(string)
+	if namespace == "" {
+		namespace = domain.RC_DEFAULT_NAMESPACE
+	} else if err := domain.ValidateNamespace(namespace); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad namespace %s", namespace))
+		return
+	}
+
+	pt, _ := body["publish_time"].(string)
+	if pt == "" {
+		util.WriteError(w, http.StatusBadRequest, "no publish_time")
+		return
+	}
+	publishTime, err := time.Parse(time.RFC3339, pt)
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad publish_time: %s", pt))
+		return
+	}
+	if !publishTime.After(time.Now()) {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("publish_time: %s must be in the future", pt))
+		return
+	}
+
+	var revertTime *time.Time
+	if rt, _ := body["revert_time"].(string); rt != "" {
+		t, err := time.Parse(time.RFC3339, rt)
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad revert_time: %s", rt))
+			return
+		}
+		if !t.After(publishTime) {
+			util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("revert_time (%s) must be after publish_time (%s)", rt, pt))
+			return
+		}
+		revertTime = &t
+	}
+
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	remoteConfig, err := s.rcRepo.GetByProjectID(ctx, project.ID, namespace)
+	if err != nil {
+		log.Println(err)
+		if err == pgx.ErrNoRows {
+			util.WriteError(w, http.StatusNotFound, fmt.Sprintf("project has no remote config in namespace %s", namespace))
+		} else {
+			util.WriteInternalServerError(w)
+		}
+		return
+	}
+
+	remoteConfig.Data = string(data)
+	if rules != nil {
+		rr := string(rules)
+		remoteConfig.Rules = &rr
+	}
+	if !checkSchema(w, r, s.rcRepo, remoteConfig) {
+		return
+	}
+
+	schedule := &domain.RemoteConfigSchedule{
+		PID:         project.ID,
+		Namespace:   namespace,
+		Data:        data,
+		Rules:       rules,
+		Status:      domain.RC_SCHEDULE_STATUS_SCHEDULED,
+		PublishTime: &publishTime,
+		RevertTime:  revertTime,
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = s.scRepo.Insert(ctx, schedule)
+	if err != nil {
+		log.Println(err)
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	util.WriteJson(w, schedule)
+}
+
+// CancelScheduleHandler cancels a schedule that is not published yet, or the
+// pending revert of a published one.
+func (s *RemoteConfigScheduleHandler) CancelScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	id, ok := body["id"].(float64)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	schedule, err := s.scRepo.GetByID(ctx, int(id))
+	if err != nil || schedule.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "schedule not found")
+		}
+		return
+	}
+
+	switch schedule.Status {
+	case domain.RC_SCHEDULE_STATUS_SCHEDULED:
+		schedule.Status = domain.RC_SCHEDULE_STATUS_CANCELED
+	case domain.RC_SCHEDULE_STATUS_PUBLISHED:
+		schedule.Status = domain.RC_SCHEDULE_STATUS_FINISHED
+		schedule.RevertTime = nil
+	default:
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("schedule status must be scheduled or published. status: %d", schedule.Status))
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = s.scRepo.Update(ctx, schedule)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteJson(w, schedule)
+}
+
+func NewRemoteConfigScheduleHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	scRepo domain.RemoteConfigScheduleRepository,
+	rcRepo domain.RemoteConfigRepository,
+	prRepo domain.ProjectRepository,
+) *RemoteConfigScheduleHandler {
+	s := &RemoteConfigScheduleHandler{
+		scRepo: scRepo,
+		rcRepo: rcRepo,
+		prRepo: prRepo,
+		router: r.NewRoute().Subrouter(),
+	}
+
+	s.router.Use(authMiddleware)
+	s.router.HandleFunc("/{id}/rc/schedules", s.GetSchedulesHandler).Methods("GET")
+
+	jsonRouter := s.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/rc/schedules/new", s.NewScheduleHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/rc/schedules/cancel", s.CancelScheduleHandler).Methods("POST")
+
+	return s
+}
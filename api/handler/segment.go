@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type SegmentHandler struct {
+	sgRepo domain.SegmentRepository
+	prRepo domain.ProjectRepository
+	router *mux.Router
+}
+
+// getSegmentBody reads a segment from the request body and validates it. On
+// failure the response is written and false is returned.
+func getSegmentBody(w http.ResponseWriter, r *http.Request) (*domain.Segment, bool) {
+	jsonBody := r.Context().Value("json")
+
+	b, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return nil, false
+	}
+	segment := &domain.Segment{}
+	if err := json.Unmarshal(b, segment); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad segment: %s", err))
+		return nil, false
+	}
+	if segment.Name == "" {
+		util.WriteError(w, http.StatusBadRequest, "no name")
+		return nil, false
+	}
+	segment.Condition.Name = segment.Name
+	if segment.Condition.Seed == "" {
+		// keep the percent buckets of the devices if the segment is renamed
+		segment.Condition.Seed = segment.Name
+	}
+	if err := segment.Condition.Compile(); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return segment, true
+}
+
+// getProjectSegment loads the segment with the given id and makes sure it
+// belongs to the project. On failure the response is written and false is
+// returned.
+func (s *SegmentHandler) getProjectSegment(w http.ResponseWriter, r *http.Request, project *domain.Project, id int) (*domain.Segment, bool) {
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	segment, err := s.sgRepo.GetByID(ctx, id)
+	if err != nil || segment.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, "segment not found")
+		}
+		return nil, false
+	}
+	return segment, true
+}
+
+func (s *SegmentHandler) GetSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	segments, err := s.sgRepo.GetByPID(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, segments)
+}
+
+func (s *SegmentHandler) NewSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	segment, ok := getSegmentBody(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	segment.ID = 0
+	segment.PID = project.ID
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := s.sgRepo.Insert(ctx, segment)
+	if err != nil {
+		log.Println(err)
+		if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
+			util.WriteError(w, http.StatusConflict, fmt.Sprintf("segment %s already exists", segment.Name))
+		} else {
+			util.WriteStatus(w, http.StatusBadRequest)
+		}
+		return
+	}
+
+	util.WriteJson(w, segment)
+}
+
+func (s *SegmentHandler) UpdateSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	update, ok := getSegmentBody(w, r)
+	if !ok {
+		return
+	}
+	if update.ID == 0 {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	segment, ok := s.getProjectSegment(w, r, project, update.ID)
+	if !ok {
+		return
+	}
+
+	segment.Name = update.Name
+	segment.Condition = update.Condition
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := s.sgRepo.Update(ctx, segment)
+	if err != nil {
+		log.Println(err)
+		if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
+			util.WriteError(w, http.StatusConflict, fmt.Sprintf("segment %s already exists", segment.Name))
+		} else {
+			util.WriteStatus(w, http.StatusBadRequest)
+		}
+		return
+	}
+
+	util.WriteJson(w, segment)
+}
+
+func (s *SegmentHandler) DeleteSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	id, ok := body["id"].(float64)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, s.prRepo)
+	if !ok {
+		return
+	}
+
+	segment, ok := s.getProjectSegment(w, r, project, int(id))
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	inUse, err := s.sgRepo.InUse(ctx, segment.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	if inUse {
+		util.WriteError(w, http.StatusConflict, "segment is used by active or scheduled notifications")
+		return
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err = s.sgRepo.Delete(ctx, segment)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteOK(w)
+}
+
+func NewSegmentHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	sgRepo domain.SegmentRepository,
+	prRepo domain.ProjectRepository,
+) *SegmentHandler {
+	s := &SegmentHandler{
+		sgRepo: sgRepo,
+		prRepo: prRepo,
+		router: r.NewRoute().Subrouter(),
+	}
+
+	s.router.Use(authMiddleware)
+	s.router.HandleFunc("/{id}/segments", s.GetSegmentsHandler).Methods("GET")
+
+	jsonRouter := s.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/segments/new", s.NewSegmentHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/segments/update", s.UpdateSegmentHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/segments/delete", s.DeleteSegmentHandler).Methods("POST")
+
+	return s
+}
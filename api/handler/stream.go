@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	STREAM_HEARTBEAT_INTERVAL = 30 * time.Second
+	STREAM_RETRY              = 5 * time.Second
+)
+
+type StreamHandler struct {
+	pubsub domain.StreamPubSub
+	router *mux.Router
+}
+
+// StreamHandler sends the events of a project as server-sent events. Events
+// that happened before the client connected are not replayed, so clients
+// should fetch the remote config and notifications once they are connected.
+func (s *StreamHandler) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	pid := mux.Vars(r)["id"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("streaming is not supported")
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	events, unsubscribe, err := s.pubsub.Subscribe(r.Context(), pid)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// tell nginx not to buffer the response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", STREAM_RETRY.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(STREAM_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		}
+		flusher.Flush()
+	}
+}
+
+func NewStreamHandler(r *mux.Router, pubsub domain.StreamPubSub) *StreamHandler {
+	s := &StreamHandler{
+		pubsub: pubsub,
+		router: r,
+	}
+	s.router.HandleFunc("/{id}/stream", s.StreamHandler).Methods("GET")
+	return s
+}
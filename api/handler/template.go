@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/doorbash/backend-services/api/util/middleware"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+type NotificationTemplateHandler struct {
+	tpRepo domain.NotificationTemplateRepository
+	prRepo domain.ProjectRepository
+	router *mux.Router
+}
+
+// getTemplateBody reads a template from the request body and validates it. On
+// failure the response is written and false is returned.
+func getTemplateBody(w http.ResponseWriter, r *http.Request) (*domain.NotificationTemplate, bool) {
+	jsonBody := r.Context().Value("json")
+
+	b, err := json.Marshal(jsonBody)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return nil, false
+	}
+	template := &domain.NotificationTemplate{}
+	if err := json.Unmarshal(b, template); err != nil {
+		util.WriteError(w, http.StatusBadRequest, fmt.Sprintf("bad template: %s", err))
+		return nil, false
+	}
+	if err := template.Compile(); err != nil {
+		util.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return template, true
+}
+
+// getProjectTemplate loads the template with the given id and makes sure it
+// belongs to the project. On failure the response is written and false is
+// returned.
+func getProjectTemplate(
+	w http.ResponseWriter,
+	r *http.Request,
+	tpRepo domain.NotificationTemplateRepository,
+	project *domain.Project,
+	id int,
+) (*domain.NotificationTemplate, bool) {
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	template, err := tpRepo.GetByID(ctx, id)
+	if err != nil || template.PID != project.ID {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println(err)
+			util.WriteInternalServerError(w)
+		} else {
+			util.WriteError(w, http.StatusNotFound, fmt.Sprintf("template %d not found", id))
+		}
+		return nil, false
+	}
+	return template, true
+}
+
+func (t *NotificationTemplateHandler) GetTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	project, ok := getUserProject(w, r, t.prRepo)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	templates, err := t.tpRepo.GetByPID(ctx, project.ID)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+	util.WriteJson(w, templates)
+}
+
+func (t *NotificationTemplateHandler) NewTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	template, ok := getTemplateBody(w, r)
+	if !ok {
+		return
+	}
+
+	project, ok := getUserProject(w, r, t.prRepo)
+	if !ok {
+		return
+	}
+
+	template.ID = 0
+	template.PID = project.ID
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := t.tpRepo.Insert(ctx, template)
+	if err != nil {
+		log.Println(err)
+		if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
+			util.WriteError(w, http.StatusConflict, fmt.Sprintf("template %s already exists", template.Name))
+		} else {
+			util.WriteStatus(w, http.StatusBadRequest)
+		}
+		return
+	}
+
+	util.WriteJson(w, template)
+}
+
+// UpdateTemplateHandler changes a template. Notifications that were already
+// made from it keep the text they were created with.
+func (t *NotificationTemplateHandler) UpdateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	update, ok := getTemplateBody(w, r)
+	if !ok {
+		return
+	}
+	if update.ID == 0 {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, t.prRepo)
+	if !ok {
+		return
+	}
+
+	template, ok := getProjectTemplate(w, r, t.tpRepo, project, update.ID)
+	if !ok {
+		return
+	}
+
+	template.Name = update.Name
+	template.DefaultLocale = update.DefaultLocale
+	template.Variants = update.Variants
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := t.tpRepo.Update(ctx, template)
+	if err != nil {
+		log.Println(err)
+		if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
+			util.WriteError(w, http.StatusConflict, fmt.Sprintf("template %s already exists", template.Name))
+		} else {
+			util.WriteStatus(w, http.StatusBadRequest)
+		}
+		return
+	}
+
+	util.WriteJson(w, template)
+}
+
+func (t *NotificationTemplateHandler) DeleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBody := r.Context().Value("json")
+
+	body, ok := jsonBody.(map[string]interface{})
+	if !ok {
+		util.WriteStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	id, ok := body["id"].(float64)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest, "no id")
+		return
+	}
+
+	project, ok := getUserProject(w, r, t.prRepo)
+	if !ok {
+		return
+	}
+
+	template, ok := getProjectTemplate(w, r, t.tpRepo, project, int(id))
+	if !ok {
+		return
+	}
+
+	ctx, cancel := util.GetContextWithTimeout(r.Context())
+	defer cancel()
+	err := t.tpRepo.Delete(ctx, template)
+	if err != nil {
+		log.Println(err)
+		util.WriteInternalServerError(w)
+		return
+	}
+
+	util.WriteOK(w)
+}
+
+func NewNotificationTemplateHandler(
+	r *mux.Router,
+	authMiddleware mux.MiddlewareFunc,
+	tpRepo domain.NotificationTemplateRepository,
+	prRepo domain.ProjectRepository,
+) *NotificationTemplateHandler {
+	t := &NotificationTemplateHandler{
+		tpRepo: tpRepo,
+		prRepo: prRepo,
+		router: r.NewRoute().Subrouter(),
+	}
+
+	t.router.Use(authMiddleware)
+	t.router.HandleFunc("/{id}/notifications/templates", t.GetTemplatesHandler).Methods("GET")
+
+	jsonRouter := t.router.NewRoute().Subrouter()
+	jsonRouter.Use(middleware.JsonBodyMiddleware)
+	jsonRouter.HandleFunc("/{id}/notifications/templates/new", t.NewTemplateHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/notifications/templates/update", t.UpdateTemplateHandler).Methods("POST")
+	jsonRouter.HandleFunc("/{id}/notifications/templates/delete", t.DeleteTemplateHandler).Methods("POST")
+
+	return t
+}
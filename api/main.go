@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"os"
 	"time"
+	// the images have no zoneinfo for the timezones of recurring notifications
+	_ "time/tzdata"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4"
@@ -49,7 +51,15 @@ func initDatabase() *pgxpool.Pool {
 	queries = append(queries, _pg.CreateUsers()...)
 	queries = append(queries, _pg.CreateProjects()...)
 	queries = append(queries, _pg.CreateRemoteConfigs()...)
+	queries = append(queries, _pg.CreateExperiments()...)
+	queries = append(queries, _pg.CreateRemoteConfigSchedules()...)
+	queries = append(queries, _pg.CreateSegments()...)
+	queries = append(queries, _pg.CreateDevices()...)
+	queries = append(queries, _pg.CreateEvents()...)
+	queries = append(queries, _pg.CreatePushCredentials()...)
+	queries = append(queries, _pg.CreateNotificationTemplates()...)
 	queries = append(queries, _pg.CreateNotifications()...)
+	queries = append(queries, _pg.CreateInAppMessages()...)
 
 	for _, q := range queries {
 		ctx, cancel = util.GetContextWithTimeout(context.Background())
@@ -71,12 +81,34 @@ func main() {
 	rcRepo := _pg.NewRemoteConfigPostgresRepository(pool)
 	projectRepo := _pg.NewProjectPostgresRepository(pool)
 	noRepo := _pg.NewNotificationPostgresRepository(pool)
+	exRepo := _pg.NewExperimentPostgresRepository(pool)
+	scRepo := _pg.NewRemoteConfigSchedulePostgresRepository(pool)
+	sgRepo := _pg.NewSegmentPostgresRepository(pool)
+	dvRepo := _pg.NewDevicePostgresRepository(pool)
+	evRepo := _pg.NewEventPostgresRepository(pool)
+	tpRepo := _pg.NewNotificationTemplatePostgresRepository(pool)
+	msRepo := _pg.NewInAppMessagePostgresRepository(pool)
+
+	credentialsKey, err := util.ParseEncryptionKey(os.Getenv("PUSH_CREDENTIALS_KEY"))
+	if err != nil {
+		log.Println("push credentials can not be stored:", err)
+	}
+	crRepo := _pg.NewPushCredentialPostgresRepository(pool, credentialsKey)
+	fcm := util.NewFCMClients(crRepo)
+	pushSenders := util.NewPushSenders(
+		fcm,
+		util.NewAPNsSenders(crRepo, os.Getenv("APNS_HOST")),
+		util.NewWebPushSenders(crRepo),
+	)
 
 	authCache := _redis.NewAuthRedisCache(6 * time.Hour)
 	rcCache := _redis.NewRemoteConfigRedisCache(24 * time.Hour)
 	noCache := _redis.NewNotificationRedisCache()
+	msCache := _redis.NewInAppMessageRedisCache()
+	streamPubSub := _redis.NewStreamRedisPubSub()
+	evQueue := _redis.NewEventRedisQueue()
 
-	if err := cache.InitCacheScripts(rcCache, noCache); err != nil {
+	if err := cache.InitCacheScripts(rcCache, noCache, msCache, evQueue); err != nil {
 		log.Fatalln(err)
 	}
 
@@ -102,19 +134,96 @@ func main() {
 		userRepo,
 	)
 
+	handler.NewExperimentHandler(
+		r,
+		authHandler.Middleware,
+		exRepo,
+		rcRepo,
+		projectRepo,
+		rcCache,
+		streamPubSub,
+	)
+
+	handler.NewRemoteConfigScheduleHandler(
+		r,
+		authHandler.Middleware,
+		scRepo,
+		rcRepo,
+		projectRepo,
+	)
+
+	// the remote config handler comes after the handlers of the other /{id}/rc
+	// routes since it serves namespaces under /{id}/rc/{namespace}
 	handler.NewRemoteConfigHandler(
 		r,
 		authHandler.Middleware,
 		rcRepo,
 		projectRepo,
 		rcCache,
+		streamPubSub,
+		fcm,
 	)
 
 	handler.NewNotificationHandler(
 		r,
 		authHandler.Middleware,
 		noRepo, projectRepo,
+		sgRepo,
+		tpRepo,
+		dvRepo,
 		noCache,
+		pushSenders,
+	)
+
+	handler.NewInAppMessageHandler(
+		r,
+		authHandler.Middleware,
+		msRepo,
+		projectRepo,
+		sgRepo,
+		msCache,
+	)
+
+	handler.NewNotificationTemplateHandler(
+		r,
+		authHandler.Middleware,
+		tpRepo,
+		projectRepo,
+	)
+
+	handler.NewSegmentHandler(
+		r,
+		authHandler.Middleware,
+		sgRepo,
+		projectRepo,
+	)
+
+	handler.NewDeviceHandler(
+		r,
+		authHandler.Middleware,
+		dvRepo,
+		projectRepo,
+	)
+
+	handler.NewEventHandler(
+		r,
+		authHandler.Middleware,
+		evQueue,
+		evRepo,
+		projectRepo,
+	)
+
+	handler.NewPushCredentialHandler(
+		r,
+		authHandler.Middleware,
+		crRepo,
+		projectRepo,
+		pushSenders,
+	)
+
+	handler.NewStreamHandler(
+		r,
+		streamPubSub,
 	)
 
 	handler.NewProjectHandler(
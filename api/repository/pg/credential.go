@@ -0,0 +1,108 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/doorbash/backend-services/api/util"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PushCredentialPostgresRepository keeps the data of the credentials
+// encrypted with the key it is created with.
+type PushCredentialPostgresRepository struct {
+	pool *pgxpool.Pool
+	key  []byte
+}
+
+func CreatePushCredentials() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS push_credentials
+(
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	provider VARCHAR(20) NOT NULL,
+	data BYTEA NOT NULL,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (pid, provider)
+);`,
+	}
+}
+
+func (c *PushCredentialPostgresRepository) GetByPID(ctx context.Context, pid string) ([]domain.PushCredential, error) {
+	rows, err := c.pool.Query(ctx, "SELECT pid, provider, create_time, update_time FROM push_credentials WHERE pid = $1 ORDER BY provider ASC", pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.PushCredential, 0)
+	for rows.Next() {
+		credential := domain.PushCredential{}
+		if err := rows.Scan(&credential.PID, &credential.Provider, &credential.CreateTime, &credential.UpdateTime); err != nil {
+			return nil, err
+		}
+		ret = append(ret, credential)
+	}
+	return ret, rows.Err()
+}
+
+func (c *PushCredentialPostgresRepository) Get(ctx context.Context, pid string, provider string) (*domain.PushCredential, error) {
+	row := c.pool.QueryRow(ctx, "SELECT pid, provider, data, create_time, update_time FROM push_credentials WHERE pid = $1 AND provider = $2", pid, provider)
+	credential := domain.PushCredential{}
+	var data []byte
+	if err := row.Scan(&credential.PID, &credential.Provider, &data, &credential.CreateTime, &credential.UpdateTime); err != nil {
+		return nil, err
+	}
+	var err error
+	credential.Data, err = util.Decrypt(c.key, data)
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (c *PushCredentialPostgresRepository) GetUpdateTime(ctx context.Context, pid string, provider string) (*time.Time, error) {
+	var ret time.Time
+	err := c.pool.QueryRow(ctx, "SELECT update_time FROM push_credentials WHERE pid = $1 AND provider = $2", pid, provider).Scan(&ret)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (c *PushCredentialPostgresRepository) Upsert(ctx context.Context, credential *domain.PushCredential) error {
+	data, err := util.Encrypt(c.key, credential.Data)
+	if err != nil {
+		return err
+	}
+	row := c.pool.QueryRow(
+		ctx,
+		`INSERT INTO push_credentials (pid, provider, data) VALUES ($1, $2, $3)
+ON CONFLICT (pid, provider) DO UPDATE SET data = $3, update_time = CURRENT_TIMESTAMP
+RETURNING create_time, update_time`,
+		credential.PID,
+		credential.Provider,
+		data,
+	)
+	return row.Scan(&credential.CreateTime, &credential.UpdateTime)
+}
+
+func (c *PushCredentialPostgresRepository) Delete(ctx context.Context, pid string, provider string) error {
+	cmd, err := c.pool.Exec(ctx, "DELETE FROM push_credentials WHERE pid = $1 AND provider = $2", pid, provider)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func NewPushCredentialPostgresRepository(pool *pgxpool.Pool, key []byte) *PushCredentialPostgresRepository {
+	return &PushCredentialPostgresRepository{
+		pool: pool,
+		key:  key,
+	}
+}
@@ -0,0 +1,152 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type DevicePostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateDevices() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS devices
+(
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	install_id VARCHAR(100) NOT NULL,
+	app_version INTEGER NOT NULL DEFAULT 0,
+	os_version VARCHAR(50) NOT NULL DEFAULT '',
+	locale VARCHAR(20) NOT NULL DEFAULT '',
+	fcm_token TEXT,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	last_seen TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (pid, install_id)
+);`,
+		"CREATE INDEX IF NOT EXISTS devices_last_seen_idx ON devices (pid, last_seen);",
+		"ALTER TABLE devices ADD COLUMN IF NOT EXISTS apns_token TEXT;",
+		"ALTER TABLE devices ADD COLUMN IF NOT EXISTS web_push_subscription TEXT;",
+	}
+}
+
+// pushTokenColumns are the columns of the devices table that hold the token of
+// each push provider.
+var pushTokenColumns = map[string]string{
+	domain.PUSH_PROVIDER_FCM:     "fcm_token",
+	domain.PUSH_PROVIDER_APNS:    "apns_token",
+	domain.PUSH_PROVIDER_WEBPUSH: "web_push_subscription",
+}
+
+func (d *DevicePostgresRepository) GetByInstallID(ctx context.Context, pid string, installID string) (*domain.Device, error) {
+	row := d.pool.QueryRow(
+		ctx,
+		"SELECT pid, install_id, app_version, os_version, locale, fcm_token, apns_token, web_push_subscription, create_time, last_seen FROM devices WHERE pid = $1 AND install_id = $2",
+		pid,
+		installID,
+	)
+	device := domain.Device{}
+	if err := row.Scan(
+		&device.PID,
+		&device.InstallID,
+		&device.AppVersion,
+		&device.OSVersion,
+		&device.Locale,
+		&device.FCMToken,
+		&device.APNsToken,
+		&device.WebPushSubscription,
+		&device.CreateTime,
+		&device.LastSeen,
+	); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (d *DevicePostgresRepository) Register(ctx context.Context, device *domain.Device) error {
+	row := d.pool.QueryRow(
+		ctx,
+		`INSERT INTO devices (pid, install_id, app_version, os_version, locale, fcm_token, apns_token, web_push_subscription) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (pid, install_id) DO UPDATE SET app_version = $3, os_version = $4, locale = $5, fcm_token = COALESCE($6, devices.fcm_token), apns_token = COALESCE($7, devices.apns_token), web_push_subscription = COALESCE($8, devices.web_push_subscription), last_seen = CURRENT_TIMESTAMP
+RETURNING create_time, last_seen`,
+		device.PID,
+		device.InstallID,
+		device.AppVersion,
+		device.OSVersion,
+		device.Locale,
+		device.FCMToken,
+		device.APNsToken,
+		device.WebPushSubscription,
+	)
+	return row.Scan(&device.CreateTime, &device.LastSeen)
+}
+
+func (d *DevicePostgresRepository) GetStats(ctx context.Context, pid string) (*domain.DeviceStats, error) {
+	row := d.pool.QueryRow(
+		ctx,
+		`SELECT
+COUNT(*),
+COUNT(*) FILTER (WHERE last_seen > CURRENT_TIMESTAMP - INTERVAL '1 day'),
+COUNT(*) FILTER (WHERE last_seen > CURRENT_TIMESTAMP - INTERVAL '7 days'),
+COUNT(*) FILTER (WHERE last_seen > CURRENT_TIMESTAMP - INTERVAL '30 days'),
+COUNT(fcm_token),
+COUNT(apns_token),
+COUNT(web_push_subscription)
+FROM devices WHERE pid = $1`,
+		pid,
+	)
+	stats := domain.DeviceStats{}
+	if err := row.Scan(
+		&stats.Installs,
+		&stats.Active1d,
+		&stats.Active7d,
+		&stats.Active30d,
+		&stats.WithFCMToken,
+		&stats.WithAPNsToken,
+		&stats.WithWebPush,
+	); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (d *DevicePostgresRepository) GetPushTokens(ctx context.Context, pid string, provider string) ([]string, error) {
+	column, ok := pushTokenColumns[provider]
+	if !ok {
+		return nil, fmt.Errorf("bad provider %s", provider)
+	}
+	rows, err := d.pool.Query(ctx, fmt.Sprintf("SELECT %s FROM devices WHERE pid = $1 AND %s IS NOT NULL", column, column), pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]string, 0)
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		ret = append(ret, token)
+	}
+	return ret, rows.Err()
+}
+
+func (d *DevicePostgresRepository) DeletePushTokens(ctx context.Context, pid string, provider string, tokens []string) (int64, error) {
+	column, ok := pushTokenColumns[provider]
+	if !ok {
+		return 0, fmt.Errorf("bad provider %s", provider)
+	}
+	cmd, err := d.pool.Exec(ctx, fmt.Sprintf("UPDATE devices SET %s = NULL WHERE pid = $1 AND %s = ANY($2)", column, column), pid, tokens)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
+
+func NewDevicePostgresRepository(pool *pgxpool.Pool) *DevicePostgresRepository {
+	return &DevicePostgresRepository{
+		pool: pool,
+	}
+}
@@ -0,0 +1,179 @@
+package pg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type EventPostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateEvents() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS events
+(
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	type VARCHAR(50) NOT NULL,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	device_id VARCHAR(100),
+	app_version INTEGER NOT NULL DEFAULT 0,
+	nid INTEGER,
+	namespace VARCHAR(50),
+	version INTEGER,
+	properties JSON
+);`,
+		"CREATE INDEX IF NOT EXISTS events_pid_time_idx ON events (pid, time);",
+		"CREATE INDEX IF NOT EXISTS events_nid_idx ON events (nid) WHERE nid IS NOT NULL;",
+	}
+}
+
+const insertEventQuery = `INSERT INTO events (pid, type, time, device_id, app_version, nid, namespace, version, properties)
+SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9 WHERE EXISTS (SELECT 1 FROM projects WHERE id = $1)`
+
+// insertEventArgs returns the arguments of insertEventQuery for the event.
+func insertEventArgs(event *domain.Event) ([]interface{}, error) {
+	var deviceID *string
+	if event.DeviceID != "" {
+		deviceID = &event.DeviceID
+	}
+	var namespace *string
+	if event.Namespace != "" {
+		namespace = &event.Namespace
+	}
+	var properties *string
+	if len(event.Properties) > 0 {
+		b, err := json.Marshal(event.Properties)
+		if err != nil {
+			return nil, err
+		}
+		p := string(b)
+		properties = &p
+	}
+	return []interface{}{
+		event.PID,
+		event.Type,
+		event.Time,
+		deviceID,
+		event.AppVersion,
+		event.NotificationID,
+		namespace,
+		event.Version,
+		properties,
+	}, nil
+}
+
+// isDataError reports whether the database rejected a statement for its
+// values, e.g. a string too long for its column, which a retry can not fix.
+func isDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+func (e *EventPostgresRepository) InsertBatch(ctx context.Context, events []domain.Event) (int, error) {
+	err := e.insertAll(ctx, events)
+	if !isDataError(err) {
+		return 0, err
+	}
+	return e.insertEach(ctx, events)
+}
+
+// insertAll stores the events in one batch, or none of them if any fails.
+func (e *EventPostgresRepository) insertAll(ctx context.Context, events []domain.Event) error {
+	batch := &pgx.Batch{}
+	for i := range events {
+		args, err := insertEventArgs(&events[i])
+		if err != nil {
+			return err
+		}
+		batch.Queue(insertEventQuery, args...)
+	}
+	br := e.pool.SendBatch(ctx, batch)
+	for range events {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	return br.Close()
+}
+
+// insertEach stores each event in a savepoint of its own so that the events
+// the database rejects for their values do not keep the others from being
+// stored. It returns the number of the rejected events.
+func (e *EventPostgresRepository) insertEach(ctx context.Context, events []domain.Event) (int, error) {
+	tx, err := e.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	dropped := 0
+	for i := range events {
+		args, err := insertEventArgs(&events[i])
+		if err != nil {
+			return 0, err
+		}
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := sp.Exec(ctx, insertEventQuery, args...); err != nil {
+			sp.Rollback(ctx)
+			if !isDataError(err) {
+				return 0, err
+			}
+			dropped++
+			continue
+		}
+		if err := sp.Commit(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return dropped, tx.Commit(ctx)
+}
+
+func (e *EventPostgresRepository) GetCounts(ctx context.Context, pid string, nid *int, from time.Time, to time.Time) ([]domain.EventCount, error) {
+	rows, err := e.pool.Query(
+		ctx,
+		`SELECT type, COUNT(*), COUNT(DISTINCT device_id)
+FROM events
+WHERE pid = $1 AND ($2::INTEGER IS NULL OR nid = $2) AND time >= $3 AND time < $4
+GROUP BY type
+ORDER BY type ASC`,
+		pid,
+		nid,
+		from,
+		to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.EventCount, 0)
+	for rows.Next() {
+		count := domain.EventCount{}
+		if err := rows.Scan(&count.Type, &count.Count, &count.Devices); err != nil {
+			return nil, err
+		}
+		ret = append(ret, count)
+	}
+	return ret, rows.Err()
+}
+
+func NewEventPostgresRepository(pool *pgxpool.Pool) *EventPostgresRepository {
+	return &EventPostgresRepository{
+		pool: pool,
+	}
+}
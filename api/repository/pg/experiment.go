@@ -0,0 +1,191 @@
+package pg
+
+import (
+	"context"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type ExperimentPostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateExperiments() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS experiments
+(
+	id SERIAL NOT NULL PRIMARY KEY,
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	name VARCHAR(100) NOT NULL,
+	parameter VARCHAR(100) NOT NULL,
+	status SMALLINT NOT NULL DEFAULT 1 CHECK (status IN (1, 2)),
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	stop_time TIMESTAMP WITH TIME ZONE
+);`,
+		`CREATE TABLE IF NOT EXISTS experiment_variants
+(
+	eid INTEGER NOT NULL REFERENCES experiments(id) ON DELETE CASCADE,
+	name VARCHAR(50) NOT NULL,
+	weight INTEGER NOT NULL CHECK (weight > 0),
+	value JSON NOT NULL,
+	exposures_count BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (eid, name)
+);`,
+		`ALTER TABLE experiments ADD COLUMN IF NOT EXISTS namespace VARCHAR(50) NOT NULL DEFAULT 'default';`,
+	}
+}
+
+func (e *ExperimentPostgresRepository) getVariants(ctx context.Context, experiment *domain.Experiment) error {
+	rows, err := e.pool.Query(ctx, "SELECT name, weight, value, exposures_count FROM experiment_variants WHERE eid = $1 ORDER BY name ASC", experiment.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	experiment.Variants = make([]domain.ExperimentVariant, 0)
+	for rows.Next() {
+		variant := domain.ExperimentVariant{}
+		var value string
+		err := rows.Scan(
+			&variant.Name,
+			&variant.Weight,
+			&value,
+			&variant.Exposures,
+		)
+		if err != nil {
+			return err
+		}
+		variant.Value = []byte(value)
+		experiment.Variants = append(experiment.Variants, variant)
+	}
+	return rows.Err()
+}
+
+func (e *ExperimentPostgresRepository) GetByID(ctx context.Context, id int) (*domain.Experiment, error) {
+	row := e.pool.QueryRow(ctx, "SELECT id, pid, namespace, name, parameter, status, create_time, stop_time FROM experiments WHERE id = $1", id)
+	experiment := &domain.Experiment{}
+	if err := row.Scan(
+		&experiment.ID,
+		&experiment.PID,
+		&experiment.Namespace,
+		&experiment.Name,
+		&experiment.Parameter,
+		&experiment.Status,
+		&experiment.CreateTime,
+		&experiment.StopTime,
+	); err != nil {
+		return nil, err
+	}
+	if err := e.getVariants(ctx, experiment); err != nil {
+		return nil, err
+	}
+	return experiment, nil
+}
+
+func (e *ExperimentPostgresRepository) GetByPID(ctx context.Context, pid string) ([]domain.Experiment, error) {
+	rows, err := e.pool.Query(ctx, "SELECT id, pid, namespace, name, parameter, status, create_time, stop_time FROM experiments WHERE pid = $1 ORDER BY create_time DESC", pid)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]domain.Experiment, 0)
+	for rows.Next() {
+		experiment := domain.Experiment{}
+		err := rows.Scan(
+			&experiment.ID,
+			&experiment.PID,
+			&experiment.Namespace,
+			&experiment.Name,
+			&experiment.Parameter,
+			&experiment.Status,
+			&experiment.CreateTime,
+			&experiment.StopTime,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ret = append(ret, experiment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range ret {
+		if err := e.getVariants(ctx, &ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (e *ExperimentPostgresRepository) Insert(ctx context.Context, experiment *domain.Experiment) error {
+	tx, err := e.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	row := tx.QueryRow(
+		ctx,
+		"INSERT INTO experiments (pid, namespace, name, parameter, status) VALUES ($1, $2, $3, $4, $5) RETURNING id, create_time",
+		experiment.PID,
+		experiment.Namespace,
+		experiment.Name,
+		experiment.Parameter,
+		experiment.Status,
+	)
+	if err := row.Scan(&experiment.ID, &experiment.CreateTime); err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	for _, v := range experiment.Variants {
+		batch.Queue(
+			"INSERT INTO experiment_variants (eid, name, weight, value) VALUES ($1, $2, $3, $4)",
+			experiment.ID,
+			v.Name,
+			v.Weight,
+			string(v.Value),
+		)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	if err := bumpRemoteConfigVersion(ctx, tx, experiment.PID, experiment.Namespace); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (e *ExperimentPostgresRepository) Update(ctx context.Context, experiment *domain.Experiment) error {
+	tx, err := e.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(
+		ctx,
+		"UPDATE experiments SET name = $1, status = $2, stop_time = $3 WHERE id = $4",
+		experiment.Name,
+		experiment.Status,
+		experiment.StopTime,
+		experiment.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if err := bumpRemoteConfigVersion(ctx, tx, experiment.PID, experiment.Namespace); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (e *ExperimentPostgresRepository) SetExposures(ctx context.Context, id int, variant string, count int64) error {
+	_, err := e.pool.Exec(ctx, "UPDATE experiment_variants SET exposures_count = GREATEST(exposures_count, $1) WHERE eid = $2 AND name = $3", count, id, variant)
+	return err
+}
+
+func NewExperimentPostgresRepository(pool *pgxpool.Pool) *ExperimentPostgresRepository {
+	return &ExperimentPostgresRepository{
+		pool: pool,
+	}
+}
@@ -0,0 +1,196 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type InAppMessagePostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateInAppMessages() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS in_app_messages
+(
+	id SERIAL NOT NULL PRIMARY KEY,
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	status SMALLINT NOT NULL DEFAULT 1 CHECK (status IN (1, 2, 3, 4, 5)),
+	name VARCHAR(100) NOT NULL,
+	layout VARCHAR(11) NOT NULL CHECK (layout IN ('banner', 'modal', 'full-screen')),
+	title VARCHAR(100) NOT NULL,
+	text VARCHAR(400) NOT NULL,
+	image VARCHAR(200),
+	background_color VARCHAR(7) NOT NULL DEFAULT '',
+	buttons JSON,
+	click_action JSON,
+	triggers JSON NOT NULL,
+	frequency JSON,
+	segment_id INTEGER REFERENCES segments(id) ON DELETE SET NULL,
+	views_count INTEGER DEFAULT 0,
+	clicks_count INTEGER DEFAULT 0,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	active_time TIMESTAMP WITH TIME ZONE,
+	expire_time TIMESTAMP WITH TIME ZONE,
+	schedule_time TIMESTAMP WITH TIME ZONE
+);`,
+		`CREATE OR REPLACE FUNCTION in_app_messages_data(p VARCHAR(30))
+RETURNS TABLE(_active_time TIMESTAMP WITH TIME ZONE, _ids TEXT, _data TEXT)
+LANGUAGE 'plpgsql'
+
+AS $BODY$
+BEGIN
+	RETURN QUERY
+		SELECT
+		MAX(active_time) AS active_time,
+		STRING_AGG(id::TEXT, ' ' ORDER BY id ASC) AS ids,
+		COALESCE(JSON_AGG(JSON_STRIP_NULLS(JSON_BUILD_OBJECT('id', id, 'layout', layout, 'title', title, 'text', text, 'image', image, 'background_color', NULLIF(background_color, ''), 'buttons', buttons, 'click_action', click_action, 'triggers', triggers, 'frequency', frequency, 'active_time', to_char((active_time::timestamp), 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), 'expire_time', to_char((expire_time::timestamp), 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), 'segment', (SELECT s.rules FROM segments s WHERE s.id = segment_id))) ORDER BY id ASC)::TEXT, '[]') AS data
+		FROM in_app_messages
+		WHERE pid = $1 AND status = 1;
+	END
+$BODY$;`,
+	}
+}
+
+const inAppMessageColumns = "id, pid, status, name, layout, title, text, image, background_color, buttons, click_action, triggers, frequency, segment_id, views_count, clicks_count, create_time, active_time, expire_time, schedule_time"
+
+func scanInAppMessage(row pgx.Row, message *domain.InAppMessage) error {
+	return row.Scan(
+		&message.ID,
+		&message.PID,
+		&message.Status,
+		&message.Name,
+		&message.Layout,
+		&message.Title,
+		&message.Text,
+		&message.Image,
+		&message.BackgroundColor,
+		&message.Buttons,
+		&message.ClickAction,
+		&message.Triggers,
+		&message.Frequency,
+		&message.SegmentID,
+		&message.ViewsCount,
+		&message.ClicksCount,
+		&message.CreateTime,
+		&message.ActiveTime,
+		&message.ExpireTime,
+		&message.ScheduleTime,
+	)
+}
+
+func (m *InAppMessagePostgresRepository) GetByID(ctx context.Context, id int) (*domain.InAppMessage, error) {
+	row := m.pool.QueryRow(ctx, "SELECT "+inAppMessageColumns+" FROM in_app_messages WHERE id = $1", id)
+	message := &domain.InAppMessage{}
+	if err := scanInAppMessage(row, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (m *InAppMessagePostgresRepository) GetByPID(ctx context.Context, pid string, limit int, offset int) ([]domain.InAppMessage, error) {
+	rows, err := m.pool.Query(ctx, "SELECT "+inAppMessageColumns+" FROM in_app_messages WHERE pid = $1 ORDER BY create_time DESC LIMIT $2 OFFSET $3", pid, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.InAppMessage, 0)
+	for rows.Next() {
+		message := domain.InAppMessage{}
+		if err := scanInAppMessage(rows, &message); err != nil {
+			return nil, err
+		}
+		ret = append(ret, message)
+	}
+	return ret, rows.Err()
+}
+
+func (m *InAppMessagePostgresRepository) Insert(ctx context.Context, message *domain.InAppMessage) error {
+	row := m.pool.QueryRow(
+		ctx,
+		"INSERT INTO in_app_messages (pid, status, name, layout, title, text, image, background_color, buttons, click_action, triggers, frequency, segment_id, create_time, active_time, expire_time, schedule_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING "+inAppMessageColumns,
+		message.PID,
+		message.Status,
+		message.Name,
+		message.Layout,
+		message.Title,
+		message.Text,
+		message.Image,
+		message.BackgroundColor,
+		message.Buttons,
+		message.ClickAction,
+		message.Triggers,
+		message.Frequency,
+		message.SegmentID,
+		message.CreateTime,
+		message.ActiveTime,
+		message.ExpireTime,
+		message.ScheduleTime,
+	)
+	return scanInAppMessage(row, message)
+}
+
+func (m *InAppMessagePostgresRepository) UpdateStatus(ctx context.Context, message *domain.InAppMessage, from int) error {
+	result, err := m.pool.Exec(
+		ctx,
+		"UPDATE in_app_messages SET status = $1, active_time = $2 WHERE id = $3 AND status = $4",
+		message.Status,
+		message.ActiveTime,
+		message.ID,
+		from,
+	)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return domain.ErrNotificationStatusChanged
+	}
+	return nil
+}
+
+func (m *InAppMessagePostgresRepository) ActivateScheduled(ctx context.Context, now time.Time) (int64, error) {
+	result, err := m.pool.Exec(
+		ctx,
+		"UPDATE in_app_messages SET status = $2, active_time = $1 WHERE status = $3 AND schedule_time <= $1",
+		now,
+		domain.NOTIFICATION_STATUS_ACTIVE,
+		domain.NOTIFICATION_STATUS_SCHEDULED,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (m *InAppMessagePostgresRepository) FinishExpired(ctx context.Context, now time.Time) (int64, error) {
+	result, err := m.pool.Exec(
+		ctx,
+		"UPDATE in_app_messages SET status = $2 WHERE status = ANY($3) AND expire_time <= $1",
+		now,
+		domain.NOTIFICATION_STATUS_FINISHED,
+		[]int{
+			domain.NOTIFICATION_STATUS_ACTIVE,
+			domain.NOTIFICATION_STATUS_SCHEDULED,
+			domain.NOTIFICATION_STATUS_PAUSED,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (m *InAppMessagePostgresRepository) Delete(ctx context.Context, message *domain.InAppMessage) error {
+	_, err := m.pool.Exec(ctx, "DELETE FROM in_app_messages WHERE id = $1", message.ID)
+	return err
+}
+
+func NewInAppMessagePostgresRepository(pool *pgxpool.Pool) *InAppMessagePostgresRepository {
+	return &InAppMessagePostgresRepository{
+		pool: pool,
+	}
+}
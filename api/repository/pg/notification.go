@@ -2,8 +2,10 @@ package pg
 
 import (
 	"context"
+	"time"
 
 	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -17,7 +19,7 @@ func CreateNotifications() []string {
 (
 	id SERIAL NOT NULL PRIMARY KEY,
 	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
-	status SMALLINT NOT NULL DEFAULT 1 CHECK (status IN (1, 2, 3, 4)),
+	status SMALLINT NOT NULL DEFAULT 1 CHECK (status IN (1, 2, 3, 4, 5)),
 	title VARCHAR(100) NOT NULL,
 	text VARCHAR(200) NOT NULL,
 	big_text VARCHAR(400),
@@ -34,6 +36,44 @@ func CreateNotifications() []string {
 	expire_time TIMESTAMP WITH TIME ZONE,
 	schedule_time TIMESTAMP WITH TIME ZONE
 );`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS segment_id INTEGER REFERENCES segments(id) ON DELETE SET NULL;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS reach_count INTEGER DEFAULT 0;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS channel VARCHAR(10) NOT NULL DEFAULT 'pull' CHECK (channel IN ('pull', 'fcm'));`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS fcm_target JSON;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS fcm_message_id TEXT;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS fcm_error TEXT;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS fcm_send_time TIMESTAMP WITH TIME ZONE;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS template_id INTEGER REFERENCES notification_templates(id) ON DELETE SET NULL;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS localizations JSON;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS local_time BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS recurrence JSON;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES notifications(id) ON DELETE SET NULL;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS click_action JSON;`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS payload JSON NOT NULL DEFAULT '{}';`,
+		`ALTER TABLE notifications DROP CONSTRAINT IF EXISTS notifications_status_check;`,
+		`ALTER TABLE notifications ADD CONSTRAINT notifications_status_check CHECK (status IN (1, 2, 3, 4, 5));`,
+		`CREATE TABLE IF NOT EXISTS notification_events
+(
+	id SERIAL NOT NULL PRIMARY KEY,
+	nid INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+	from_status SMALLINT,
+	to_status SMALLINT NOT NULL,
+	actor VARCHAR(10) NOT NULL CHECK (actor IN ('user', 'loop')),
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS notification_events_nid_idx ON notification_events (nid);",
+		`CREATE TABLE IF NOT EXISTS notification_stats
+(
+	nid INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+	bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+	app_version INTEGER NOT NULL DEFAULT 0,
+	views INTEGER NOT NULL DEFAULT 0,
+	clicks INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (nid, bucket, app_version)
+);`,
+		// the ids include the fcm notifications for their clicks to be
+		// counted but only pull notifications make the time of the data
 		`CREATE OR REPLACE FUNCTION notifications_data(p VARCHAR(30))
 RETURNS TABLE(_active_time TIMESTAMP WITH TIME ZONE, _ids TEXT, _data TEXT)
 LANGUAGE 'plpgsql'
@@ -42,9 +82,9 @@ AS $BODY$
 BEGIN
 	RETURN QUERY
 		SELECT
-		MAX(active_time) AS active_time,
+		COALESCE(MAX(active_time) FILTER (WHERE channel = 'pull'), 'epoch') AS active_time,
 		STRING_AGG(id::TEXT, ' ' ORDER BY id ASC) AS ids,
-		'[' || STRING_AGG(CONCAT('{"id":', id, ',"title":"', title, '","text":"', text, '","big-text":"', big_text, '","image":"', image, '","big-image":"', big_image, '","priority":"', priority, '","style":"', style, '","action":"', action, '","extra":"', extra, '","active_time":"', to_char((active_time::timestamp), 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), '"}'), ',') || ']' AS data
+		COALESCE('[' || STRING_AGG(CONCAT('{"id":', id, ',"title":"', title, '","text":"', text, '","big-text":"', big_text, '","image":"', image, '","big-image":"', big_image, '","priority":"', priority, '","style":"', style, '","action":"', action, '","extra":"', extra, '","active_time":"', to_char((active_time::timestamp), 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), '"', CASE WHEN segment_id IS NULL THEN '' ELSE CONCAT(',"segment":', (SELECT s.rules::TEXT FROM segments s WHERE s.id = segment_id)) END, CASE WHEN localizations IS NULL THEN '' ELSE CONCAT(',"localizations":', localizations::TEXT) END, CASE WHEN click_action IS NULL THEN '' ELSE CONCAT(',"click_action":', click_action::TEXT) END, CASE WHEN payload::TEXT = '{}' THEN '' ELSE CONCAT(',', SUBSTR(payload::TEXT, 2, LENGTH(payload::TEXT) - 2)) END, CASE WHEN local_time THEN CONCAT(',"local_time":"', to_char((schedule_time::timestamp), 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), '","local_expire_time":"', to_char((expire_time::timestamp), 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), '"') ELSE '' END, '}'), ',') FILTER (WHERE channel = 'pull') || ']', '[]') AS data
 		FROM notifications
 		WHERE pid = $1 AND status = 1
 		ORDER BY active_time ASC;
@@ -53,10 +93,19 @@ $BODY$;`,
 	}
 }
 
-func (n *NotificationPostgresRepository) GetByID(ctx context.Context, id int) (*domain.Notification, error) {
-	row := n.pool.QueryRow(ctx, "SELECT id, pid, status, title, text, big_text, image, big_image, priority, style, action, extra, views_count, clicks_count, create_time, active_time, expire_time, schedule_time FROM notifications WHERE id = $1", id)
-	notification := &domain.Notification{}
-	if err := row.Scan(
+// localizations is the value of the localizations column, which is NULL rather
+// than a JSON null for notifications without localizations.
+func localizations(notification *domain.Notification) interface{} {
+	if len(notification.Localizations) == 0 {
+		return nil
+	}
+	return notification.Localizations
+}
+
+const notificationColumns = "id, pid, status, title, text, big_text, image, big_image, priority, style, action, extra, views_count, clicks_count, reach_count, create_time, active_time, expire_time, schedule_time, segment_id, channel, fcm_target, fcm_message_id, fcm_error, fcm_send_time, template_id, localizations, local_time, recurrence, parent_id, click_action, payload"
+
+func scanNotification(row pgx.Row, notification *domain.Notification) error {
+	return row.Scan(
 		&notification.ID,
 		&notification.PID,
 		&notification.Status,
@@ -71,45 +120,62 @@ func (n *NotificationPostgresRepository) GetByID(ctx context.Context, id int) (*
 		&notification.Extra,
 		&notification.ViewsCount,
 		&notification.ClicksCount,
+		&notification.ReachCount,
 		&notification.CreateTime,
 		&notification.ActiveTime,
 		&notification.ExpireTime,
 		&notification.ScheduleTime,
-	); err != nil {
+		&notification.SegmentID,
+		&notification.Channel,
+		&notification.FCMTarget,
+		&notification.FCMMessageID,
+		&notification.FCMError,
+		&notification.FCMSendTime,
+		&notification.TemplateID,
+		&notification.Localizations,
+		&notification.LocalTime,
+		&notification.Recurrence,
+		&notification.ParentID,
+		&notification.ClickAction,
+		&notification.NotificationPayload,
+	)
+}
+
+func (n *NotificationPostgresRepository) GetByID(ctx context.Context, id int) (*domain.Notification, error) {
+	row := n.pool.QueryRow(ctx, "SELECT "+notificationColumns+" FROM notifications WHERE id = $1", id)
+	notification := &domain.Notification{}
+	if err := scanNotification(row, notification); err != nil {
 		return nil, err
 	}
 	return notification, nil
 }
 
+func (n *NotificationPostgresRepository) GetByIDs(ctx context.Context, ids []int) ([]domain.Notification, error) {
+	rows, err := n.pool.Query(ctx, "SELECT "+notificationColumns+" FROM notifications WHERE id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.Notification, 0, len(ids))
+	for rows.Next() {
+		notification := domain.Notification{}
+		if err := scanNotification(rows, &notification); err != nil {
+			return nil, err
+		}
+		ret = append(ret, notification)
+	}
+	return ret, rows.Err()
+}
+
 func (n *NotificationPostgresRepository) GetByPID(ctx context.Context, pid string, limit int, offset int) ([]domain.Notification, error) {
-	rows, err := n.pool.Query(ctx, "SELECT id, pid, status, title, text, big_text, image, big_image, priority, style, action, extra, views_count, clicks_count, create_time, active_time, expire_time, schedule_time FROM notifications WHERE pid = $1 ORDER BY create_time DESC LIMIT $2 OFFSET $3", pid, limit, offset)
+	rows, err := n.pool.Query(ctx, "SELECT "+notificationColumns+" FROM notifications WHERE pid = $1 ORDER BY create_time DESC LIMIT $2 OFFSET $3", pid, limit, offset)
 	if err != nil {
 		return nil, err
 	}
 	ret := make([]domain.Notification, 0)
 	for rows.Next() {
 		notification := domain.Notification{}
-		err := rows.Scan(
-			&notification.ID,
-			&notification.PID,
-			&notification.Status,
-			&notification.Title,
-			&notification.Text,
-			&notification.BigText,
-			&notification.Image,
-			&notification.BigImage,
-			&notification.Priority,
-			&notification.Style,
-			&notification.Action,
-			&notification.Extra,
-			&notification.ViewsCount,
-			&notification.ClicksCount,
-			&notification.CreateTime,
-			&notification.ActiveTime,
-			&notification.ExpireTime,
-			&notification.ScheduleTime,
-		)
-		if err != nil {
+		if err := scanNotification(rows, &notification); err != nil {
 			return nil, err
 		}
 		ret = append(ret, notification)
@@ -117,10 +183,28 @@ func (n *NotificationPostgresRepository) GetByPID(ctx context.Context, pid strin
 	return ret, nil
 }
 
-func (n *NotificationPostgresRepository) Insert(ctx context.Context, notification *domain.Notification) error {
-	row := n.pool.QueryRow(
+func (n *NotificationPostgresRepository) Insert(ctx context.Context, notification *domain.Notification, actor domain.NotificationActor) error {
+	return n.InsertAll(ctx, []*domain.Notification{notification}, actor)
+}
+
+func (n *NotificationPostgresRepository) InsertAll(ctx context.Context, notifications []*domain.Notification, actor domain.NotificationActor) error {
+	tx, err := n.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, notification := range notifications {
+		if err := insertNotification(ctx, tx, notification, actor); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func insertNotification(ctx context.Context, tx pgx.Tx, notification *domain.Notification, actor domain.NotificationActor) error {
+	row := tx.QueryRow(
 		ctx,
-		"INSERT INTO notifications (pid, status, title, text, big_text, image, big_image, priority, style, action, extra, create_time, active_time, expire_time, schedule_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id, pid, status, title, text, big_text, image, big_image, priority, style, action, extra, create_time, active_time, expire_time, schedule_time",
+		"INSERT INTO notifications (pid, status, title, text, big_text, image, big_image, priority, style, action, extra, create_time, active_time, expire_time, schedule_time, segment_id, channel, fcm_target, fcm_send_time, template_id, localizations, local_time, recurrence, parent_id, click_action, payload) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26) RETURNING id, pid, status, title, text, big_text, image, big_image, priority, style, action, extra, create_time, active_time, expire_time, schedule_time, segment_id, channel, fcm_target, fcm_message_id, fcm_error, fcm_send_time, template_id, localizations, local_time, recurrence, parent_id, click_action, payload",
 		notification.PID,
 		notification.Status,
 		notification.Title,
@@ -136,8 +220,19 @@ func (n *NotificationPostgresRepository) Insert(ctx context.Context, notificatio
 		notification.ActiveTime,
 		notification.ExpireTime,
 		notification.ScheduleTime,
+		notification.SegmentID,
+		notification.Channel,
+		notification.FCMTarget,
+		notification.FCMSendTime,
+		notification.TemplateID,
+		localizations(notification),
+		notification.LocalTime,
+		notification.Recurrence,
+		notification.ParentID,
+		notification.ClickAction,
+		notification.NotificationPayload,
 	)
-	return row.Scan(
+	err := row.Scan(
 		&notification.ID,
 		&notification.PID,
 		&notification.Status,
@@ -154,13 +249,56 @@ func (n *NotificationPostgresRepository) Insert(ctx context.Context, notificatio
 		&notification.ActiveTime,
 		&notification.ExpireTime,
 		&notification.ScheduleTime,
+		&notification.SegmentID,
+		&notification.Channel,
+		&notification.FCMTarget,
+		&notification.FCMMessageID,
+		&notification.FCMError,
+		&notification.FCMSendTime,
+		&notification.TemplateID,
+		&notification.Localizations,
+		&notification.LocalTime,
+		&notification.Recurrence,
+		&notification.ParentID,
+		&notification.ClickAction,
+		&notification.NotificationPayload,
 	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO notification_events (nid, from_status, to_status, actor, user_id) VALUES ($1, NULL, $2, $3, $4)",
+		notification.ID,
+		notification.Status,
+		actor.Type,
+		actor.UserID,
+	)
+	return err
 }
 
 func (n *NotificationPostgresRepository) Update(ctx context.Context, notification *domain.Notification) error {
-	_, err := n.pool.Exec(
+	return n.UpdateAll(ctx, []*domain.Notification{notification})
+}
+
+func (n *NotificationPostgresRepository) UpdateAll(ctx context.Context, notifications []*domain.Notification) error {
+	tx, err := n.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, notification := range notifications {
+		if err := updateNotification(ctx, tx, notification); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func updateNotification(ctx context.Context, tx pgx.Tx, notification *domain.Notification) error {
+	result, err := tx.Exec(
 		ctx,
-		"UPDATE notifications SET status = $1, title = $2, text = $3, big_text = $4, image = $5, big_image = $6, priority = $7, style = $8, action = $9, extra = $10, active_time = $11, expire_time = $12, schedule_time = $13 WHERE id = $14",
+		"UPDATE notifications SET status = $1, title = $2, text = $3, big_text = $4, image = $5, big_image = $6, priority = $7, style = $8, action = $9, extra = $10, active_time = $11, expire_time = $12, schedule_time = $13, segment_id = $14, template_id = $15, localizations = $16, local_time = $17, recurrence = $18, click_action = $19, payload = $20 WHERE id = $21 AND status = $1",
 		notification.Status,
 		notification.Title,
 		notification.Text,
@@ -174,16 +312,194 @@ func (n *NotificationPostgresRepository) Update(ctx context.Context, notificatio
 		notification.ActiveTime,
 		notification.ExpireTime,
 		notification.ScheduleTime,
+		notification.SegmentID,
+		notification.TemplateID,
+		localizations(notification),
+		notification.LocalTime,
+		notification.Recurrence,
+		notification.ClickAction,
+		notification.NotificationPayload,
+		notification.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return domain.ErrNotificationStatusChanged
+	}
+	return nil
+}
+
+func (n *NotificationPostgresRepository) UpdateFCMResult(ctx context.Context, notification *domain.Notification) error {
+	_, err := n.pool.Exec(
+		ctx,
+		"UPDATE notifications SET fcm_message_id = $1, fcm_error = $2, fcm_send_time = $3 WHERE id = $4",
+		notification.FCMMessageID,
+		notification.FCMError,
+		notification.FCMSendTime,
+		notification.ID,
+	)
+	return err
+}
+
+func (n *NotificationPostgresRepository) UpdateStatus(ctx context.Context, notification *domain.Notification, from int, actor domain.NotificationActor) error {
+	return n.UpdateStatusAll(ctx, []*domain.Notification{notification}, []int{from}, actor)
+}
+
+func (n *NotificationPostgresRepository) UpdateStatusAll(ctx context.Context, notifications []*domain.Notification, from []int, actor domain.NotificationActor) error {
+	tx, err := n.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for i, notification := range notifications {
+		if err := updateNotificationStatus(ctx, tx, notification, from[i], actor); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func updateNotificationStatus(ctx context.Context, tx pgx.Tx, notification *domain.Notification, from int, actor domain.NotificationActor) error {
+	result, err := tx.Exec(
+		ctx,
+		"UPDATE notifications SET status = $1, active_time = $2, schedule_time = $3 WHERE id = $4 AND status = $5",
+		notification.Status,
+		notification.ActiveTime,
+		notification.ScheduleTime,
+		notification.ID,
+		from,
+	)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return domain.ErrNotificationStatusChanged
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO notification_events (nid, from_status, to_status, actor, user_id) VALUES ($1, $2, $3, $4, $5)",
 		notification.ID,
+		from,
+		notification.Status,
+		actor.Type,
+		actor.UserID,
 	)
 	return err
 }
 
+func (n *NotificationPostgresRepository) ActivateScheduled(ctx context.Context, now time.Time, actor domain.NotificationActor) (int64, error) {
+	// local time notifications become active once the earliest timezone
+	// reaches their schedule time
+	result, err := n.pool.Exec(
+		ctx,
+		`WITH t AS (
+	UPDATE notifications SET status = $2, active_time = $1
+	WHERE status = $3 AND recurrence IS NULL AND schedule_time <= $1 + (CASE WHEN local_time THEN INTERVAL '14 hours' ELSE INTERVAL '0' END)
+	RETURNING id
+)
+INSERT INTO notification_events (nid, from_status, to_status, actor, user_id)
+SELECT id, $3, $2, $4::VARCHAR, $5::INTEGER FROM t`,
+		now,
+		domain.NOTIFICATION_STATUS_ACTIVE,
+		domain.NOTIFICATION_STATUS_SCHEDULED,
+		actor.Type,
+		actor.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (n *NotificationPostgresRepository) FinishExpired(ctx context.Context, now time.Time, actor domain.NotificationActor) (int64, error) {
+	// local time notifications finish once the latest timezone reaches their
+	// expire time
+	result, err := n.pool.Exec(
+		ctx,
+		`WITH t AS (
+	UPDATE notifications n SET status = $2
+	FROM notifications o
+	WHERE n.id = o.id AND n.status = ANY($3) AND o.expire_time <= $1 - (CASE WHEN o.local_time THEN INTERVAL '12 hours' ELSE INTERVAL '0' END)
+	RETURNING n.id, o.status
+)
+INSERT INTO notification_events (nid, from_status, to_status, actor, user_id)
+SELECT id, status, $2, $4::VARCHAR, $5::INTEGER FROM t`,
+		now,
+		domain.NOTIFICATION_STATUS_FINISHED,
+		[]int{
+			domain.NOTIFICATION_STATUS_ACTIVE,
+			domain.NOTIFICATION_STATUS_SCHEDULED,
+			domain.NOTIFICATION_STATUS_PAUSED,
+		},
+		actor.Type,
+		actor.UserID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (n *NotificationPostgresRepository) GetHistory(ctx context.Context, id int) ([]domain.NotificationEvent, error) {
+	rows, err := n.pool.Query(ctx, "SELECT id, nid, from_status, to_status, actor, user_id, time FROM notification_events WHERE nid = $1 ORDER BY time ASC, id ASC", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.NotificationEvent, 0)
+	for rows.Next() {
+		event := domain.NotificationEvent{}
+		err := rows.Scan(
+			&event.ID,
+			&event.NID,
+			&event.From,
+			&event.To,
+			&event.Type,
+			&event.UserID,
+			&event.Time,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, event)
+	}
+	return ret, rows.Err()
+}
+
 func (n *NotificationPostgresRepository) Delete(ctx context.Context, notification *domain.Notification) error {
 	_, err := n.pool.Exec(ctx, "DELETE FROM notifications WHERE id = $1", notification.ID)
 	return err
 }
 
+func (n *NotificationPostgresRepository) GetStats(ctx context.Context, id int, interval string, from time.Time, to time.Time) ([]domain.NotificationStats, error) {
+	rows, err := n.pool.Query(
+		ctx,
+		`SELECT date_trunc($2, bucket AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS t, app_version, SUM(views), SUM(clicks)
+FROM notification_stats
+WHERE nid = $1 AND bucket >= $3 AND bucket < $4
+GROUP BY t, app_version
+ORDER BY t ASC, app_version ASC`,
+		id,
+		interval,
+		from,
+		to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.NotificationStats, 0)
+	for rows.Next() {
+		stats := domain.NotificationStats{}
+		if err := rows.Scan(&stats.Time, &stats.AppVersion, &stats.Views, &stats.Clicks); err != nil {
+			return nil, err
+		}
+		ret = append(ret, stats)
+	}
+	return ret, rows.Err()
+}
+
 func NewNotificationPostgresRepository(pool *pgxpool.Pool) *NotificationPostgresRepository {
 	return &NotificationPostgresRepository{
 		pool: pool,
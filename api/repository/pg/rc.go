@@ -2,8 +2,10 @@ package pg
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -19,37 +21,281 @@ func CreateRemoteConfigs() []string {
 	data JSON NOT NULL,
 	version INTEGER DEFAULT 1
 );`,
+		`CREATE TABLE IF NOT EXISTS remote_config_versions
+(
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	version INTEGER NOT NULL,
+	data JSON NOT NULL,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (pid, version)
+);`,
+		`ALTER TABLE remote_configs ADD COLUMN IF NOT EXISTS rules JSON;`,
+		`ALTER TABLE remote_config_versions ADD COLUMN IF NOT EXISTS rules JSON;`,
+		`ALTER TABLE remote_configs ADD COLUMN IF NOT EXISTS update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;`,
+		`CREATE TABLE IF NOT EXISTS remote_config_schemas
+(
+	pid VARCHAR(30) NOT NULL PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+	schema JSON NOT NULL,
+	update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);`,
+		`ALTER TABLE remote_configs ADD COLUMN IF NOT EXISTS namespace VARCHAR(50) NOT NULL DEFAULT 'default';`,
+		`ALTER TABLE remote_config_versions ADD COLUMN IF NOT EXISTS namespace VARCHAR(50) NOT NULL DEFAULT 'default';`,
+		`ALTER TABLE remote_config_schemas ADD COLUMN IF NOT EXISTS namespace VARCHAR(50) NOT NULL DEFAULT 'default';`,
+		namespacePrimaryKey("remote_configs", "pid, namespace"),
+		namespacePrimaryKey("remote_config_versions", "pid, namespace, version"),
+		namespacePrimaryKey("remote_config_schemas", "pid, namespace"),
+		`INSERT INTO remote_config_versions (pid, namespace, version, data)
+SELECT pid, namespace, version, data FROM remote_configs
+ON CONFLICT DO NOTHING;`,
 	}
 }
 
-func (rc *RemoteConfigPostgresRepository) GetByProjectID(ctx context.Context, pid string) (*domain.RemoteConfig, error) {
-	row := rc.pool.QueryRow(ctx, "SELECT pid, data, version FROM remote_configs WHERE pid = $1", pid)
+// namespacePrimaryKey moves the primary key of a table that was keyed by
+// project to the given columns, unless it already includes the namespace.
+func namespacePrimaryKey(table string, columns string) string {
+	return fmt.Sprintf(`DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM information_schema.key_column_usage WHERE table_name = '%[1]s' AND constraint_name = '%[1]s_pkey' AND column_name = 'namespace') THEN
+		ALTER TABLE %[1]s DROP CONSTRAINT IF EXISTS %[1]s_pkey;
+		ALTER TABLE %[1]s ADD PRIMARY KEY (%[2]s);
+	END IF;
+END $$;`, table, columns)
+}
+
+const selectRemoteConfig = `SELECT pid, namespace, data, rules, version, update_time, (
+	SELECT JSON_AGG(JSON_BUILD_OBJECT(
+		'id', e.id,
+		'parameter', e.parameter,
+		'variants', (
+			SELECT JSON_AGG(JSON_BUILD_OBJECT('name', v.name, 'weight', v.weight, 'value', v.value) ORDER BY v.name)
+			FROM experiment_variants v WHERE v.eid = e.id
+		)
+	) ORDER BY e.id)
+	FROM experiments e WHERE e.pid = remote_configs.pid AND e.namespace = remote_configs.namespace AND e.status = 1
+) FROM remote_configs WHERE pid = $1 AND namespace = $2`
+
+func scanRemoteConfig(row pgx.Row) (*domain.RemoteConfig, error) {
 	remoteConfig := domain.RemoteConfig{}
 	if err := row.Scan(
 		&remoteConfig.ProjectID,
+		&remoteConfig.Namespace,
 		&remoteConfig.Data,
+		&remoteConfig.Rules,
 		&remoteConfig.Version,
+		&remoteConfig.UpdateTime,
+		&remoteConfig.Experiments,
 	); err != nil {
 		return nil, err
 	}
 	return &remoteConfig, nil
 }
 
+func (rc *RemoteConfigPostgresRepository) GetByProjectID(ctx context.Context, pid string, namespace string) (*domain.RemoteConfig, error) {
+	return scanRemoteConfig(rc.pool.QueryRow(ctx, selectRemoteConfig, pid, namespace))
+}
+
+// GetNamespaces returns the remote configs of the project without their data.
+func (rc *RemoteConfigPostgresRepository) GetNamespaces(ctx context.Context, pid string) ([]domain.RemoteConfig, error) {
+	rows, err := rc.pool.Query(ctx, "SELECT pid, namespace, version, update_time FROM remote_configs WHERE pid = $1 ORDER BY namespace ASC", pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.RemoteConfig, 0)
+	for rows.Next() {
+		remoteConfig := domain.RemoteConfig{}
+		err := rows.Scan(
+			&remoteConfig.ProjectID,
+			&remoteConfig.Namespace,
+			&remoteConfig.Version,
+			&remoteConfig.UpdateTime,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, remoteConfig)
+	}
+	return ret, rows.Err()
+}
+
+func (rc *RemoteConfigPostgresRepository) GetVersions(ctx context.Context, pid string, namespace string, limit int, offset int) ([]domain.RemoteConfigVersion, error) {
+	rows, err := rc.pool.Query(ctx, "SELECT pid, namespace, version, create_time FROM remote_config_versions WHERE pid = $1 AND namespace = $2 ORDER BY version DESC LIMIT $3 OFFSET $4", pid, namespace, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.RemoteConfigVersion, 0)
+	for rows.Next() {
+		v := domain.RemoteConfigVersion{}
+		err := rows.Scan(
+			&v.ProjectID,
+			&v.Namespace,
+			&v.Version,
+			&v.CreateTime,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, rows.Err()
+}
+
+func (rc *RemoteConfigPostgresRepository) GetVersion(ctx context.Context, pid string, namespace string, version int) (*domain.RemoteConfigVersion, error) {
+	row := rc.pool.QueryRow(ctx, "SELECT pid, namespace, version, data, rules, create_time FROM remote_config_versions WHERE pid = $1 AND namespace = $2 AND version = $3", pid, namespace, version)
+	v := domain.RemoteConfigVersion{}
+	if err := row.Scan(
+		&v.ProjectID,
+		&v.Namespace,
+		&v.Version,
+		&v.Data,
+		&v.Rules,
+		&v.CreateTime,
+	); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
 func (rc *RemoteConfigPostgresRepository) Insert(ctx context.Context, remoteConfig *domain.RemoteConfig) error {
-	row := rc.pool.QueryRow(ctx, "INSERT INTO remote_configs (pid, data) VALUES ($1, $2) RETURNING version", remoteConfig.ProjectID, remoteConfig.Data)
-	return row.Scan(&remoteConfig.Version)
+	tx, err := rc.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	row := tx.QueryRow(
+		ctx,
+		"INSERT INTO remote_configs (pid, namespace, data, rules) VALUES ($1, $2, $3, $4) RETURNING version, update_time",
+		remoteConfig.ProjectID,
+		remoteConfig.Namespace,
+		remoteConfig.Data,
+		remoteConfig.Rules,
+	)
+	if err := row.Scan(&remoteConfig.Version, &remoteConfig.UpdateTime); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO remote_config_versions (pid, namespace, version, data, rules) VALUES ($1, $2, $3, $4, $5)",
+		remoteConfig.ProjectID,
+		remoteConfig.Namespace,
+		remoteConfig.Version,
+		remoteConfig.Data,
+		remoteConfig.Rules,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
 func (rc *RemoteConfigPostgresRepository) Update(ctx context.Context, remoteConfig *domain.RemoteConfig) error {
-	row := rc.pool.QueryRow(
+	tx, err := rc.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := updateRemoteConfig(ctx, tx, remoteConfig); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Patch locks the remote config of the namespace, passes it to fn to be modified
+// and publishes the result as a new version. If version is not zero and does
+// not match the current version, ErrRemoteConfigVersionMismatch is returned.
+func (rc *RemoteConfigPostgresRepository) Patch(ctx context.Context, pid string, namespace string, version int, fn func(rc *domain.RemoteConfig) error) (*domain.RemoteConfig, error) {
+	tx, err := rc.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	var current int
+	if err := tx.QueryRow(ctx, "SELECT version FROM remote_configs WHERE pid = $1 AND namespace = $2 FOR UPDATE", pid, namespace).Scan(&current); err != nil {
+		return nil, err
+	}
+	if version != 0 && version != current {
+		return nil, domain.ErrRemoteConfigVersionMismatch
+	}
+	remoteConfig, err := scanRemoteConfig(tx.QueryRow(ctx, selectRemoteConfig, pid, namespace))
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(remoteConfig); err != nil {
+		return nil, err
+	}
+	if err := updateRemoteConfig(ctx, tx, remoteConfig); err != nil {
+		return nil, err
+	}
+	return remoteConfig, tx.Commit(ctx)
+}
+
+func updateRemoteConfig(ctx context.Context, tx pgx.Tx, remoteConfig *domain.RemoteConfig) error {
+	row := tx.QueryRow(
 		ctx,
-		"UPDATE remote_configs SET data = $1, version = version + 1 WHERE pid = $2 RETURNING version",
+		"UPDATE remote_configs SET data = $1, rules = $2, version = version + 1, update_time = CURRENT_TIMESTAMP WHERE pid = $3 AND namespace = $4 RETURNING version, update_time",
 		remoteConfig.Data,
+		remoteConfig.Rules,
 		remoteConfig.ProjectID,
+		remoteConfig.Namespace,
 	)
-	return row.Scan(
-		&remoteConfig.Version,
+	if err := row.Scan(&remoteConfig.Version, &remoteConfig.UpdateTime); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		ctx,
+		"INSERT INTO remote_config_versions (pid, namespace, version, data, rules) VALUES ($1, $2, $3, $4, $5)",
+		remoteConfig.ProjectID,
+		remoteConfig.Namespace,
+		remoteConfig.Version,
+		remoteConfig.Data,
+		remoteConfig.Rules,
+	)
+	return err
+}
+
+// bumpRemoteConfigVersion stores the current data and rules of the namespace
+// as a new version, for clients to pick up a change of its experiments.
+func bumpRemoteConfigVersion(ctx context.Context, tx pgx.Tx, pid string, namespace string) error {
+	_, err := tx.Exec(
+		ctx,
+		`WITH bumped AS (
+	UPDATE remote_configs SET version = version + 1, update_time = CURRENT_TIMESTAMP WHERE pid = $1 AND namespace = $2 RETURNING pid, namespace, version, data, rules
+)
+INSERT INTO remote_config_versions (pid, namespace, version, data, rules) SELECT pid, namespace, version, data, rules FROM bumped`,
+		pid,
+		namespace,
+	)
+	return err
+}
+
+// GetSchema returns the json schema of the namespace or nil if it has none.
+func (rc *RemoteConfigPostgresRepository) GetSchema(ctx context.Context, pid string, namespace string) (*string, error) {
+	row := rc.pool.QueryRow(ctx, "SELECT schema FROM remote_config_schemas WHERE pid = $1 AND namespace = $2", pid, namespace)
+	var schema string
+	if err := row.Scan(&schema); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func (rc *RemoteConfigPostgresRepository) UpdateSchema(ctx context.Context, pid string, namespace string, schema string) error {
+	_, err := rc.pool.Exec(
+		ctx,
+		"INSERT INTO remote_config_schemas (pid, namespace, schema) VALUES ($1, $2, $3) ON CONFLICT (pid, namespace) DO UPDATE SET schema = EXCLUDED.schema, update_time = CURRENT_TIMESTAMP",
+		pid,
+		namespace,
+		schema,
 	)
+	return err
+}
+
+func (rc *RemoteConfigPostgresRepository) DeleteSchema(ctx context.Context, pid string, namespace string) error {
+	_, err := rc.pool.Exec(ctx, "DELETE FROM remote_config_schemas WHERE pid = $1 AND namespace = $2", pid, namespace)
+	return err
 }
 
 func NewRemoteConfigPostgresRepository(pool *pgxpool.Pool) *RemoteConfigPostgresRepository {
@@ -0,0 +1,138 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type RemoteConfigSchedulePostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateRemoteConfigSchedules() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS remote_config_schedules
+(
+	id SERIAL NOT NULL PRIMARY KEY,
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	data JSON NOT NULL,
+	rules JSON,
+	status SMALLINT NOT NULL DEFAULT 1 CHECK (status IN (1, 2, 3, 4)),
+	publish_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	revert_time TIMESTAMP WITH TIME ZONE,
+	base_version INTEGER,
+	publish_version INTEGER,
+	revert_version INTEGER,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);`,
+		`ALTER TABLE remote_config_schedules ADD COLUMN IF NOT EXISTS namespace VARCHAR(50) NOT NULL DEFAULT 'default';`,
+	}
+}
+
+const selectRemoteConfigSchedule = "SELECT id, pid, namespace, data, rules, status, publish_time, revert_time, base_version, publish_version, revert_version, create_time FROM remote_config_schedules"
+
+func scanRemoteConfigSchedule(row pgx.Row) (*domain.RemoteConfigSchedule, error) {
+	s := &domain.RemoteConfigSchedule{}
+	var data string
+	var rules *string
+	if err := row.Scan(
+		&s.ID,
+		&s.PID,
+		&s.Namespace,
+		&data,
+		&rules,
+		&s.Status,
+		&s.PublishTime,
+		&s.RevertTime,
+		&s.BaseVersion,
+		&s.PublishVersion,
+		&s.RevertVersion,
+		&s.CreateTime,
+	); err != nil {
+		return nil, err
+	}
+	s.Data = []byte(data)
+	if rules != nil {
+		s.Rules = []byte(*rules)
+	}
+	return s, nil
+}
+
+func (s *RemoteConfigSchedulePostgresRepository) query(ctx context.Context, sql string, args ...interface{}) ([]domain.RemoteConfigSchedule, error) {
+	rows, err := s.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.RemoteConfigSchedule, 0)
+	for rows.Next() {
+		schedule, err := scanRemoteConfigSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *schedule)
+	}
+	return ret, rows.Err()
+}
+
+func (s *RemoteConfigSchedulePostgresRepository) GetByID(ctx context.Context, id int) (*domain.RemoteConfigSchedule, error) {
+	return scanRemoteConfigSchedule(s.pool.QueryRow(ctx, selectRemoteConfigSchedule+" WHERE id = $1", id))
+}
+
+func (s *RemoteConfigSchedulePostgresRepository) GetByPID(ctx context.Context, pid string) ([]domain.RemoteConfigSchedule, error) {
+	return s.query(ctx, selectRemoteConfigSchedule+" WHERE pid = $1 ORDER BY publish_time DESC", pid)
+}
+
+func (s *RemoteConfigSchedulePostgresRepository) GetDue(ctx context.Context, t time.Time) ([]domain.RemoteConfigSchedule, error) {
+	return s.query(
+		ctx,
+		selectRemoteConfigSchedule+" WHERE (status = $1 AND publish_time <= $3) OR (status = $2 AND revert_time <= $3) ORDER BY publish_time ASC",
+		domain.RC_SCHEDULE_STATUS_SCHEDULED,
+		domain.RC_SCHEDULE_STATUS_PUBLISHED,
+		t,
+	)
+}
+
+func (s *RemoteConfigSchedulePostgresRepository) Insert(ctx context.Context, schedule *domain.RemoteConfigSchedule) error {
+	var rules *string
+	if len(schedule.Rules) > 0 {
+		r := string(schedule.Rules)
+		rules = &r
+	}
+	row := s.pool.QueryRow(
+		ctx,
+		"INSERT INTO remote_config_schedules (pid, namespace, data, rules, status, publish_time, revert_time) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, create_time",
+		schedule.PID,
+		schedule.Namespace,
+		string(schedule.Data),
+		rules,
+		schedule.Status,
+		schedule.PublishTime,
+		schedule.RevertTime,
+	)
+	return row.Scan(&schedule.ID, &schedule.CreateTime)
+}
+
+func (s *RemoteConfigSchedulePostgresRepository) Update(ctx context.Context, schedule *domain.RemoteConfigSchedule) error {
+	_, err := s.pool.Exec(
+		ctx,
+		"UPDATE remote_config_schedules SET status = $1, revert_time = $2, base_version = $3, publish_version = $4, revert_version = $5 WHERE id = $6",
+		schedule.Status,
+		schedule.RevertTime,
+		schedule.BaseVersion,
+		schedule.PublishVersion,
+		schedule.RevertVersion,
+		schedule.ID,
+	)
+	return err
+}
+
+func NewRemoteConfigSchedulePostgresRepository(pool *pgxpool.Pool) *RemoteConfigSchedulePostgresRepository {
+	return &RemoteConfigSchedulePostgresRepository{
+		pool: pool,
+	}
+}
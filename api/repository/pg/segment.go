@@ -0,0 +1,116 @@
+package pg
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type SegmentPostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateSegments() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS segments
+(
+	id SERIAL NOT NULL PRIMARY KEY,
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	name VARCHAR(100) NOT NULL,
+	rules JSON NOT NULL,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (pid, name)
+);`,
+	}
+}
+
+func scanSegment(row pgx.Row) (*domain.Segment, error) {
+	segment := &domain.Segment{}
+	var rules string
+	if err := row.Scan(
+		&segment.ID,
+		&segment.PID,
+		&segment.Name,
+		&rules,
+		&segment.CreateTime,
+		&segment.UpdateTime,
+	); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(rules), &segment.Condition); err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+func (s *SegmentPostgresRepository) GetByID(ctx context.Context, id int) (*domain.Segment, error) {
+	return scanSegment(s.pool.QueryRow(ctx, "SELECT id, pid, name, rules, create_time, update_time FROM segments WHERE id = $1", id))
+}
+
+func (s *SegmentPostgresRepository) GetByPID(ctx context.Context, pid string) ([]domain.Segment, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id, pid, name, rules, create_time, update_time FROM segments WHERE pid = $1 ORDER BY name ASC", pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.Segment, 0)
+	for rows.Next() {
+		segment, err := scanSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *segment)
+	}
+	return ret, rows.Err()
+}
+
+func (s *SegmentPostgresRepository) Insert(ctx context.Context, segment *domain.Segment) error {
+	rules, err := json.Marshal(segment.Condition)
+	if err != nil {
+		return err
+	}
+	row := s.pool.QueryRow(
+		ctx,
+		"INSERT INTO segments (pid, name, rules) VALUES ($1, $2, $3) RETURNING id, create_time, update_time",
+		segment.PID,
+		segment.Name,
+		string(rules),
+	)
+	return row.Scan(&segment.ID, &segment.CreateTime, &segment.UpdateTime)
+}
+
+func (s *SegmentPostgresRepository) Update(ctx context.Context, segment *domain.Segment) error {
+	rules, err := json.Marshal(segment.Condition)
+	if err != nil {
+		return err
+	}
+	row := s.pool.QueryRow(
+		ctx,
+		"UPDATE segments SET name = $1, rules = $2, update_time = CURRENT_TIMESTAMP WHERE id = $3 RETURNING update_time",
+		segment.Name,
+		string(rules),
+		segment.ID,
+	)
+	return row.Scan(&segment.UpdateTime)
+}
+
+func (s *SegmentPostgresRepository) Delete(ctx context.Context, segment *domain.Segment) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM segments WHERE id = $1", segment.ID)
+	return err
+}
+
+func (s *SegmentPostgresRepository) InUse(ctx context.Context, id int) (bool, error) {
+	var ret bool
+	err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM notifications WHERE segment_id = $1 AND status IN (1, 2, 5)) OR EXISTS (SELECT 1 FROM in_app_messages WHERE segment_id = $1 AND status IN (1, 2, 5))", id).Scan(&ret)
+	return ret, err
+}
+
+func NewSegmentPostgresRepository(pool *pgxpool.Pool) *SegmentPostgresRepository {
+	return &SegmentPostgresRepository{
+		pool: pool,
+	}
+}
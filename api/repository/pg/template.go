@@ -0,0 +1,114 @@
+package pg
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type NotificationTemplatePostgresRepository struct {
+	pool *pgxpool.Pool
+}
+
+func CreateNotificationTemplates() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS notification_templates
+(
+	id SERIAL NOT NULL PRIMARY KEY,
+	pid VARCHAR(30) NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	name VARCHAR(100) NOT NULL,
+	default_locale VARCHAR(20) NOT NULL,
+	variants JSON NOT NULL,
+	create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (pid, name)
+);`,
+	}
+}
+
+func scanNotificationTemplate(row pgx.Row) (*domain.NotificationTemplate, error) {
+	template := &domain.NotificationTemplate{}
+	var variants string
+	if err := row.Scan(
+		&template.ID,
+		&template.PID,
+		&template.Name,
+		&template.DefaultLocale,
+		&variants,
+		&template.CreateTime,
+		&template.UpdateTime,
+	); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(variants), &template.Variants); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+func (t *NotificationTemplatePostgresRepository) GetByID(ctx context.Context, id int) (*domain.NotificationTemplate, error) {
+	return scanNotificationTemplate(t.pool.QueryRow(ctx, "SELECT id, pid, name, default_locale, variants, create_time, update_time FROM notification_templates WHERE id = $1", id))
+}
+
+func (t *NotificationTemplatePostgresRepository) GetByPID(ctx context.Context, pid string) ([]domain.NotificationTemplate, error) {
+	rows, err := t.pool.Query(ctx, "SELECT id, pid, name, default_locale, variants, create_time, update_time FROM notification_templates WHERE pid = $1 ORDER BY name ASC", pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]domain.NotificationTemplate, 0)
+	for rows.Next() {
+		template, err := scanNotificationTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *template)
+	}
+	return ret, rows.Err()
+}
+
+func (t *NotificationTemplatePostgresRepository) Insert(ctx context.Context, template *domain.NotificationTemplate) error {
+	variants, err := json.Marshal(template.Variants)
+	if err != nil {
+		return err
+	}
+	row := t.pool.QueryRow(
+		ctx,
+		"INSERT INTO notification_templates (pid, name, default_locale, variants) VALUES ($1, $2, $3, $4) RETURNING id, create_time, update_time",
+		template.PID,
+		template.Name,
+		template.DefaultLocale,
+		string(variants),
+	)
+	return row.Scan(&template.ID, &template.CreateTime, &template.UpdateTime)
+}
+
+func (t *NotificationTemplatePostgresRepository) Update(ctx context.Context, template *domain.NotificationTemplate) error {
+	variants, err := json.Marshal(template.Variants)
+	if err != nil {
+		return err
+	}
+	row := t.pool.QueryRow(
+		ctx,
+		"UPDATE notification_templates SET name = $1, default_locale = $2, variants = $3, update_time = CURRENT_TIMESTAMP WHERE id = $4 RETURNING update_time",
+		template.Name,
+		template.DefaultLocale,
+		string(variants),
+		template.ID,
+	)
+	return row.Scan(&template.UpdateTime)
+}
+
+func (t *NotificationTemplatePostgresRepository) Delete(ctx context.Context, template *domain.NotificationTemplate) error {
+	_, err := t.pool.Exec(ctx, "DELETE FROM notification_templates WHERE id = $1", template.ID)
+	return err
+}
+
+func NewNotificationTemplatePostgresRepository(pool *pgxpool.Pool) *NotificationTemplatePostgresRepository {
+	return &NotificationTemplatePostgresRepository{
+		pool: pool,
+	}
+}
@@ -0,0 +1,272 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+)
+
+const (
+	APNS_HOST_PRODUCTION  = "https://api.push.apple.com"
+	APNS_HOST_DEVELOPMENT = "https://api.sandbox.push.apple.com"
+)
+
+// APNS_TOKEN_LIFETIME is how long a provider token is used. APNs rejects
+// tokens older than an hour and throttles tokens that are renewed too often.
+const APNS_TOKEN_LIFETIME = 50 * time.Minute
+
+// APNS_CONCURRENCY is how many requests are sent at the same time. They share
+// a single HTTP/2 connection.
+const APNS_CONCURRENCY = 10
+
+// apnsCredential is the .p8 signing key of an Apple developer team together
+// with the bundle id of the app.
+type apnsCredential struct {
+	KeyID      string `json:"key_id"`
+	TeamID     string `json:"team_id"`
+	Topic      string `json:"topic"`
+	PrivateKey string `json:"private_key"`
+	Production bool   `json:"production"`
+
+	key *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	token     string
+	tokenTime time.Time
+}
+
+func parseAPNsCredential(data []byte) (*apnsCredential, error) {
+	c := &apnsCredential{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.KeyID == "" {
+		return nil, errors.New("no key_id")
+	}
+	if c.TeamID == "" {
+		return nil, errors.New("no team_id")
+	}
+	if c.Topic == "" {
+		return nil, errors.New("no topic")
+	}
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not a .p8 key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("bad private_key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an ECDSA key")
+	}
+	c.key = ecKey
+	return c, nil
+}
+
+// ValidateAPNsCredential checks that the data is the credential an APNs sender
+// can use, i.e. {"key_id", "team_id", "topic", "private_key", "production"}.
+func ValidateAPNsCredential(data []byte) error {
+	_, err := parseAPNsCredential(data)
+	return err
+}
+
+// providerToken returns the JWT that authenticates the team.
+func (c *apnsCredential) providerToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Since(c.tokenTime) < APNS_TOKEN_LIFETIME {
+		return c.token, nil
+	}
+	now := time.Now()
+	token, err := SignES256JWT(c.key, map[string]interface{}{
+		"kid": c.KeyID,
+	}, map[string]interface{}{
+		"iss": c.TeamID,
+		"iat": now.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.tokenTime = now
+	return token, nil
+}
+
+// APNsSenders sends to iOS devices through the Apple Push Notification
+// service, using the token based auth of the apns credential of each project.
+type APNsSenders struct {
+	credentials *pushCredentials
+	client      *http.Client
+	host        string
+}
+
+func (a *APNsSenders) Provider() string {
+	return domain.PUSH_PROVIDER_APNS
+}
+
+func (a *APNsSenders) Invalidate(pid string) {
+	a.credentials.invalidate(pid)
+}
+
+// Send posts the message to each of the device tokens as a visible alert. The
+// data of the message is passed next to the aps dictionary.
+func (a *APNsSenders) Send(ctx context.Context, pid string, tokens []string, message *domain.PushMessage) (*domain.PushResult, error) {
+	v, err := a.credentials.get(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	credential := v.(*apnsCredential)
+	token, err := credential.providerToken()
+	if err != nil {
+		return nil, err
+	}
+
+	aps := map[string]interface{}{
+		"alert": map[string]string{
+			"title": message.Title,
+			"body":  message.Text,
+		},
+	}
+	if message.Sound != "" {
+		aps["sound"] = message.Sound
+	}
+	payload := map[string]interface{}{
+		"aps": aps,
+	}
+	for k, v := range message.Data {
+		if k != "aps" {
+			payload[k] = v
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	host := a.host
+	if host == "" {
+		if credential.Production {
+			host = APNS_HOST_PRODUCTION
+		} else {
+			host = APNS_HOST_DEVELOPMENT
+		}
+	}
+
+	ret := domain.NewPushResult()
+	var mu sync.Mutex
+	var sendErr error
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < APNS_CONCURRENCY && i < len(tokens); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				failure, err := a.send(ctx, host, credential.Topic, token, t, body)
+				mu.Lock()
+				if failure == nil && err == nil {
+					ret.SuccessCount++
+				} else {
+					ret.FailureCount++
+					if failure == nil {
+						failure = &domain.PushFailure{
+							Provider: domain.PUSH_PROVIDER_APNS,
+							Token:    t,
+							Error:    err.Error(),
+						}
+						if sendErr == nil {
+							sendErr = err
+						}
+					}
+					ret.Failures = append(ret.Failures, *failure)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range tokens {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ret.SuccessCount == 0 && sendErr != nil {
+		return ret, sendErr
+	}
+	return ret, nil
+}
+
+// send posts the payload to one device. A failure is returned if APNs
+// rejected the notification and an error if it could not be reached.
+func (a *APNsSenders) send(
+	ctx context.Context,
+	host string,
+	topic string,
+	providerToken string,
+	deviceToken string,
+	body []byte,
+) (*domain.PushFailure, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/3/device/%s", host, deviceToken), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil, nil
+	}
+
+	reason := struct {
+		Reason string `json:"reason"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&reason)
+	if reason.Reason == "" {
+		reason.Reason = resp.Status
+	}
+	return &domain.PushFailure{
+		Provider: domain.PUSH_PROVIDER_APNS,
+		Token:    deviceToken,
+		Error:    reason.Reason,
+		Invalid: resp.StatusCode == http.StatusGone ||
+			reason.Reason == "BadDeviceToken" ||
+			reason.Reason == "Unregistered" ||
+			reason.Reason == "DeviceTokenNotForTopic",
+	}, nil
+}
+
+// NewAPNsSenders makes a sender that talks to the production or development
+// APNs host as set in the credential of each project. A non empty host is
+// used for all projects instead, e.g. to send to a local stand-in.
+func NewAPNsSenders(crRepo domain.PushCredentialRepository, host string) *APNsSenders {
+	return &APNsSenders{
+		credentials: newPushCredentials(crRepo, domain.PUSH_PROVIDER_APNS, func(data []byte) (interface{}, error) {
+			return parseAPNsCredential(data)
+		}),
+		// APNs only speaks HTTP/2 which the transport negotiates over TLS
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		},
+		host: host,
+	}
+}
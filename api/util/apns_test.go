@@ -0,0 +1,135 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/doorbash/backend-services/api/domain"
+)
+
+func newTestAPNsSenders(t *testing.T, host string) *APNsSenders {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"key_id":      "KEY",
+		"team_id":     "TEAM",
+		"topic":       "com.example.app",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPNsSenders(testCredentials{domain.PUSH_PROVIDER_APNS: data}, host)
+}
+
+func TestAPNsSend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("authorization"), "bearer ") || r.Header.Get("apns-topic") != "com.example.app" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "InvalidProviderToken"})
+			return
+		}
+		body := struct {
+			APS struct {
+				Alert struct {
+					Title string `json:"title"`
+				} `json:"alert"`
+			} `json:"aps"`
+			Key string `json:"key"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.APS.Alert.Title != "title" || body.Key != "value" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "PayloadEmpty"})
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/3/device/") {
+		case "good":
+			w.WriteHeader(http.StatusOK)
+		case "gone":
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "Unregistered"})
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "BadDeviceToken"})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"reason": "InternalServerError"})
+		}
+	}))
+	defer server.Close()
+
+	a := newTestAPNsSenders(t, server.URL)
+	result, err := a.Send(context.Background(), "p", []string{"good", "gone", "bad", "busy"}, &domain.PushMessage{
+		Title: "title",
+		Text:  "text",
+		Data:  map[string]string{"key": "value"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SuccessCount != 1 || result.FailureCount != 3 {
+		t.Fatalf("got %d successes and %d failures, want 1 and 3", result.SuccessCount, result.FailureCount)
+	}
+
+	failures := failuresByToken(result)
+	tests := []struct {
+		token   string
+		reason  string
+		invalid bool
+	}{
+		{"gone", "Unregistered", true},
+		{"bad", "BadDeviceToken", true},
+		{"busy", "InternalServerError", false},
+	}
+	for _, test := range tests {
+		f, ok := failures[test.token]
+		if !ok {
+			t.Errorf("%s: no failure", test.token)
+			continue
+		}
+		if f.Error != test.reason || f.Invalid != test.invalid || f.Provider != domain.PUSH_PROVIDER_APNS {
+			t.Errorf("%s: got %+v, want reason %s and invalid %v", test.token, f, test.reason, test.invalid)
+		}
+	}
+}
+
+func TestAPNsSendUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	a := newTestAPNsSenders(t, server.URL)
+	result, err := a.Send(context.Background(), "p", []string{"a", "b"}, &domain.PushMessage{Title: "title"})
+	if err == nil {
+		t.Fatal("no error sending to a closed server")
+	}
+	if result == nil || result.SuccessCount != 0 || result.FailureCount != 2 {
+		t.Fatalf("got %+v, want 2 failures", result)
+	}
+	for _, f := range result.Failures {
+		if f.Invalid {
+			t.Errorf("%s: unreachable APNs made the token invalid", f.Token)
+		}
+	}
+}
+
+func TestAPNsSendNoCredential(t *testing.T) {
+	a := NewAPNsSenders(testCredentials{}, "")
+	if _, err := a.Send(context.Background(), "p", []string{"a"}, &domain.PushMessage{Title: "title"}); err == nil {
+		t.Fatal("no error sending without a credential")
+	}
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNoEncryptionKey  = errors.New("no encryption key")
+	ErrBadEncryptionKey = errors.New("encryption key must be 32 bytes encoded in base64")
+	ErrBadCiphertext    = errors.New("bad ciphertext")
+)
+
+// ParseEncryptionKey decodes a base64 encoded AES-256 key.
+func ParseEncryptionKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, ErrNoEncryptionKey
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, ErrBadEncryptionKey
+	}
+	return key, nil
+}
+
+// Encrypt seals the plaintext with AES-GCM. The random nonce is prepended to
+// the returned ciphertext.
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens a ciphertext made by Encrypt.
+func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrBadCiphertext
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
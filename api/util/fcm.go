@@ -3,34 +3,221 @@ package util
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/messaging"
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
 
 	"google.golang.org/api/option"
 )
 
-func SendNotification(
+// FCM_MULTICAST_MAX_TOKENS is the most tokens FCM accepts in one multicast
+// request.
+const FCM_MULTICAST_MAX_TOKENS = 500
+
+// FCM_TIMEOUT is how long a single FCM request may take.
+const FCM_TIMEOUT = 20 * time.Second
+
+type fcmClient struct {
+	client     *messaging.Client
+	updateTime *time.Time
+	checkTime  time.Time
+}
+
+// FCMClients keeps one messaging client per project. The service account of
+// a project is read from its push credential, falling back to
+// /fcm/{projectId}.json for projects that have none.
+type FCMClients struct {
+	crRepo domain.PushCredentialRepository
+
+	mu      sync.Mutex
+	clients map[string]*fcmClient
+}
+
+func (f *FCMClients) Provider() string {
+	return domain.PUSH_PROVIDER_FCM
+}
+
+// Send delivers the data of the message to the registration tokens.
+func (f *FCMClients) Send(ctx context.Context, projectId string, tokens []string, message *domain.PushMessage) (*domain.PushResult, error) {
+	return f.SendNotificationToTokens(ctx, projectId, tokens, message.Data)
+}
+
+func (f *FCMClients) Invalidate(projectId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.clients, projectId)
+}
+
+func (f *FCMClients) get(ctx context.Context, projectId string) (*messaging.Client, error) {
+	f.mu.Lock()
+	c, ok := f.clients[projectId]
+	fresh := ok && time.Since(c.checkTime) < PUSH_CREDENTIAL_CHECK_INTERVAL
+	f.mu.Unlock()
+
+	if fresh {
+		return c.client, nil
+	}
+
+	updateTime, err := f.crRepo.GetUpdateTime(ctx, projectId, domain.PUSH_PROVIDER_FCM)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	if ok && timeEqual(updateTime, c.updateTime) {
+		f.mu.Lock()
+		c.checkTime = time.Now()
+		f.mu.Unlock()
+		return c.client, nil
+	}
+
+	var opt option.ClientOption
+	if updateTime == nil {
+		opt = option.WithCredentialsFile(fmt.Sprintf("/fcm/%s.json", projectId))
+	} else {
+		credential, err := f.crRepo.Get(ctx, projectId, domain.PUSH_PROVIDER_FCM)
+		if err != nil {
+			return nil, err
+		}
+		updateTime = credential.UpdateTime
+		opt = option.WithCredentialsJSON(credential.Data)
+	}
+	app, err := firebase.NewApp(context.Background(), nil, opt)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing app: %v", err)
+	}
+	client, err := app.Messaging(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clients[projectId] = &fcmClient{
+		client:     client,
+		updateTime: updateTime,
+		checkTime:  time.Now(),
+	}
+	return client, nil
+}
+
+func timeEqual(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func (f *FCMClients) SendNotification(
 	ctx context.Context,
 	projectId string,
 	topic string,
 	data map[string]string,
 ) error {
-	opt := option.WithCredentialsFile(fmt.Sprintf("/fcm/%s.json", projectId))
-	app, err := firebase.NewApp(ctx, nil, opt)
-	if err != nil {
-		return fmt.Errorf("error initializing app: %v", err)
-	}
-	c, err := app.Messaging(ctx)
+	_, err := f.SendNotificationToTopic(ctx, projectId, topic, data)
+	return err
+}
+
+// SendNotificationToTopic sends to the devices subscribed to the topic and
+// returns the FCM message id.
+func (f *FCMClients) SendNotificationToTopic(
+	ctx context.Context,
+	projectId string,
+	topic string,
+	data map[string]string,
+) (string, error) {
+	c, err := f.get(ctx, projectId)
 	if err != nil {
-		return err
+		return "", err
 	}
-	_, err = c.Send(ctx, &messaging.Message{
+	return c.Send(ctx, &messaging.Message{
 		Data:  data,
 		Topic: topic,
 	})
+}
+
+// SendNotificationToCondition sends to the devices subscribed to a combination
+// of topics, e.g. "'a' in topics && 'b' in topics", and returns the FCM message
+// id.
+func (f *FCMClients) SendNotificationToCondition(
+	ctx context.Context,
+	projectId string,
+	condition string,
+	data map[string]string,
+) (string, error) {
+	c, err := f.get(ctx, projectId)
+	if err != nil {
+		return "", err
+	}
+	return c.Send(ctx, &messaging.Message{
+		Data:      data,
+		Condition: condition,
+	})
+}
+
+// SendNotificationToTokens sends to each of the registration tokens in batches
+// of FCM_MULTICAST_MAX_TOKENS. An error is returned only if a whole batch
+// fails, the failures of single tokens are reported in the result. A batch of
+// which every token is rejected with an invalid argument fails as FCM rejects
+// the message itself, e.g. for being too large, rather than the tokens.
+func (f *FCMClients) SendNotificationToTokens(
+	ctx context.Context,
+	projectId string,
+	tokens []string,
+	data map[string]string,
+) (*domain.PushResult, error) {
+	c, err := f.get(ctx, projectId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	ret := domain.NewPushResult()
+	for start := 0; start < len(tokens); start += FCM_MULTICAST_MAX_TOKENS {
+		end := start + FCM_MULTICAST_MAX_TOKENS
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		batch := tokens[start:end]
+		res, err := c.SendMulticast(ctx, &messaging.MulticastMessage{
+			Tokens: batch,
+			Data:   data,
+		})
+		if err != nil {
+			return ret, err
+		}
+		if res.SuccessCount == 0 && len(res.Responses) > 0 {
+			rejected := true
+			for _, r := range res.Responses {
+				if r.Success || !messaging.IsInvalidArgument(r.Error) {
+					rejected = false
+					break
+				}
+			}
+			if rejected {
+				return ret, fmt.Errorf("message rejected: %v", res.Responses[0].Error)
+			}
+		}
+		ret.SuccessCount += res.SuccessCount
+		ret.FailureCount += res.FailureCount
+		for i, r := range res.Responses {
+			if r.Success {
+				continue
+			}
+			ret.Failures = append(ret.Failures, domain.PushFailure{
+				Provider: domain.PUSH_PROVIDER_FCM,
+				Token:    batch[i],
+				Error:    r.Error.Error(),
+				Invalid:  messaging.IsRegistrationTokenNotRegistered(r.Error),
+			})
+		}
+	}
+	return ret, nil
+}
+
+func NewFCMClients(crRepo domain.PushCredentialRepository) *FCMClients {
+	return &FCMClients{
+		crRepo:  crRepo,
+		clients: make(map[string]*fcmClient),
 	}
-	return nil
 }
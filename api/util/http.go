@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Result struct {
-	Ok     bool         `json:"ok"`
-	Err    *string      `json:"error,omitempty"`
-	Result *interface{} `json:"result,omitempty"`
+	Ok      bool         `json:"ok"`
+	Err     *string      `json:"error,omitempty"`
+	Details *interface{} `json:"details,omitempty"`
+	Result  *interface{} `json:"result,omitempty"`
 }
 
 func WriteOK(w http.ResponseWriter) {
@@ -46,6 +49,24 @@ func WriteError(w http.ResponseWriter, statusCode int, errorMessage string) {
 	w.Write(data)
 }
 
+func WriteErrorDetails(w http.ResponseWriter, statusCode int, errorMessage string, details interface{}) {
+	result := &Result{
+		Ok:      false,
+		Err:     &errorMessage,
+		Details: &details,
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
 func WriteJson(w http.ResponseWriter, res interface{}) {
 	result := &Result{
 		Ok:     true,
@@ -74,3 +95,43 @@ func WriteUnauthorized(w http.ResponseWriter) {
 func WriteInternalServerError(w http.ResponseWriter) {
 	WriteStatus(w, http.StatusInternalServerError)
 }
+
+// CheckNotModified sets the validators and the Cache-Control header of a
+// cacheable response. It writes 304 and returns true when the conditional
+// headers of the request show that the client has the current representation.
+func CheckNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified *time.Time, maxAge time.Duration) bool {
+	h := w.Header()
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if lastModified != nil {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-Modified-Since is ignored when If-None-Match is present
+		if etag == "" || !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && lastModified != nil {
+		t, err := http.ParseTime(ims)
+		if err != nil || lastModified.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches does the weak comparison of an If-None-Match header with etag.
+func etagMatches(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type JsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// CreateJsonPatch returns the RFC 6902 operations that turn the "from" document
+// into the "to" document. Objects are compared key by key, everything else
+// (including arrays) is replaced as a whole.
+func CreateJsonPatch(from string, to string) ([]JsonPatchOperation, error) {
+	var a, b interface{}
+	if err := json.Unmarshal([]byte(from), &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(to), &b); err != nil {
+		return nil, err
+	}
+	ops := make([]JsonPatchOperation, 0)
+	return diffJson(ops, "", a, b)
+}
+
+func diffJson(ops []JsonPatchOperation, path string, a interface{}, b interface{}) ([]JsonPatchOperation, error) {
+	ma, okA := a.(map[string]interface{})
+	mb, okB := b.(map[string]interface{})
+	if !okA || !okB {
+		if reflect.DeepEqual(a, b) {
+			return ops, nil
+		}
+		value, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, JsonPatchOperation{Op: "replace", Path: path, Value: value}), nil
+	}
+
+	keys := make([]string, 0, len(ma)+len(mb))
+	for k := range ma {
+		keys = append(keys, k)
+	}
+	for k := range mb {
+		if _, ok := ma[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var err error
+	for _, k := range keys {
+		p := path + "/" + escapeJsonPointer(k)
+		va, inA := ma[k]
+		vb, inB := mb[k]
+		switch {
+		case !inB:
+			ops = append(ops, JsonPatchOperation{Op: "remove", Path: p})
+		case !inA:
+			value, err := json.Marshal(vb)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, JsonPatchOperation{Op: "add", Path: p, Value: value})
+		default:
+			ops, err = diffJson(ops, p, va, vb)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ops, nil
+}
+
+func escapeJsonPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
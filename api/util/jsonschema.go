@@ -0,0 +1,43 @@
+package util
+
+import (
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type JsonSchemaViolation struct {
+	Field       string `json:"field"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func CompileJsonSchema(schema string) (*gojsonschema.Schema, error) {
+	return gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+}
+
+// ValidateJsonSchema validates the json documents against the schema and
+// returns the violations of the first document that does not match.
+func ValidateJsonSchema(schema string, documents ...string) ([]JsonSchemaViolation, error) {
+	s, err := CompileJsonSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, document := range documents {
+		result, err := s.Validate(gojsonschema.NewStringLoader(document))
+		if err != nil {
+			return nil, err
+		}
+		if result.Valid() {
+			continue
+		}
+		violations := make([]JsonSchemaViolation, 0, len(result.Errors()))
+		for _, e := range result.Errors() {
+			violations = append(violations, JsonSchemaViolation{
+				Field:       e.Field(),
+				Type:        e.Type(),
+				Description: e.Description(),
+			})
+		}
+		return violations, nil
+	}
+	return nil, nil
+}
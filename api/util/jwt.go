@@ -0,0 +1,45 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// SignES256JWT makes a JWT signed with ECDSA P-256 and SHA-256 as used by the
+// token based auth of APNs and by VAPID.
+func SignES256JWT(key *ecdsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) (string, error) {
+	if key == nil {
+		return "", errors.New("no key")
+	}
+	h := map[string]interface{}{
+		"alg": "ES256",
+		"typ": "JWT",
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// the signature is r || s, each padded to the size of the curve
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -11,6 +11,16 @@ import (
 )
 
 func JsonBodyMiddleware(h http.Handler) http.Handler {
+	return jsonBodyMiddleware(h, true)
+}
+
+// SecretJsonBodyMiddleware is JsonBodyMiddleware for bodies that hold secrets,
+// e.g. private keys, which are not logged.
+func SecretJsonBodyMiddleware(h http.Handler) http.Handler {
+	return jsonBodyMiddleware(h, false)
+}
+
+func jsonBodyMiddleware(h http.Handler, logBody bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		data, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -18,11 +28,15 @@ func JsonBodyMiddleware(h http.Handler) http.Handler {
 			util.WriteInternalServerError(w)
 			return
 		}
-		log.Println(string(data))
+		if logBody {
+			log.Println(string(data))
+		}
 		var jsonBody interface{}
 		err = json.Unmarshal(data, &jsonBody)
 		if err != nil {
-			log.Println(err)
+			if logBody {
+				log.Println(err)
+			}
 			util.WriteStatus(w, http.StatusBadRequest)
 			return
 		}
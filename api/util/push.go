@@ -0,0 +1,257 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+)
+
+// PUSH_CREDENTIAL_CHECK_INTERVAL is how often a cached credential is checked
+// for being rotated, e.g. by another process.
+const PUSH_CREDENTIAL_CHECK_INTERVAL = time.Minute
+
+// PushSenders are the senders of the push providers by provider name.
+type PushSenders map[string]domain.PushSender
+
+func NewPushSenders(senders ...domain.PushSender) PushSenders {
+	ret := make(PushSenders)
+	for _, s := range senders {
+		ret[s.Provider()] = s
+	}
+	return ret
+}
+
+type cachedCredential struct {
+	value      interface{}
+	updateTime *time.Time
+	checkTime  time.Time
+}
+
+// pushCredentials keeps the parsed credential of each project for one push
+// provider and parses it again once it is rotated.
+type pushCredentials struct {
+	crRepo   domain.PushCredentialRepository
+	provider string
+	parse    func(data []byte) (interface{}, error)
+
+	mu     sync.Mutex
+	values map[string]*cachedCredential
+}
+
+func (p *pushCredentials) get(ctx context.Context, pid string) (interface{}, error) {
+	p.mu.Lock()
+	c, ok := p.values[pid]
+	fresh := ok && time.Since(c.checkTime) < PUSH_CREDENTIAL_CHECK_INTERVAL
+	p.mu.Unlock()
+
+	if fresh {
+		return c.value, nil
+	}
+
+	updateTime, err := p.crRepo.GetUpdateTime(ctx, pid, p.provider)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			p.invalidate(pid)
+			return nil, fmt.Errorf("project %s has no %s credential", pid, p.provider)
+		}
+		return nil, err
+	}
+	if ok && timeEqual(updateTime, c.updateTime) {
+		p.mu.Lock()
+		c.checkTime = time.Now()
+		p.mu.Unlock()
+		return c.value, nil
+	}
+
+	credential, err := p.crRepo.Get(ctx, pid, p.provider)
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.parse(credential.Data)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s credential of project %s: %v", p.provider, pid, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[pid] = &cachedCredential{
+		value:      value,
+		updateTime: credential.UpdateTime,
+		checkTime:  time.Now(),
+	}
+	return value, nil
+}
+
+func (p *pushCredentials) invalidate(pid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.values, pid)
+}
+
+func newPushCredentials(
+	crRepo domain.PushCredentialRepository,
+	provider string,
+	parse func(data []byte) (interface{}, error),
+) *pushCredentials {
+	return &pushCredentials{
+		crRepo:   crRepo,
+		provider: provider,
+		parse:    parse,
+		values:   make(map[string]*cachedCredential),
+	}
+}
+
+// pushTimeout is how long sending to n tokens may take.
+func pushTimeout(n int) time.Duration {
+	return time.Duration(1+n/FCM_MULTICAST_MAX_TOKENS) * FCM_TIMEOUT
+}
+
+// PushNotification sends a notification of the fcm channel to its target and
+// sets the message id or error and the send time of the notification. Topics,
+// conditions and tokens go through FCM, while the devices target reaches the
+// registered devices of the project through every provider they have a token
+// for. For tokens the result of each token is returned and the tokens that are
+// reported as invalid are removed from the devices of the project.
+func PushNotification(
+	ctx context.Context,
+	senders PushSenders,
+	no *domain.Notification,
+	dvRepo domain.DeviceRepository,
+) (*domain.PushResult, error) {
+	if no.FCMTarget == nil {
+		return nil, fmt.Errorf("notification %d has no fcm target", no.ID)
+	}
+
+	// the devices get the notification as they would fetch it
+	payload := *no
+	payload.FCMTarget = nil
+	payload.FCMMessageID = nil
+	payload.FCMError = nil
+	payload.FCMSendTime = nil
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, err
+	}
+	// pushes are not personalized so placeholders left for the device to
+	// fill are dropped
+	message := &domain.PushMessage{
+		Title: domain.FillPlaceholders(no.Title, nil, false),
+		Text:  domain.FillPlaceholders(no.Text, nil, false),
+		Sound: no.Sound,
+		Data: map[string]string{
+			"type": "notification",
+			"data": string(b),
+		},
+	}
+
+	var messageID string
+	var result *domain.PushResult
+	target := no.FCMTarget
+	switch {
+	case target.Topic != "" || target.Condition != "":
+		fcm, ok := senders[domain.PUSH_PROVIDER_FCM].(*FCMClients)
+		if !ok {
+			return nil, errors.New("no fcm sender")
+		}
+		c, cancel := GetContextWithThisTimeout(ctx, FCM_TIMEOUT)
+		defer cancel()
+		if target.Topic != "" {
+			messageID, err = fcm.SendNotificationToTopic(c, no.PID, target.Topic, message.Data)
+		} else {
+			messageID, err = fcm.SendNotificationToCondition(c, no.PID, target.Condition, message.Data)
+		}
+	case target.Devices:
+		result = domain.NewPushResult()
+		errs := make([]string, 0)
+		for _, provider := range domain.PushProviders {
+			sender, ok := senders[provider]
+			if !ok {
+				continue
+			}
+			c, cancel := GetContextWithTimeout(ctx)
+			defer cancel()
+			tokens, err := dvRepo.GetPushTokens(c, no.PID, provider)
+			if err != nil {
+				return nil, err
+			}
+			if len(tokens) == 0 {
+				continue
+			}
+			res, err := pushToTokens(ctx, sender, no.PID, tokens, message, dvRepo)
+			if res != nil {
+				result.Add(res)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", provider, err))
+			}
+		}
+		if len(errs) > 0 {
+			err = errors.New(strings.Join(errs, "; "))
+		}
+	default:
+		sender, ok := senders[domain.PUSH_PROVIDER_FCM]
+		if !ok {
+			return nil, errors.New("no fcm sender")
+		}
+		result, err = pushToTokens(ctx, sender, no.PID, target.Tokens, message, dvRepo)
+	}
+
+	now := time.Now()
+	no.FCMSendTime = &now
+	no.FCMMessageID = nil
+	no.FCMError = nil
+	if messageID != "" {
+		no.FCMMessageID = &messageID
+	}
+	if err != nil {
+		e := err.Error()
+		no.FCMError = &e
+	} else if result != nil && result.FailureCount > 0 {
+		e := fmt.Sprintf("%d of %d tokens failed", result.FailureCount, result.SuccessCount+result.FailureCount)
+		no.FCMError = &e
+	}
+	if result != nil && result.SuccessCount > 0 {
+		// some devices got the notification
+		return result, nil
+	}
+	return result, err
+}
+
+// pushToTokens sends the message to the tokens of one provider and removes
+// the tokens the provider reports as invalid from the devices of the project.
+func pushToTokens(
+	ctx context.Context,
+	sender domain.PushSender,
+	pid string,
+	tokens []string,
+	message *domain.PushMessage,
+	dvRepo domain.DeviceRepository,
+) (*domain.PushResult, error) {
+	if len(tokens) == 0 {
+		return domain.NewPushResult(), nil
+	}
+	c, cancel := GetContextWithThisTimeout(ctx, pushTimeout(len(tokens)))
+	defer cancel()
+	result, err := sender.Send(c, pid, tokens, message)
+	if result != nil {
+		if invalid := result.InvalidTokens(sender.Provider()); len(invalid) > 0 {
+			c, cancel := GetContextWithTimeout(ctx)
+			defer cancel()
+			pruned, err := dvRepo.DeletePushTokens(c, pid, sender.Provider(), invalid)
+			if err != nil {
+				log.Println(err)
+			} else {
+				log.Println("just pruned", pruned, sender.Provider(), "tokens of project:", pid)
+			}
+		}
+	}
+	return result, err
+}
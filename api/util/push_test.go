@@ -0,0 +1,58 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"github.com/jackc/pgx/v4"
+)
+
+// testCredentials is a PushCredentialRepository that holds one credential of
+// each provider for every project.
+type testCredentials map[string][]byte
+
+func (t testCredentials) GetByPID(ctx context.Context, pid string) ([]domain.PushCredential, error) {
+	return nil, nil
+}
+
+func (t testCredentials) Get(ctx context.Context, pid string, provider string) (*domain.PushCredential, error) {
+	data, ok := t[provider]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	updateTime := time.Unix(0, 0)
+	return &domain.PushCredential{
+		PID:        pid,
+		Provider:   provider,
+		Data:       data,
+		UpdateTime: &updateTime,
+	}, nil
+}
+
+func (t testCredentials) GetUpdateTime(ctx context.Context, pid string, provider string) (*time.Time, error) {
+	c, err := t.Get(ctx, pid, provider)
+	if err != nil {
+		return nil, err
+	}
+	return c.UpdateTime, nil
+}
+
+func (t testCredentials) Upsert(ctx context.Context, c *domain.PushCredential) error {
+	t[c.Provider] = c.Data
+	return nil
+}
+
+func (t testCredentials) Delete(ctx context.Context, pid string, provider string) error {
+	delete(t, provider)
+	return nil
+}
+
+// failuresByToken returns the failures of the result by their token.
+func failuresByToken(result *domain.PushResult) map[string]domain.PushFailure {
+	ret := make(map[string]domain.PushFailure)
+	for _, f := range result.Failures {
+		ret[f.Token] = f
+	}
+	return ret
+}
@@ -0,0 +1,417 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"golang.org/x/crypto/hkdf"
+)
+
+// WEB_PUSH_TTL is how long push services keep a message for a browser that is
+// not connected.
+const WEB_PUSH_TTL = 24 * time.Hour
+
+// WEB_PUSH_RECORD_SIZE is the record size of the encrypted content. The whole
+// payload is sent in a single record.
+const WEB_PUSH_RECORD_SIZE = 4096
+
+// WEB_PUSH_MAX_PAYLOAD is the largest payload push services accept. They take
+// at most 4096 bytes of content, which also holds the 86 bytes of the header,
+// the padding delimiter and the 16 bytes of the authentication tag.
+const WEB_PUSH_MAX_PAYLOAD = 4096 - 86 - 17
+
+// WEB_PUSH_CONCURRENCY is how many requests are sent at the same time.
+const WEB_PUSH_CONCURRENCY = 10
+
+// WebPushSubscription is the PushSubscription of a browser as serialized by
+// PushSubscription.toJSON().
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+
+	publicKey []byte
+	auth      []byte
+}
+
+// decodeBase64URL decodes base64url with or without padding, as browsers and
+// libraries do not agree on it.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// isPublicIP reports whether the ip can be the address of a push service, so
+// that subscriptions can not make the server post to its own network.
+func isPublicIP(ip net.IP) bool {
+	return ip != nil &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast()
+}
+
+// ParseWebPushSubscription parses and validates the JSON of a subscription.
+// The endpoint must be an https url of a public host.
+func ParseWebPushSubscription(data []byte) (*WebPushSubscription, error) {
+	s := &WebPushSubscription{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return nil, errors.New("bad endpoint")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, errors.New("bad endpoint")
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return nil, errors.New("bad endpoint")
+	}
+	s.publicKey, err = decodeBase64URL(s.Keys.P256dh)
+	if err != nil {
+		return nil, errors.New("bad p256dh key")
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), s.publicKey); x == nil {
+		return nil, errors.New("bad p256dh key")
+	}
+	s.auth, err = decodeBase64URL(s.Keys.Auth)
+	if err != nil || len(s.auth) != 16 {
+		return nil, errors.New("bad auth secret")
+	}
+	return s, nil
+}
+
+// encrypt encrypts the payload for the subscription with the aes128gcm content
+// coding of RFC 8291.
+func (s *WebPushSubscription) encrypt(payload []byte) ([]byte, error) {
+	if len(payload) > WEB_PUSH_MAX_PAYLOAD {
+		return nil, errors.New("payload is too large")
+	}
+
+	curve := elliptic.P256()
+	asKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asKey.X, asKey.Y)
+	uaX, uaY := elliptic.Unmarshal(curve, s.publicKey)
+	sx, _ := curve.ScalarMult(uaX, uaY, asKey.D.Bytes())
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+
+	keyInfo := append([]byte("WebPush: info\x00"), s.publicKey...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, s.auth, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// salt || record size || key id length || key id || the only record,
+	// which ends with the last record delimiter
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[16:20], WEB_PUSH_RECORD_SIZE)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	plaintext := make([]byte, len(payload), len(payload)+1)
+	copy(plaintext, payload)
+	return gcm.Seal(header, nonce, append(plaintext, 2), nil), nil
+}
+
+// vapidTokens are the VAPID JWTs of a credential by the push service they
+// were made for, as a JWT is only valid for one push service.
+type vapidTokens struct {
+	credential *webPushCredential
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func (v *vapidTokens) get(audience string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if jwt, ok := v.tokens[audience]; ok {
+		return jwt, nil
+	}
+	jwt, err := SignES256JWT(v.credential.key, nil, map[string]interface{}{
+		"aud": audience,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": v.credential.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	v.tokens[audience] = jwt
+	return jwt, nil
+}
+
+// webPushCredential is the VAPID key pair of a project, both keys encoded in
+// base64url as expected by PushManager.subscribe(), and the contact of the
+// application server, e.g. "mailto:admin@example.com".
+type webPushCredential struct {
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+	Subject    string `json:"subject"`
+
+	key *ecdsa.PrivateKey
+}
+
+func parseWebPushCredential(data []byte) (*webPushCredential, error) {
+	c := &webPushCredential{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(c.Subject, "mailto:") && !strings.HasPrefix(c.Subject, "https://") {
+		return nil, errors.New("subject must be a mailto: or https: url")
+	}
+	d, err := decodeBase64URL(c.PrivateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("bad private_key")
+	}
+	public, err := decodeBase64URL(c.PublicKey)
+	if err != nil {
+		return nil, errors.New("bad public_key")
+	}
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d)
+	if !bytes.Equal(elliptic.Marshal(curve, key.X, key.Y), public) {
+		return nil, errors.New("public_key does not match private_key")
+	}
+	c.key = key
+	return c, nil
+}
+
+// ValidateWebPushCredential checks that the data is the credential a web push
+// sender can use, i.e. {"public_key", "private_key", "subject"}.
+func ValidateWebPushCredential(data []byte) error {
+	_, err := parseWebPushCredential(data)
+	return err
+}
+
+// WebPushSenders sends to browsers through their push services, identifying
+// the application server with the VAPID key pair of each project. The tokens
+// are the JSON of the subscriptions of the browsers.
+type WebPushSenders struct {
+	credentials *pushCredentials
+	client      *http.Client
+}
+
+func (wp *WebPushSenders) Provider() string {
+	return domain.PUSH_PROVIDER_WEBPUSH
+}
+
+func (wp *WebPushSenders) Invalidate(pid string) {
+	wp.credentials.invalidate(pid)
+}
+
+// Send posts the message to each of the subscriptions. The service worker gets
+// the message as {"title", "text", "data"}.
+func (wp *WebPushSenders) Send(ctx context.Context, pid string, tokens []string, message *domain.PushMessage) (*domain.PushResult, error) {
+	v, err := wp.credentials.get(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	credential := v.(*webPushCredential)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"title": message.Title,
+		"text":  message.Text,
+		"data":  message.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vapid := &vapidTokens{
+		credential: credential,
+		tokens:     make(map[string]string),
+	}
+
+	ret := domain.NewPushResult()
+	var mu sync.Mutex
+	var sendErr error
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < WEB_PUSH_CONCURRENCY && i < len(tokens); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				failure, err := wp.send(ctx, credential, vapid, t, payload)
+				mu.Lock()
+				if failure == nil && err == nil {
+					ret.SuccessCount++
+				} else {
+					ret.FailureCount++
+					if failure == nil {
+						failure = &domain.PushFailure{
+							Provider: domain.PUSH_PROVIDER_WEBPUSH,
+							Token:    t,
+							Error:    err.Error(),
+						}
+						if sendErr == nil {
+							sendErr = err
+						}
+					}
+					ret.Failures = append(ret.Failures, *failure)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range tokens {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ret.SuccessCount == 0 && sendErr != nil {
+		return ret, sendErr
+	}
+	return ret, nil
+}
+
+// send posts the payload to one subscription. A failure is returned if the
+// subscription is bad or the push service rejected the message and an error
+// if the push service could not be reached.
+func (wp *WebPushSenders) send(
+	ctx context.Context,
+	credential *webPushCredential,
+	vapid *vapidTokens,
+	token string,
+	payload []byte,
+) (*domain.PushFailure, error) {
+	subscription, err := ParseWebPushSubscription([]byte(token))
+	if err != nil {
+		return &domain.PushFailure{
+			Provider: domain.PUSH_PROVIDER_WEBPUSH,
+			Token:    token,
+			Error:    err.Error(),
+			Invalid:  true,
+		}, nil
+	}
+	body, err := subscription.encrypt(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	u, _ := url.Parse(subscription.Endpoint)
+	audience := u.Scheme + "://" + u.Host
+	jwt, err := vapid.get(audience)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", jwt, credential.PublicKey))
+	req.Header.Set("TTL", fmt.Sprint(int(WEB_PUSH_TTL.Seconds())))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := wp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil, nil
+	}
+	return &domain.PushFailure{
+		Provider: domain.PUSH_PROVIDER_WEBPUSH,
+		Token:    token,
+		Error:    resp.Status,
+		Invalid:  resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone,
+	}, nil
+}
+
+func NewWebPushSenders(crRepo domain.PushCredentialRepository) *WebPushSenders {
+	return &WebPushSenders{
+		credentials: newPushCredentials(crRepo, domain.PUSH_PROVIDER_WEBPUSH, func(data []byte) (interface{}, error) {
+			return parseWebPushCredential(data)
+		}),
+		client: newWebPushClient(),
+	}
+}
+
+// newWebPushClient makes a client that checks the addresses of the endpoints
+// again once resolved, and so the hosts of redirects too. It does not use a
+// proxy as the proxy would be the address checked.
+func newWebPushClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublicOnly,
+	}).DialContext
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+// dialPublicOnly refuses connections to addresses that are not public.
+func dialPublicOnly(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicIP(net.ParseIP(host)) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/doorbash/backend-services/api/domain"
+	"golang.org/x/crypto/hkdf"
+)
+
+// decryptWebPush decrypts the aes128gcm content of RFC 8291 as a browser with
+// the private key and auth secret of the subscription does.
+func decryptWebPush(private []byte, public []byte, auth []byte, content []byte) ([]byte, error) {
+	if len(content) < 21 || len(content) < 21+int(content[20]) {
+		return nil, errors.New("short header")
+	}
+	salt := content[:16]
+	rs := binary.BigEndian.Uint32(content[16:20])
+	asPublic := content[21 : 21+int(content[20])]
+	record := content[21+int(content[20]):]
+	if uint32(len(record)) > rs {
+		return nil, errors.New("more than one record")
+	}
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	if asX == nil {
+		return nil, errors.New("bad key id")
+	}
+	sx, _ := curve.ScalarMult(asX, asY, private)
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+
+	keyInfo := append([]byte("WebPush: info\x00"), public...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, auth, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext = bytes.TrimRight(plaintext, "\x00")
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 2 {
+		return nil, errors.New("no last record delimiter")
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+func mustDecodeBase64URL(t *testing.T, s string) []byte {
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestDecryptWebPush checks decryptWebPush with the example of RFC 8291
+// section 5, so that it can check encrypt.
+func TestDecryptWebPush(t *testing.T) {
+	private := mustDecodeBase64URL(t, "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94")
+	public := mustDecodeBase64URL(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	auth := mustDecodeBase64URL(t, "BTBZMqHH6r4Tts7J_aSIgg")
+	content := mustDecodeBase64URL(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+
+	plaintext, err := decryptWebPush(private, public, auth, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "When I grow up, I want to be a watermelon" {
+		t.Fatalf("got %q", plaintext)
+	}
+}
+
+// testBrowser is the key pair and auth secret of a push subscription.
+type testBrowser struct {
+	private []byte
+	public  []byte
+	auth    []byte
+}
+
+func newTestBrowser(t *testing.T) *testBrowser {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return &testBrowser{
+		private: key.D.FillBytes(make([]byte, 32)),
+		public:  elliptic.Marshal(elliptic.P256(), key.X, key.Y),
+		auth:    auth,
+	}
+}
+
+// subscription returns the JSON of the subscription of the browser to the
+// endpoint.
+func (b *testBrowser) subscription(t *testing.T, endpoint string) string {
+	data, err := json.Marshal(map[string]interface{}{
+		"endpoint": endpoint,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(b.public),
+			"auth":   base64.RawURLEncoding.EncodeToString(b.auth),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWebPushEncrypt(t *testing.T) {
+	browser := newTestBrowser(t)
+	s, err := ParseWebPushSubscription([]byte(browser.subscription(t, "https://push.example.com/a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, 100, WEB_PUSH_MAX_PAYLOAD} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+		content, err := s.encrypt(payload)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if len(content) > 4096 {
+			t.Errorf("%d bytes: content is %d bytes", size, len(content))
+		}
+		plaintext, err := decryptWebPush(browser.private, browser.public, browser.auth, content)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, payload) {
+			t.Errorf("%d bytes: decrypted payload does not match", size)
+		}
+	}
+
+	if _, err := s.encrypt(make([]byte, WEB_PUSH_MAX_PAYLOAD+1)); err == nil {
+		t.Error("no error encrypting a payload that is too large")
+	}
+}
+
+func TestParseWebPushSubscription(t *testing.T) {
+	browser := newTestBrowser(t)
+	tests := []struct {
+		endpoint string
+		ok       bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/a", true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/a", true},
+		{"https://8.8.8.8/a", true},
+		{"http://fcm.googleapis.com/fcm/send/a", false},
+		{"ftp://fcm.googleapis.com/a", false},
+		{"https:///a", false},
+		{"https://localhost/a", false},
+		{"https://LOCALHOST./a", false},
+		{"https://api.localhost/a", false},
+		{"https://127.0.0.1/a", false},
+		{"https://10.0.0.1/a", false},
+		{"https://172.16.0.1/a", false},
+		{"https://192.168.1.1:8080/a", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://0.0.0.0/a", false},
+		{"https://[::1]/a", false},
+		{"https://[fd00::1]/a", false},
+		{"https://[fe80::1]/a", false},
+	}
+	for _, test := range tests {
+		_, err := ParseWebPushSubscription([]byte(browser.subscription(t, test.endpoint)))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.endpoint, err, test.ok)
+		}
+	}
+
+	if _, err := ParseWebPushSubscription([]byte(`{"endpoint": "https://push.example.com/a", "keys": {"p256dh": "AAAA", "auth": "AAAA"}}`)); err == nil {
+		t.Error("no error parsing a subscription with bad keys")
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"8.8.8.8:443", true},
+		{"[2001:4860:4860::8888]:443", true},
+		{"127.0.0.1:443", false},
+		{"10.1.2.3:443", false},
+		{"169.254.169.254:80", false},
+		{"[::1]:443", false},
+	}
+	for _, test := range tests {
+		err := dialPublicOnly("tcp", test.address, nil)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.address, err, test.ok)
+		}
+	}
+}
+
+func newTestWebPushSenders(t *testing.T) (*WebPushSenders, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	data, err := json.Marshal(map[string]string{
+		"public_key":  public,
+		"private_key": base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))),
+		"subject":     "mailto:admin@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWebPushSenders(testCredentials{domain.PUSH_PROVIDER_WEBPUSH: data}), public
+}
+
+// useTestServer makes the sender reach the server for every host, as the
+// endpoints of the subscriptions can not be the address of the server.
+func useTestServer(wp *WebPushSenders, server *httptest.Server) {
+	client := server.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	wp.client = client
+}
+
+func TestWebPushSend(t *testing.T) {
+	browser := newTestBrowser(t)
+	wp, public := newTestWebPushSenders(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t=") ||
+			!strings.HasSuffix(r.Header.Get("Authorization"), ", k="+public) ||
+			r.Header.Get("Content-Encoding") != "aes128gcm" ||
+			r.Header.Get("TTL") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		plaintext, err := decryptWebPush(browser.private, browser.public, browser.auth, content)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		message := struct {
+			Title string            `json:"title"`
+			Text  string            `json:"text"`
+			Data  map[string]string `json:"data"`
+		}{}
+		if err := json.Unmarshal(plaintext, &message); err != nil || message.Title != "title" || message.Data["key"] != "value" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/good":
+			w.WriteHeader(http.StatusCreated)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+	useTestServer(wp, server)
+
+	tokens := []string{
+		browser.subscription(t, "https://example.com/gone"),
+		browser.subscription(t, "https://example.com/missing"),
+		browser.subscription(t, "https://example.com/busy"),
+		browser.subscription(t, "http://example.com/good"),
+	}
+	for i := 0; i < 2*WEB_PUSH_CONCURRENCY; i++ {
+		tokens = append(tokens, browser.subscription(t, "https://example.com/good"))
+	}
+
+	result, err := wp.Send(context.Background(), "p", tokens, &domain.PushMessage{
+		Title: "title",
+		Text:  "text",
+		Data:  map[string]string{"key": "value"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SuccessCount != 2*WEB_PUSH_CONCURRENCY || result.FailureCount != 4 {
+		t.Fatalf("got %d successes and %d failures, want %d and 4", result.SuccessCount, result.FailureCount, 2*WEB_PUSH_CONCURRENCY)
+	}
+
+	failures := failuresByToken(result)
+	tests := []struct {
+		token   string
+		invalid bool
+	}{
+		{tokens[0], true},
+		{tokens[1], true},
+		{tokens[2], false},
+		{tokens[3], true},
+	}
+	for _, test := range tests {
+		f, ok := failures[test.token]
+		if !ok {
+			t.Errorf("%s: no failure", test.token)
+			continue
+		}
+		if f.Invalid != test.invalid || f.Provider != domain.PUSH_PROVIDER_WEBPUSH {
+			t.Errorf("%s: got %+v, want invalid %v", test.token, f, test.invalid)
+		}
+	}
+}
+
+func TestWebPushSendUnreachable(t *testing.T) {
+	browser := newTestBrowser(t)
+	wp, _ := newTestWebPushSenders(t)
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	useTestServer(wp, server)
+	server.Close()
+
+	tokens := []string{
+		browser.subscription(t, "https://example.com/a"),
+		browser.subscription(t, "https://example.com/b"),
+	}
+	result, err := wp.Send(context.Background(), "p", tokens, &domain.PushMessage{Title: "title"})
+	if err == nil {
+		t.Fatal("no error sending to a closed server")
+	}
+	if result == nil || result.SuccessCount != 0 || result.FailureCount != 2 {
+		t.Fatalf("got %+v, want 2 failures", result)
+	}
+	for _, f := range result.Failures {
+		if f.Invalid {
+			t.Errorf("%s: an unreachable push service made the subscription invalid", f.Token)
+		}
+	}
+}
+
+func TestWebPushSendPrivateAddress(t *testing.T) {
+	browser := newTestBrowser(t)
+	wp, _ := newTestWebPushSenders(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// a public name that resolves to the address of the server is refused
+	// when dialed
+	wp.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	dial := wp.client.Transport.(*http.Transport).DialContext
+	wp.client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return dial(ctx, network, net.JoinHostPort("127.0.0.1", port))
+	}
+
+	result, err := wp.Send(context.Background(), "p", []string{browser.subscription(t, "https://example.com/a")}, &domain.PushMessage{Title: "title"})
+	if err == nil || !strings.Contains(err.Error(), "is not a public address") || result.SuccessCount != 0 {
+		t.Fatalf("got %+v and error %v, want the address refused", result, err)
+	}
+}
+
+func TestWebPushCredential(t *testing.T) {
+	_, public := newTestWebPushSenders(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name string
+		data map[string]string
+	}{
+		{"bad subject", map[string]string{
+			"public_key":  public,
+			"private_key": base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))),
+			"subject":     "admin@example.com",
+		}},
+		{"other public key", map[string]string{
+			"public_key":  public,
+			"private_key": base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))),
+			"subject":     "mailto:admin@example.com",
+		}},
+		{"short private key", map[string]string{
+			"public_key":  public,
+			"private_key": base64.RawURLEncoding.EncodeToString(new(big.Int).SetInt64(1).Bytes()),
+			"subject":     "mailto:admin@example.com",
+		}},
+	}
+	for _, test := range tests {
+		data, _ := json.Marshal(test.data)
+		if err := ValidateWebPushCredential(data); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+	// the images have no zoneinfo for the timezones of recurring notifications
+	_ "time/tzdata"
 
 	"github.com/doorbash/backend-services/api/cache"
 	_redis "github.com/doorbash/backend-services/api/cache/redis"
@@ -28,11 +32,13 @@ func UpdateRemoteConfigs(
 	pool *pgxpool.Pool,
 	rcRepo domain.RemoteConfigRepository,
 	rcCache domain.RemoteConfigCache,
+	streamPubSub domain.StreamPubSub,
+	fcm *util.FCMClients,
 ) error {
 	log.Println("UpdateRemoteConfigs()")
 	ctx, cancel := util.GetContextWithTimeout(context.Background())
 	defer cancel()
-	rows, err := pool.Query(ctx, "SELECT pid, version FROM remote_configs WHERE data IS NOT NULL")
+	rows, err := pool.Query(ctx, "SELECT pid, namespace, version FROM remote_configs WHERE data IS NOT NULL")
 	if err != nil {
 		return err
 	}
@@ -46,17 +52,18 @@ func UpdateRemoteConfigs(
 
 	for rows.Next() {
 		var pid string
+		var namespace string
 		var version int
-		err := rows.Scan(&pid, &version)
+		err := rows.Scan(&pid, &namespace, &version)
 		if err != nil {
 			return err
 		}
 
-		log.Println("pid =", pid, "version =", version)
+		log.Println("pid =", pid, "namespace =", namespace, "version =", version)
 
 		ctx, cancel := util.GetContextWithTimeout(context.Background())
 		defer cancel()
-		v, err := rcCache.GetVersionByProjectID(ctx, pid)
+		v, err := rcCache.GetVersionByProjectID(ctx, pid, namespace)
 		if err != nil && err != redis.Nil {
 			return err
 		}
@@ -64,7 +71,7 @@ func UpdateRemoteConfigs(
 		if err == redis.Nil || version > *v {
 			ctx, cancel := util.GetContextWithTimeout(context.Background())
 			defer cancel()
-			remoteConfig, err := rcRepo.GetByProjectID(ctx, pid)
+			remoteConfig, err := rcRepo.GetByProjectID(ctx, pid, namespace)
 			if err != nil {
 				log.Println(err)
 				continue
@@ -74,13 +81,24 @@ func UpdateRemoteConfigs(
 			err = rcCache.Update(ctx, remoteConfig)
 			if err != nil {
 				log.Println(err)
+			} else {
+				ctx, cancel = util.GetContextWithTimeout(context.Background())
+				defer cancel()
+				err = streamPubSub.Publish(ctx, pid, &domain.StreamEvent{
+					Type:      domain.STREAM_EVENT_RC,
+					Namespace: namespace,
+					Version:   remoteConfig.Version,
+				})
+				if err != nil {
+					log.Println(err)
+				}
 			}
 		}
 
 		if shouldSendNotification {
 			ctx, cancel = util.GetContextWithTimeout(context.Background())
 			defer cancel()
-			data, err := rcCache.GetDataByProjectID(ctx, pid)
+			data, err := rcCache.GetDataByProjectID(ctx, pid, namespace)
 			if err != nil {
 				log.Println(err)
 				continue
@@ -88,6 +106,7 @@ func UpdateRemoteConfigs(
 
 			remoteConfig := domain.RemoteConfig{
 				ProjectID: pid,
+				Namespace: namespace,
 				Version:   version,
 				Data:      *data,
 			}
@@ -99,7 +118,7 @@ func UpdateRemoteConfigs(
 			}
 			ctx, cancel = util.GetContextWithThisTimeout(context.Background(), 20*time.Second)
 			defer cancel()
-			err = util.SendNotification(ctx, pid, "all", map[string]string{
+			err = fcm.SendNotification(ctx, pid, "all", map[string]string{
 				"type": "rc",
 				"data": string(b),
 			})
@@ -112,36 +131,239 @@ func UpdateRemoteConfigs(
 	return nil
 }
 
-func UpdateNotifications(pool *pgxpool.Pool, noCache domain.NotificationCache) error {
-	log.Println("UpdateNotifications()")
+// UpdateRemoteConfigSchedules publishes the remote configs whose publish time
+// has come and reverts the ones whose revert time has come.
+func UpdateRemoteConfigSchedules(
+	scRepo domain.RemoteConfigScheduleRepository,
+	rcRepo domain.RemoteConfigRepository,
+) error {
+	log.Println("UpdateRemoteConfigSchedules()")
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	schedules, err := scRepo.GetDue(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for i := range schedules {
+		s := &schedules[i]
+		switch s.Status {
+		case domain.RC_SCHEDULE_STATUS_SCHEDULED:
+			err = publishRemoteConfigSchedule(rcRepo, s)
+		case domain.RC_SCHEDULE_STATUS_PUBLISHED:
+			err = revertRemoteConfigSchedule(rcRepo, s)
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		err = scRepo.Update(ctx, s)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+func publishRemoteConfigSchedule(rcRepo domain.RemoteConfigRepository, s *domain.RemoteConfigSchedule) error {
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	remoteConfig, err := rcRepo.Patch(ctx, s.PID, s.Namespace, 0, func(rc *domain.RemoteConfig) error {
+		baseVersion := rc.Version
+		s.BaseVersion = &baseVersion
+		rc.Data = string(s.Data)
+		if len(s.Rules) > 0 {
+			rules := string(s.Rules)
+			rc.Rules = &rules
+		}
+		return nil
+	})
+	if err == pgx.ErrNoRows {
+		log.Println("project", s.PID, "has no remote config. canceling schedule", s.ID)
+		s.Status = domain.RC_SCHEDULE_STATUS_CANCELED
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.PublishVersion = &remoteConfig.Version
+	if s.RevertTime != nil {
+		s.Status = domain.RC_SCHEDULE_STATUS_PUBLISHED
+	} else {
+		s.Status = domain.RC_SCHEDULE_STATUS_FINISHED
+	}
+	log.Println("just published schedule", s.ID, "of project", s.PID, "as version", remoteConfig.Version)
+	return nil
+}
+
+func revertRemoteConfigSchedule(rcRepo domain.RemoteConfigRepository, s *domain.RemoteConfigSchedule) error {
+	s.Status = domain.RC_SCHEDULE_STATUS_FINISHED
+	if s.BaseVersion == nil || s.PublishVersion == nil {
+		return nil
+	}
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	base, err := rcRepo.GetVersion(ctx, s.PID, s.Namespace, *s.BaseVersion)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	remoteConfig, err := rcRepo.Patch(ctx, s.PID, s.Namespace, *s.PublishVersion, func(rc *domain.RemoteConfig) error {
+		rc.Data = base.Data
+		rc.Rules = base.Rules
+		return nil
+	})
+	if err == domain.ErrRemoteConfigVersionMismatch || err == pgx.ErrNoRows {
+		// somebody has changed the remote config since it was published
+		log.Println("remote config of project", s.PID, "has changed since schedule", s.ID, "was published. not reverting")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.RevertVersion = &remoteConfig.Version
+	log.Println("just reverted schedule", s.ID, "of project", s.PID, "to version", *s.BaseVersion)
+	return nil
+}
+
+func UpdateExperimentExposures(
+	pool *pgxpool.Pool,
+	exRepo domain.ExperimentRepository,
+	rcCache domain.RemoteConfigCache,
+) error {
+	log.Println("UpdateExperimentExposures()")
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	rows, err := pool.Query(ctx, "SELECT DISTINCT pid FROM experiments WHERE status = 1 OR stop_time > $1", time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	pids := make([]string, 0)
+	for rows.Next() {
+		var pid string
+		err := rows.Scan(&pid)
+		if err != nil {
+			return err
+		}
+		pids = append(pids, pid)
+	}
+
+	for _, pid := range pids {
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		// the exposures are estimates of all devices so far, so storing them
+		// again after a failed write loses nothing
+		exposures, err := rcCache.GetExposures(ctx, pid)
+		if err != nil {
+			return err
+		}
+
+		for k, count := range exposures {
+			parts := strings.SplitN(k, ".", 2)
+			if len(parts) != 2 {
+				log.Println("bad exposure key:", k)
+				continue
+			}
+			id, err := strconv.Atoi(parts[0])
+			if err != nil {
+				log.Println("bad exposure key:", k)
+				continue
+			}
+			if count == 0 {
+				continue
+			}
+			ctx, cancel = util.GetContextWithTimeout(context.Background())
+			defer cancel()
+			err = exRepo.SetExposures(ctx, id, parts[1], count)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			log.Println("just set", count, "exposures for variant", parts[1], "of experiment", id)
+		}
+	}
+
+	return nil
+}
+
+// DeliverNotifications activates the scheduled notifications and the
+// occurrences of the recurring ones that are due, and pushes the active ones of
+// the fcm channel that have not been pushed yet. It runs more often than
+// UpdateNotifications so that they go out close to their schedule time.
+func DeliverNotifications(
+	pool *pgxpool.Pool,
+	noRepo domain.NotificationRepository,
+	dvRepo domain.DeviceRepository,
+	noCache domain.NotificationCache,
+	streamPubSub domain.StreamPubSub,
+	pushSenders util.PushSenders,
+) error {
 	now := time.Now()
 
-	// scheduled(2) -> active(1)
+	made, err := materializeRecurrences(pool, noRepo, now)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// scheduled -> active
 	ctx, cancel := util.GetContextWithTimeout(context.Background())
 	defer cancel()
-	cmd, err := pool.Exec(ctx, "UPDATE notifications SET status = 1, active_time = $1 WHERE status = 2 AND schedule_time <= $1", now)
+	count, err := noRepo.ActivateScheduled(ctx, now, domain.NotificationLoopActor)
 	if err != nil {
 		return err
 	}
 
-	if cmd.RowsAffected() > 0 {
-		log.Println("just set", cmd.RowsAffected(), "notifications as active")
+	if count > 0 {
+		log.Println("just set", count, "notifications as active")
 	}
 
-	// active(1), scheduled(2) -> finished(4)
-	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	err = pushNotifications(pool, noRepo, dvRepo, pushSenders, now)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// the clients get the new active notifications right away rather than
+	// on the next run of UpdateNotifications
+	if made > 0 || count > 0 {
+		return refreshNotifications(pool, noCache, streamPubSub)
+	}
+
+	return nil
+}
+
+func UpdateNotifications(
+	pool *pgxpool.Pool,
+	noRepo domain.NotificationRepository,
+	noCache domain.NotificationCache,
+	streamPubSub domain.StreamPubSub,
+) error {
+	log.Println("UpdateNotifications()")
+	now := time.Now()
+
+	// active, scheduled, paused -> finished
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
 	defer cancel()
-	cmd, err = pool.Exec(ctx, "UPDATE notifications SET status = 4 WHERE (status = 1 OR status = 2) AND expire_time <= $1", now)
+	count, err := noRepo.FinishExpired(ctx, now, domain.NotificationLoopActor)
 	if err != nil {
 		return err
 	}
 
-	if cmd.RowsAffected() > 0 {
-		log.Println("just set", cmd.RowsAffected(), "notifications as finished")
+	if count > 0 {
+		log.Println("just set", count, "notifications as finished")
 	}
 
-	// udpate notification views_count, clicks_count
-	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	return refreshNotifications(pool, noCache, streamPubSub)
+}
+
+// refreshNotifications stores the counters of the active notifications of each
+// project and caches them for the clients.
+func refreshNotifications(pool *pgxpool.Pool, noCache domain.NotificationCache, streamPubSub domain.StreamPubSub) error {
+	// udpate notification views_count, clicks_count, reach_count
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
 	defer cancel()
 	rows, err := pool.Query(ctx, "SELECT DISTINCT pid FROM notifications WHERE status = 1")
 	if err != nil {
@@ -155,59 +377,301 @@ func UpdateNotifications(pool *pgxpool.Pool, noCache domain.NotificationCache) e
 			return err
 		}
 
-		err = updateNotificationData(pool, noCache, pid)
+		// the counters are flushed before the cache is updated since it
+		// drops the counters of notifications that are no longer active
+		err = flushNotificationCounters(pool, noCache, pid)
+		if err != nil {
+			log.Println(err)
+		}
 
+		err = updateNotificationData(pool, noCache, streamPubSub, pid)
 		if err != nil {
 			log.Println(err)
 		}
+	}
+
+	return nil
+}
 
+// materializeRecurrences makes an active notification of each due occurrence
+// of the recurring notifications and moves them on to their next occurrence.
+// Occurrences that were missed while the loop was not running are skipped.
+func materializeRecurrences(pool *pgxpool.Pool, noRepo domain.NotificationRepository, now time.Time) (int, error) {
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	rows, err := pool.Query(ctx, "SELECT id FROM notifications WHERE status = 2 AND recurrence IS NOT NULL AND schedule_time <= $1 + (CASE WHEN local_time THEN INTERVAL '14 hours' ELSE INTERVAL '0' END)", now)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	made := 0
+
+	for _, id := range ids {
 		ctx, cancel = util.GetContextWithTimeout(context.Background())
 		defer cancel()
-		views, err := noCache.GetViewsByProjectID(ctx, pid)
+		parent, err := noRepo.GetByID(ctx, id)
 		if err != nil {
-			return err
+			log.Println(err)
+			continue
 		}
 
-		if views != "0" {
-			ctx, cancel = util.GetContextWithTimeout(context.Background())
-			defer cancel()
-			cmd, err = pool.Exec(ctx, "UPDATE notifications SET views_count = views_count + $1 WHERE status = 1 AND pid = $2", views, pid)
-			if err != nil {
-				return err
-			}
+		occurrence := *parent.ScheduleTime
+		expireTime := occurrence.Add(time.Duration(parent.Recurrence.Duration) * time.Minute)
+		if expireTime.After(*parent.ExpireTime) {
+			expireTime = *parent.ExpireTime
+		}
+		no := *parent
+		no.ID = 0
+		no.Status = domain.NOTIFICATION_STATUS_ACTIVE
+		no.CreateTime = &now
+		no.ActiveTime = &now
+		no.ScheduleTime = &occurrence
+		no.ExpireTime = &expireTime
+		no.Recurrence = nil
+		no.ParentID = &parent.ID
+		no.ViewsCount = 0
+		no.ClicksCount = 0
+		no.ReachCount = 0
+		no.FCMMessageID = nil
+		no.FCMError = nil
+		no.FCMSendTime = nil
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		if err := noRepo.Insert(ctx, &no, domain.NotificationLoopActor); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Println("just made notification", no.ID, "of recurring notification", parent.ID)
+		made++
 
-			if cmd.RowsAffected() > 0 {
-				log.Println("just added", views, "views for", cmd.RowsAffected(), "notifications of project:", pid)
-			}
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		if parent.Advance(now) {
+			err = noRepo.Update(ctx, parent)
+		} else if err = parent.SetStatus(domain.NOTIFICATION_STATUS_FINISHED); err == nil {
+			err = noRepo.UpdateStatus(ctx, parent, domain.NOTIFICATION_STATUS_SCHEDULED, domain.NotificationLoopActor)
 		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return made, nil
+}
 
-		rClicks, err := noCache.GetClicksByProjectID(ctx, pid)
+// pushNotifications sends the active notifications of the fcm channel that
+// have not been pushed yet. They are claimed by setting their send time first,
+// so each notification is pushed at most once.
+func pushNotifications(
+	pool *pgxpool.Pool,
+	noRepo domain.NotificationRepository,
+	dvRepo domain.DeviceRepository,
+	pushSenders util.PushSenders,
+	now time.Time,
+) error {
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	rows, err := pool.Query(ctx, "UPDATE notifications SET fcm_send_time = $1 WHERE channel = 'fcm' AND status = 1 AND fcm_send_time IS NULL RETURNING id", now)
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
+	for _, id := range ids {
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		no, err := noRepo.GetByID(ctx, id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		_, err = util.PushNotification(context.Background(), pushSenders, no, dvRepo)
+		if err != nil {
+			log.Println(err)
+		} else {
+			log.Println("just pushed notification", id, "of project:", no.PID)
+		}
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		if err := noRepo.UpdateFCMResult(ctx, no); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+func flushNotificationCounters(pool *pgxpool.Pool, noCache domain.NotificationCache, pid string) error {
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	views, err := noCache.GetAndResetViewsByProjectID(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	clicks, err := noCache.GetAndResetClicksByProjectID(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(views))
+	for id := range views {
+		ids = append(ids, id)
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	reach, err := noCache.GetReachByProjectID(ctx, pid, ids)
+	if err != nil {
+		return err
+	}
+
+	err = flushNotificationStats(pool, noCache, pid)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if views[id] == "0" && (clicks[id] == "" || clicks[id] == "0") && reach[id] == 0 {
+			continue
+		}
+		v, _ := strconv.Atoi(views[id])
+		c, _ := strconv.Atoi(clicks[id])
+		// the reach is an estimate of all devices so far and not an increment.
+		// it never goes down in case the devices are evicted from redis.
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		_, err := pool.Exec(
+			ctx,
+			"UPDATE notifications SET views_count = views_count + $1, clicks_count = clicks_count + $2, reach_count = GREATEST(reach_count, $3) WHERE pid = $4 AND id = $5",
+			v,
+			c,
+			reach[id],
+			pid,
+			id,
+		)
 		if err != nil {
 			return err
 		}
+	}
 
-		for k, v := range rClicks {
-			if v == "0" {
-				continue
-			}
-			ctx, cancel = util.GetContextWithTimeout(context.Background())
-			defer cancel()
-			_, err := pool.Exec(ctx, "UPDATE notifications SET clicks_count = clicks_count + $1 WHERE status = 1 AND id = $2", v, k)
-			if err != nil {
-				return err
-			}
+	return nil
+}
+
+// flushNotificationStats adds the views and clicks reported since the last
+// flush to the hourly buckets of the notifications by app version.
+func flushNotificationStats(pool *pgxpool.Pool, noCache domain.NotificationCache, pid string) error {
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	views, err := noCache.GetAndResetAppVersionViewsByProjectID(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	clicks, err := noCache.GetAndResetAppVersionClicksByProjectID(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for k := range views {
+		keys[k] = true
+	}
+	for k := range clicks {
+		keys[k] = true
+	}
+
+	bucket := time.Now().UTC().Truncate(time.Hour)
+	for k := range keys {
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		nid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		appVersion, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		v, _ := strconv.Atoi(views[k])
+		c, _ := strconv.Atoi(clicks[k])
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		_, err = pool.Exec(
+			ctx,
+			`INSERT INTO notification_stats (nid, bucket, app_version, views, clicks) SELECT id, $3, $4, $5, $6 FROM notifications WHERE pid = $1 AND id = $2
+ON CONFLICT (nid, bucket, app_version) DO UPDATE SET views = notification_stats.views + EXCLUDED.views, clicks = notification_stats.clicks + EXCLUDED.clicks`,
+			pid,
+			nid,
+			bucket,
+			appVersion,
+			v,
+			c,
+		)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func updateNotificationData(pool *pgxpool.Pool, noCache domain.NotificationCache, pid string) error {
+func updateNotificationData(pool *pgxpool.Pool, noCache domain.NotificationCache, streamPubSub domain.StreamPubSub, pid string) error {
+	return updateProjectData(pool, noCache, streamPubSub, pid, "notifications_data", domain.STREAM_EVENT_NOTIFICATIONS)
+}
+
+// projectDataCache is where the clients get the active notifications or
+// in-app messages of a project from.
+type projectDataCache interface {
+	GetETagByProjectID(ctx context.Context, pid string) (string, error)
+	UpdateProjectData(ctx context.Context, pid string, ids string, data string, t time.Time, expire time.Duration) error
+}
+
+// updateProjectData caches what the database function fn returns for the
+// project and tells its clients with an event of type eventType if it changed.
+func updateProjectData(
+	pool *pgxpool.Pool,
+	cache projectDataCache,
+	streamPubSub domain.StreamPubSub,
+	pid string,
+	fn string,
+	eventType string,
+) error {
 	ctx, cancel := util.GetContextWithTimeout(context.Background())
 	defer cancel()
 
-	row := pool.QueryRow(ctx, "SELECT _active_time, _ids, _data FROM notifications_data($1)", pid)
+	row := pool.QueryRow(ctx, fmt.Sprintf("SELECT _active_time, _ids, _data FROM %s($1)", fn), pid)
 	var activeTime pgtype.Timestamptz
 	var ids pgtype.Text
 	var data pgtype.Text
@@ -233,7 +697,182 @@ func updateNotificationData(pool *pgxpool.Pool, noCache domain.NotificationCache
 
 	ctx, cancel = util.GetContextWithTimeout(context.Background())
 	defer cancel()
-	return noCache.UpdateProjectData(ctx, pid, ids.String, data.String, activeTime.Time, 15*time.Minute)
+	etag, err := cache.GetETagByProjectID(ctx, pid)
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	err = cache.UpdateProjectData(ctx, pid, ids.String, data.String, activeTime.Time, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	newEtag, err := cache.GetETagByProjectID(ctx, pid)
+	if err != nil || newEtag == etag {
+		return err
+	}
+
+	// the set of notifications or messages has changed
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	t := activeTime.Time
+	return streamPubSub.Publish(ctx, pid, &domain.StreamEvent{
+		Type: eventType,
+		Time: &t,
+	})
+}
+
+func UpdateInAppMessages(
+	pool *pgxpool.Pool,
+	msRepo domain.InAppMessageRepository,
+	msCache domain.InAppMessageCache,
+	streamPubSub domain.StreamPubSub,
+) error {
+	log.Println("UpdateInAppMessages()")
+	now := time.Now()
+
+	// scheduled -> active
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	count, err := msRepo.ActivateScheduled(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		log.Println("just set", count, "in-app messages as active")
+	}
+
+	// active, scheduled, paused -> finished
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	count, err = msRepo.FinishExpired(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		log.Println("just set", count, "in-app messages as finished")
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	rows, err := pool.Query(ctx, "SELECT DISTINCT pid FROM in_app_messages WHERE status = 1")
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var pid string
+		err := rows.Scan(&pid)
+		if err != nil {
+			return err
+		}
+
+		// the counters are flushed before the cache is updated since it
+		// drops the counters of messages that are no longer active
+		err = flushInAppMessageCounters(pool, msCache, pid)
+		if err != nil {
+			log.Println(err)
+		}
+
+		err = updateProjectData(pool, msCache, streamPubSub, pid, "in_app_messages_data", domain.STREAM_EVENT_MESSAGES)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+func flushInAppMessageCounters(pool *pgxpool.Pool, msCache domain.InAppMessageCache, pid string) error {
+	ctx, cancel := util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	views, err := msCache.GetAndResetViewsByProjectID(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = util.GetContextWithTimeout(context.Background())
+	defer cancel()
+	clicks, err := msCache.GetAndResetClicksByProjectID(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	for id := range views {
+		if views[id] == "0" && (clicks[id] == "" || clicks[id] == "0") {
+			continue
+		}
+		v, _ := strconv.Atoi(views[id])
+		c, _ := strconv.Atoi(clicks[id])
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		_, err := pool.Exec(
+			ctx,
+			"UPDATE in_app_messages SET views_count = views_count + $1, clicks_count = clicks_count + $2 WHERE pid = $3 AND id = $4",
+			v,
+			c,
+			pid,
+			id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const EVENTS_BATCH_SIZE = 500
+
+// PersistEvents moves the events buffered in redis to postgres.
+func PersistEvents(evQueue domain.EventQueue, evRepo domain.EventRepository) error {
+	for {
+		ctx, cancel := util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		queued, err := evQueue.Read(ctx, EVENTS_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		if len(queued) == 0 {
+			return nil
+		}
+
+		ids := make([]string, len(queued))
+		events := make([]domain.Event, len(queued))
+		for i, qe := range queued {
+			ids[i] = qe.ID
+			events[i] = qe.Event
+		}
+
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		dropped, err := evRepo.InsertBatch(ctx, events)
+		if err != nil {
+			return err
+		}
+		if dropped > 0 {
+			log.Println("just dropped", dropped, "events that could not be stored")
+		}
+
+		ctx, cancel = util.GetContextWithTimeout(context.Background())
+		defer cancel()
+		err = evQueue.Ack(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		log.Println("just persisted", len(events), "events")
+
+		if len(queued) < EVENTS_BATCH_SIZE {
+			return nil
+		}
+	}
 }
 
 func main() {
@@ -262,17 +901,62 @@ func main() {
 	}
 
 	rcRepo := _pg.NewRemoteConfigPostgresRepository(pool)
+	exRepo := _pg.NewExperimentPostgresRepository(pool)
+	scRepo := _pg.NewRemoteConfigSchedulePostgresRepository(pool)
+	evRepo := _pg.NewEventPostgresRepository(pool)
+	noRepo := _pg.NewNotificationPostgresRepository(pool)
+	dvRepo := _pg.NewDevicePostgresRepository(pool)
+	msRepo := _pg.NewInAppMessagePostgresRepository(pool)
+
+	credentialsKey, err := util.ParseEncryptionKey(os.Getenv("PUSH_CREDENTIALS_KEY"))
+	if err != nil {
+		log.Println("push credentials can not be read:", err)
+	}
+	crRepo := _pg.NewPushCredentialPostgresRepository(pool, credentialsKey)
+	fcm := util.NewFCMClients(crRepo)
+	pushSenders := util.NewPushSenders(
+		fcm,
+		util.NewAPNsSenders(crRepo, os.Getenv("APNS_HOST")),
+		util.NewWebPushSenders(crRepo),
+	)
 
 	noCache := _redis.NewNotificationRedisCache()
+	msCache := _redis.NewInAppMessageRedisCache()
 	rcCache := _redis.NewRemoteConfigRedisCache(24 * time.Hour)
+	streamPubSub := _redis.NewStreamRedisPubSub()
+	evQueue := _redis.NewEventRedisQueue()
 
-	if err := cache.InitCacheScripts(rcCache, noCache); err != nil {
+	if err := cache.InitCacheScripts(rcCache, noCache, msCache, evQueue); err != nil {
 		log.Fatalln(err)
 	}
 
 	go func() {
 		for {
-			err := UpdateNotifications(pool, noCache)
+			err := PersistEvents(evQueue, evRepo)
+			if err != nil {
+				log.Println(err)
+			}
+			time.Sleep(30 * time.Second)
+		}
+	}()
+
+	go func() {
+		for {
+			err := DeliverNotifications(pool, noRepo, dvRepo, noCache, streamPubSub, pushSenders)
+			if err != nil {
+				log.Println(err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+
+	go func() {
+		for {
+			err := UpdateNotifications(pool, noRepo, noCache, streamPubSub)
+			if err != nil {
+				log.Println(err)
+			}
+			err = UpdateInAppMessages(pool, msRepo, msCache, streamPubSub)
 			if err != nil {
 				log.Println(err)
 			}
@@ -281,7 +965,15 @@ func main() {
 	}()
 
 	for {
-		err := UpdateRemoteConfigs(pool, rcRepo, rcCache)
+		err := UpdateRemoteConfigSchedules(scRepo, rcRepo)
+		if err != nil {
+			log.Println(err)
+		}
+		err = UpdateRemoteConfigs(pool, rcRepo, rcCache, streamPubSub, fcm)
+		if err != nil {
+			log.Println(err)
+		}
+		err = UpdateExperimentExposures(pool, exRepo, rcCache)
 		if err != nil {
 			log.Println(err)
 		}